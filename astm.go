@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin/binding"
+	log "github.com/sirupsen/logrus"
+	"rtcgw/astm"
+	"rtcgw/config"
+	"rtcgw/models"
+	"rtcgw/tasks"
+	"sync"
+)
+
+// startASTMServer receives GeneXpert results from the configured instruments over ASTM on astm_port
+func startASTMServer(wg *sync.WaitGroup) {
+	defer wg.Done()
+	server := &astm.Server{
+		Addr:    ":" + config.RTCGwConf.Server.ASTMPort,
+		Handler: handleASTMResults,
+	}
+	for _, instrument := range config.RTCGwConf.Server.ASTMInstruments {
+		server.Instruments = append(server.Instruments, astm.Instrument{
+			Name: instrument.Name, Address: instrument.Address, FacilityID: instrument.FacilityDHIS2ID})
+	}
+	if len(server.Instruments) == 0 {
+		log.Warn("No astm_instruments are configured, so all ASTM results will be discarded")
+	}
+	log.Infof("Receiving ASTM results on %s", server.Addr)
+	if err := server.ListenAndServe(); err != nil {
+		log.Fatalf("Could not start ASTM server: %v", err)
+	}
+}
+
+// handleASTMResults queues the valid results received from an instrument. ASTM has no acknowledgment of
+// messages, so invalid results are only logged
+func handleASTMResults(instrument astm.Instrument, results []astm.Result) {
+	for _, astmResult := range results {
+		result := models.LabXpertResultFromASTM(astmResult)
+		logger := log.WithFields(log.Fields{
+			"instrument": instrument.Name, "specimen_id": astmResult.SpecimenID, "patient_id": result.PatientID})
+		if err := binding.Validator.ValidateStruct(&result); err != nil {
+			logger.WithField("errors", models.FormatValidationError(err)).Warn("Discarding invalid ASTM results")
+			continue
+		}
+		// instruments may send results again, e.g. when they are resent from the instrument's history
+		taskID := fmt.Sprintf("%s:astm:%s:%s:%s:%s",
+			tasks.TypeSendResults, instrument.Name, result.PatientID, astmResult.SpecimenID, astmResult.Completed)
+		submission, err := queueLabResult(taskID, result)
+		if err != nil {
+			logger.WithError(err).Error("Failed to queue ASTM results")
+			continue
+		}
+		logger.WithField("submission_id", submission.ID).Info("Queued ASTM results")
+	}
+}
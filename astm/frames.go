@@ -0,0 +1,132 @@
+// Package astm receives results from laboratory instruments such as GeneXpert analyzers over ASTM E1381
+// (low-level framing) and parses their ASTM E1394 records
+package astm
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ASTM E1381 control characters
+const (
+	STX = 0x02
+	ETX = 0x03
+	EOT = 0x04
+	ENQ = 0x05
+	ACK = 0x06
+	NAK = 0x15
+	ETB = 0x17
+	LF  = 0x0a
+	CR  = 0x0d
+)
+
+// MaxFrameText is the maximum length of the text of a frame. Longer records are split into intermediate frames
+const MaxFrameText = 240
+
+// Errors of received frames, which are answered with a NAK
+var (
+	ErrChecksum    = errors.New("frame checksum mismatch")
+	ErrFrameNumber = errors.New("unexpected frame number")
+	ErrFrame       = errors.New("malformed frame")
+)
+
+// Frame is a received frame
+type Frame struct {
+	Number int
+	Text   string
+	Final  bool // the frame ends with ETX rather than ETB
+}
+
+// Checksum returns the checksum of a frame, the modulo 256 sum of the frame number, text and ETX or ETB, as
+// two uppercase hexadecimal characters
+func Checksum(numberTextEnd []byte) string {
+	var sum byte
+	for _, b := range numberTextEnd {
+		sum += b
+	}
+	return fmt.Sprintf("%02X", sum)
+}
+
+// EncodeFrame returns the frame <STX> FN text <ETB|ETX> C1 C2 <CR><LF>
+func EncodeFrame(number int, text string, final bool) []byte {
+	end := byte(ETB)
+	if final {
+		end = ETX
+	}
+	body := append([]byte{byte('0' + number%8)}, text...)
+	body = append(body, end)
+	frame := append([]byte{STX}, body...)
+	frame = append(frame, Checksum(body)...)
+	return append(frame, CR, LF)
+}
+
+// Frames splits the records of a message into frames numbered from 1. Each record ends with a carriage return
+// and records longer than MaxFrameText are sent in intermediate frames ending with ETB
+func Frames(records []string) [][]byte {
+	var frames [][]byte
+	number := 1
+	for _, record := range records {
+		text := record + "\r"
+		for len(text) > MaxFrameText {
+			frames = append(frames, EncodeFrame(number, text[:MaxFrameText], false))
+			text = text[MaxFrameText:]
+			number++
+		}
+		frames = append(frames, EncodeFrame(number, text, true))
+		number++
+	}
+	return frames
+}
+
+// readFrame reads a frame whose STX has already been read, checking its checksum
+func readFrame(r *bufio.Reader) (Frame, error) {
+	number, err := r.ReadByte()
+	if err != nil {
+		return Frame{}, err
+	}
+	if number == STX || number == EOT || number == ENQ {
+		_ = r.UnreadByte()
+		return Frame{}, fmt.Errorf("%w: frame without a frame number", ErrFrame)
+	}
+	body := []byte{number}
+	var frame Frame
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return Frame{}, err
+		}
+		if b == STX || b == EOT || b == ENQ {
+			// leave the control character for the receiver, the sender having abandoned the frame
+			_ = r.UnreadByte()
+			return Frame{}, fmt.Errorf("%w: unexpected control character %#x", ErrFrame, b)
+		}
+		body = append(body, b)
+		if b == ETX || b == ETB {
+			frame.Final = b == ETX
+			break
+		}
+		if len(body) > MaxFrameText+2 {
+			return Frame{}, fmt.Errorf("%w: frame longer than %d characters", ErrFrame, MaxFrameText)
+		}
+	}
+	trailer := make([]byte, 4)
+	for i := range trailer {
+		if trailer[i], err = r.ReadByte(); err != nil {
+			return Frame{}, err
+		}
+	}
+	if trailer[2] != CR || trailer[3] != LF {
+		return Frame{}, fmt.Errorf("%w: frame does not end with CR LF", ErrFrame)
+	}
+	if !strings.EqualFold(string(trailer[:2]), Checksum(body)) {
+		return Frame{}, fmt.Errorf("%w: got %s, expected %s", ErrChecksum, trailer[:2], Checksum(body))
+	}
+	if number < '0' || number > '7' {
+		return Frame{}, fmt.Errorf("%w: %q", ErrFrameNumber, number)
+	}
+	frame.Number = int(number - '0')
+	frame.Text = string(body[1 : len(body)-1])
+	return frame, nil
+}
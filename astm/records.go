@@ -0,0 +1,195 @@
+package astm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Record is an ASTM E1394 record. Fields are numbered as in the standard, so Field(1) is the record type and,
+// for the header, Field(2) the delimiter definition
+type Record struct {
+	Type       string
+	fields     []string
+	delimiters delimiters
+}
+
+type delimiters struct {
+	field, repeat, component, escape byte
+}
+
+// Field returns the unescaped field n, including any repeats and components
+func (r *Record) Field(n int) string {
+	if n < 1 || n > len(r.fields) {
+		return ""
+	}
+	if r.Type == "H" && n == 2 {
+		return r.fields[1]
+	}
+	return r.delimiters.unescape(r.fields[n-1])
+}
+
+// Component returns component c of the first repeat of field n
+func (r *Record) Component(n, c int) string {
+	if n < 1 || n > len(r.fields) {
+		return ""
+	}
+	field := strings.SplitN(r.fields[n-1], string(r.delimiters.repeat), 2)[0]
+	components := strings.Split(field, string(r.delimiters.component))
+	if c < 1 || c > len(components) {
+		return ""
+	}
+	return r.delimiters.unescape(components[c-1])
+}
+
+func (d delimiters) unescape(value string) string {
+	if strings.IndexByte(value, d.escape) < 0 {
+		return value
+	}
+	e := string(d.escape)
+	return strings.NewReplacer(e+"F"+e, string(d.field), e+"R"+e, string(d.repeat),
+		e+"S"+e, string(d.component), e+"E"+e, e).Replace(value)
+}
+
+// Message is the records of a message, from its header (H) to its terminator (L)
+type Message struct {
+	Records []*Record
+}
+
+// ParseMessages parses the records of a transmission, which are separated by carriage returns, into messages
+func ParseMessages(text string) ([]Message, error) {
+	var messages []Message
+	var current *Message
+	var d delimiters
+	for _, line := range strings.FieldsFunc(text, func(r rune) bool { return r == '\r' || r == '\n' }) {
+		if line[0] == 'H' {
+			if current != nil {
+				return nil, fmt.Errorf("%w: message without a terminator record", ErrRecord)
+			}
+			if len(line) < 5 {
+				return nil, fmt.Errorf("%w: invalid header record %q", ErrRecord, line)
+			}
+			d = delimiters{field: line[1], repeat: line[2], component: line[3], escape: line[4]}
+			current = &Message{}
+		}
+		if current == nil {
+			return nil, fmt.Errorf("%w: %q record outside a message", ErrRecord, line[:1])
+		}
+		fields := strings.Split(line, string(d.field))
+		current.Records = append(current.Records, &Record{Type: fields[0], fields: fields, delimiters: d})
+		if fields[0] == "L" {
+			messages = append(messages, *current)
+			current = nil
+		}
+	}
+	if current != nil {
+		return nil, fmt.Errorf("%w: message without a terminator record", ErrRecord)
+	}
+	if len(messages) == 0 {
+		return nil, fmt.Errorf("%w: no header record", ErrRecord)
+	}
+	return messages, nil
+}
+
+// ErrRecord is returned for transmissions whose records are not a valid ASTM E1394 message
+var ErrRecord = errors.New("invalid records")
+
+// Result is a GeneXpert test result from an order record and its result records
+type Result struct {
+	Instrument string // the sender name of the header
+	PatientID  string
+	SpecimenID string
+	MTB        string
+	RR         string
+	Completed  string // the date and time the test was completed, YYYYMMDDHHMMSS
+	FacilityID string // the facility of the instrument
+}
+
+// Results returns the results of the message's orders that have an MTB result. GeneXpert sends the result of
+// the test as a whole, e.g. "MTB DETECTED HIGH;Rif Resistance NOT DETECTED", and of each analyte, the analyte
+// name being the seventh component of the universal test id
+func (m *Message) Results() []Result {
+	var results []Result
+	var instrument, patientID, timestamp string
+	var current *Result
+	flush := func() {
+		if current != nil && current.MTB != "" {
+			if current.Completed == "" {
+				current.Completed = timestamp
+			}
+			results = append(results, *current)
+		}
+		current = nil
+	}
+	for _, record := range m.Records {
+		switch record.Type {
+		case "H":
+			instrument, timestamp = record.Component(5, 1), record.Field(14)
+		case "P":
+			flush()
+			patientID = firstNonEmpty(record.Component(3, 1), record.Component(4, 1), record.Component(5, 1))
+		case "O":
+			flush()
+			current = &Result{Instrument: instrument, PatientID: patientID, SpecimenID: record.Component(3, 1)}
+		case "R":
+			if current == nil {
+				current = &Result{Instrument: instrument, PatientID: patientID}
+			}
+			current.addResult(record)
+		case "L":
+			flush()
+		}
+	}
+	flush()
+	return results
+}
+
+func (r *Result) addResult(record *Record) {
+	value := strings.TrimSpace(record.Component(4, 1))
+	if value == "" {
+		return
+	}
+	if completed := firstNonEmpty(record.Field(13), record.Field(12)); completed != "" {
+		r.Completed = completed
+	}
+	switch analyte := strings.ToUpper(record.Component(3, 7)); {
+	case strings.HasPrefix(analyte, "RIF"):
+		r.RR = value
+	case strings.HasPrefix(analyte, "MTB"):
+		r.MTB = value
+	case analyte == "":
+		for _, part := range strings.Split(value, ";") {
+			part = strings.TrimSpace(part)
+			upper := strings.ToUpper(part)
+			switch {
+			case strings.HasPrefix(upper, "RIF RESISTANCE "):
+				r.RR = strings.TrimSpace(part[len("RIF RESISTANCE "):])
+			case strings.HasPrefix(upper, "MTB "):
+				r.MTB = strings.TrimSpace(part[len("MTB "):])
+			case r.MTB == "" && (upper == "ERROR" || upper == "INVALID" || upper == "NO RESULT"):
+				r.MTB = part
+			}
+		}
+	}
+}
+
+// ParseTime parses an ASTM date and time, YYYYMMDD[HHMM[SS]], in loc. dateOnly is true if it has no time of day
+func ParseTime(value string, loc *time.Location) (t time.Time, dateOnly bool, err error) {
+	layouts := map[int]string{8: "20060102", 12: "200601021504", 14: "20060102150405"}
+	layout, ok := layouts[len(value)]
+	if !ok {
+		return time.Time{}, false, fmt.Errorf("invalid ASTM date/time %q", value)
+	}
+	t, err = time.ParseInLocation(layout, value, loc)
+	return t, len(value) == 8, err
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,263 @@
+package astm
+
+import (
+	"bufio"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxRetransmissions is the number of times a sender may retransmit a frame before it must abort the transmission
+const maxRetransmissions = 6
+
+// Instrument is an analyzer allowed to send results and the facility they are saved for. Instruments with an
+// address are identified by their IP address, the others by the sender name of their header records
+type Instrument struct {
+	Name       string
+	Address    string
+	FacilityID string
+}
+
+// Handler processes the results of a complete message received from an instrument
+type Handler func(instrument Instrument, results []Result)
+
+// Server receives ASTM E1381 transmissions over TCP connections. Each frame is acknowledged with ACK, or with NAK
+// if it is corrupted, and the records of complete transmissions are passed to the Handler. Partial and corrupted
+// transmissions, and those from unknown instruments, are logged and discarded
+type Server struct {
+	Addr        string
+	Instruments []Instrument
+	Handler     Handler
+	Timeout     time.Duration // the receiver timeout while a transmission is in progress, 30s by default
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+}
+
+// ListenAndServe listens on the server's TCP address and serves connections until the server is closed
+func (s *Server) ListenAndServe() error {
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l, serving each in its own goroutine, until the server is closed
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return net.ErrClosed
+	}
+	s.listener = l
+	s.conns = make(map[net.Conn]struct{})
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops the server, closing its listener and open connections
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	if s.listener != nil {
+		return s.listener.Close()
+	}
+	return nil
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.WithField("remote_addr", conn.RemoteAddr().String()).Errorf("ASTM connection panicked: %v", r)
+		}
+		_ = conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+	logger := log.WithField("remote_addr", conn.RemoteAddr().String())
+	reader := bufio.NewReader(conn)
+	for {
+		// instruments keep connections open between transmissions
+		_ = conn.SetReadDeadline(time.Time{})
+		b, err := reader.ReadByte()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				logger.WithError(err).Warn("Closing ASTM connection")
+			}
+			return
+		}
+		if b != ENQ {
+			// anything but the establishment phase is ignored while idle
+			continue
+		}
+		if _, err := conn.Write([]byte{ACK}); err != nil {
+			return
+		}
+		text, err := s.receive(conn, reader, logger)
+		if err != nil {
+			logger.WithError(err).Warn("Discarding ASTM transmission")
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		s.dispatch(conn, text, logger)
+	}
+}
+
+// receive reads the frames of a transmission up to its EOT, acknowledging each, and returns the records' text
+func (s *Server) receive(conn net.Conn, reader *bufio.Reader, logger *log.Entry) (string, error) {
+	var text strings.Builder
+	expected, retransmissions, complete := 1, 0, true
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(s.timeout()))
+		b, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		switch b {
+		case EOT:
+			if !complete {
+				return "", errors.New("transmission ended in the middle of a record")
+			}
+			if text.Len() == 0 {
+				return "", errors.New("transmission without frames")
+			}
+			return text.String(), nil
+		case STX:
+		default:
+			// the rest of a corrupted frame, or a sender not waiting for our reply
+			continue
+		}
+
+		frame, err := readFrame(reader)
+		if err == nil && frame.Number != expected%8 {
+			if frame.Number == (expected-1)%8 && expected > 1 {
+				// the sender did not get our ACK of the previous frame and sent it again
+				if _, err := conn.Write([]byte{ACK}); err != nil {
+					return "", err
+				}
+				continue
+			}
+			err = ErrFrameNumber
+		}
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				return "", err
+			}
+			retransmissions++
+			logger.WithError(err).WithField("frame", expected%8).Warn("Rejecting ASTM frame")
+			if retransmissions > maxRetransmissions {
+				return "", errors.New("too many corrupted frames")
+			}
+			if _, err := conn.Write([]byte{NAK}); err != nil {
+				return "", err
+			}
+			continue
+		}
+
+		text.WriteString(frame.Text)
+		complete = frame.Final
+		expected++
+		retransmissions = 0
+		if _, err := conn.Write([]byte{ACK}); err != nil {
+			return "", err
+		}
+	}
+}
+
+// dispatch passes the results of the received messages to the handler, for the instrument they are from
+func (s *Server) dispatch(conn net.Conn, text string, logger *log.Entry) {
+	messages, err := ParseMessages(text)
+	if err != nil {
+		logger.WithError(err).Warn("Discarding ASTM transmission")
+		return
+	}
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	for _, message := range messages {
+		sender := message.Records[0].Component(5, 1)
+		instrument, ok := s.instrument(sender, host)
+		if !ok {
+			logger.WithField("sender", sender).Warn("Discarding ASTM message from an unknown instrument")
+			continue
+		}
+		results := message.Results()
+		if len(results) == 0 {
+			logger.WithField("instrument", instrument.Name).Info("ASTM message has no MTB results")
+			continue
+		}
+		for i := range results {
+			results[i].FacilityID = instrument.FacilityID
+		}
+		s.Handler(instrument, results)
+	}
+}
+
+// instrument returns the configured instrument at the IP address host, preferring the one with the sender name if
+// several share the address, or else the instrument without an address that has the sender name. Instruments
+// with an address are never matched by name from other hosts, so that their name cannot be used to send results
+// for their facility
+func (s *Server) instrument(sender, host string) (Instrument, bool) {
+	var found *Instrument
+	for i, instrument := range s.Instruments {
+		if instrument.Address == "" || instrument.Address != host {
+			continue
+		}
+		if strings.EqualFold(instrument.Name, sender) {
+			return instrument, true
+		}
+		if found == nil {
+			found = &s.Instruments[i]
+		}
+	}
+	if found != nil {
+		return *found, true
+	}
+	for _, instrument := range s.Instruments {
+		if instrument.Address == "" && instrument.Name != "" && strings.EqualFold(instrument.Name, sender) {
+			return instrument, true
+		}
+	}
+	return Instrument{}, false
+}
+
+func (s *Server) timeout() time.Duration {
+	if s.Timeout > 0 {
+		return s.Timeout
+	}
+	return 30 * time.Second
+}
@@ -0,0 +1,473 @@
+package astm
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// geneXpertRecords is a transmission of a GeneXpert MTB/RIF result as sent by the instrument
+var geneXpertRecords = []string{
+	`H|\^&|||GX-MULAGO^GeneXpert^6.4|||||LIS||P|1394-97|20250127130827`,
+	`P|1||1234567890||^Doe^John||19800101|M`,
+	`O|1|SPEC-001||^^^MTB-RIF^Xpert MTB-RIF Assay G4^5|R|20250127110000|||||||||||||||||||F`,
+	`R|1|^^^MTB-RIF^Xpert MTB-RIF Assay G4^5^^|MTB DETECTED HIGH;Rif Resistance NOT DETECTED^|||||F||admin|20250127112000|20250127130000|GX-MULAGO^709123^618221^Cartridge`,
+	`R|2|^^^MTB-RIF^Xpert MTB-RIF Assay G4^5^Probe D^Ct|24.3|||||F||admin|20250127112000|20250127130000|`,
+	`L|1|N`,
+}
+
+var mulago = Instrument{Name: "GX-MULAGO", FacilityID: "FvewOonC8lS"}
+
+// simulator plays the part of an instrument, sending transmissions to the server and reading its replies
+type simulator struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func (sim *simulator) send(data []byte) {
+	sim.t.Helper()
+	if _, err := sim.conn.Write(data); err != nil {
+		sim.t.Fatalf("write: %v", err)
+	}
+}
+
+// expect reads the server's reply to what was last sent
+func (sim *simulator) expect(reply byte) {
+	sim.t.Helper()
+	_ = sim.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	b, err := sim.reader.ReadByte()
+	if err != nil {
+		sim.t.Fatalf("expected %#x, got error %v", reply, err)
+	}
+	if b != reply {
+		sim.t.Fatalf("expected %#x, got %#x", reply, b)
+	}
+}
+
+// establish sends ENQ, which the server must accept
+func (sim *simulator) establish() {
+	sim.t.Helper()
+	sim.send([]byte{ENQ})
+	sim.expect(ACK)
+}
+
+// transmit sends a complete transmission of the records, expecting each frame to be acknowledged
+func (sim *simulator) transmit(records []string) {
+	sim.t.Helper()
+	sim.establish()
+	for _, frame := range Frames(records) {
+		sim.send(frame)
+		sim.expect(ACK)
+	}
+	sim.send([]byte{EOT})
+}
+
+type received struct {
+	mu      sync.Mutex
+	results []Result
+	ch      chan struct{}
+}
+
+func (r *received) handle(_ Instrument, results []Result) {
+	r.mu.Lock()
+	r.results = append(r.results, results...)
+	r.mu.Unlock()
+	r.ch <- struct{}{}
+}
+
+// wait waits for the handler to be called, or fails the test
+func (r *received) wait(t *testing.T) []Result {
+	t.Helper()
+	select {
+	case <-r.ch:
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler was not called")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.results
+}
+
+// none checks that the handler is not called
+func (r *received) none(t *testing.T) {
+	t.Helper()
+	select {
+	case <-r.ch:
+		t.Fatalf("handler called with %v", r.results)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func startServer(t *testing.T, instruments ...Instrument) (*Server, *received) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &received{ch: make(chan struct{}, 10)}
+	server := &Server{Instruments: instruments, Handler: r.handle, Timeout: 300 * time.Millisecond}
+	go func() { _ = server.Serve(l) }()
+	t.Cleanup(func() { _ = server.Close() })
+	server.Addr = l.Addr().String()
+	return server, r
+}
+
+func connect(t *testing.T, server *Server) *simulator {
+	t.Helper()
+	conn, err := net.Dial("tcp", server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return &simulator{t: t, conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func TestChecksum(t *testing.T) {
+	// frame number 1, text "H|\^&" + CR, ETX
+	body := append([]byte("1H|\\^&\r"), ETX)
+	if got := Checksum(body); got != "E5" {
+		t.Errorf("Checksum() = %s, want E5", got)
+	}
+	frame := EncodeFrame(1, "H|\\^&\r", true)
+	if string(frame) != "\x021H|\\^&\r\x03E5\r\n" {
+		t.Errorf("EncodeFrame() = %q", frame)
+	}
+}
+
+func TestFramesSplitLongRecords(t *testing.T) {
+	long := "R|1|" + strings.Repeat("x", 2*MaxFrameText)
+	frames := Frames([]string{"H|\\^&", long, "L|1|N"})
+	if len(frames) != 5 {
+		t.Fatalf("got %d frames, want 5", len(frames))
+	}
+	for i, frame := range frames {
+		if want := byte('0' + (i+1)%8); frame[1] != want {
+			t.Errorf("frame %d has number %c, want %c", i, frame[1], want)
+		}
+	}
+	if frames[1][len(frames[1])-5] != ETB || frames[3][len(frames[3])-5] != ETX {
+		t.Error("intermediate frames should end with ETB and the last frame of a record with ETX")
+	}
+}
+
+func TestReceivesGeneXpertResult(t *testing.T) {
+	server, r := startServer(t, mulago)
+	sim := connect(t, server)
+	sim.transmit(geneXpertRecords)
+
+	results := r.wait(t)
+	if len(results) != 1 {
+		t.Fatalf("got %d results, want 1", len(results))
+	}
+	want := Result{Instrument: "GX-MULAGO", PatientID: "1234567890", SpecimenID: "SPEC-001",
+		MTB: "DETECTED HIGH", RR: "NOT DETECTED", Completed: "20250127130000", FacilityID: "FvewOonC8lS"}
+	if results[0] != want {
+		t.Errorf("got %+v, want %+v", results[0], want)
+	}
+}
+
+func TestReceivesResultsSplitAcrossFrames(t *testing.T) {
+	server, r := startServer(t, mulago)
+	sim := connect(t, server)
+	records := append([]string{}, geneXpertRecords...)
+	// a long comment in the patient name makes the patient record span several frames
+	records[1] = `P|1||1234567890||^Doe^John ` + strings.Repeat("A", 2*MaxFrameText) + `||19800101|M`
+	sim.transmit(records)
+
+	if results := r.wait(t); len(results) != 1 || results[0].PatientID != "1234567890" {
+		t.Errorf("got %+v", results)
+	}
+}
+
+func TestIdentifiesInstrumentByAddress(t *testing.T) {
+	server, r := startServer(t, Instrument{Name: "GX-OTHER", Address: "127.0.0.1", FacilityID: "Qw7c6Ckb0XC"})
+	sim := connect(t, server)
+	sim.transmit(geneXpertRecords)
+
+	if results := r.wait(t); results[0].FacilityID != "Qw7c6Ckb0XC" {
+		t.Errorf("got facility %s, want Qw7c6Ckb0XC", results[0].FacilityID)
+	}
+}
+
+func TestDiscardsResultsWithTheNameOfAnInstrumentAtAnotherAddress(t *testing.T) {
+	server, r := startServer(t, Instrument{Name: "GX-MULAGO", Address: "10.0.0.1", FacilityID: "FvewOonC8lS"})
+	sim := connect(t, server)
+	sim.transmit(geneXpertRecords)
+	r.none(t)
+}
+
+func TestDiscardsResultsFromUnknownInstruments(t *testing.T) {
+	server, r := startServer(t, Instrument{Name: "GX-OTHER", Address: "10.0.0.1", FacilityID: "Qw7c6Ckb0XC"})
+	sim := connect(t, server)
+	sim.transmit(geneXpertRecords)
+	r.none(t)
+}
+
+func TestCorruptedFrameIsRejectedAndRetransmitted(t *testing.T) {
+	server, r := startServer(t, mulago)
+	sim := connect(t, server)
+	sim.establish()
+	frames := Frames(geneXpertRecords)
+	for i, frame := range frames {
+		if i == 2 {
+			corrupted := append([]byte{}, frame...)
+			corrupted[len(corrupted)-4] ^= 0x01 // checksum
+			sim.send(corrupted)
+			sim.expect(NAK)
+		}
+		sim.send(frame)
+		sim.expect(ACK)
+	}
+	sim.send([]byte{EOT})
+
+	if results := r.wait(t); len(results) != 1 {
+		t.Fatalf("got %d results, want 1", len(results))
+	}
+}
+
+func TestDuplicateFrameIsAcknowledgedOnce(t *testing.T) {
+	server, r := startServer(t, mulago)
+	sim := connect(t, server)
+	sim.establish()
+	frames := Frames(geneXpertRecords)
+	for i, frame := range frames {
+		sim.send(frame)
+		sim.expect(ACK)
+		if i == 1 {
+			// the instrument missed the ACK and sends the frame again
+			sim.send(frame)
+			sim.expect(ACK)
+		}
+	}
+	sim.send([]byte{EOT})
+
+	results := r.wait(t)
+	if len(results) != 1 || results[0].MTB != "DETECTED HIGH" {
+		t.Errorf("got %+v", results)
+	}
+}
+
+func TestOutOfSequenceFrameIsRejected(t *testing.T) {
+	server, r := startServer(t, mulago)
+	sim := connect(t, server)
+	sim.establish()
+	frames := Frames(geneXpertRecords)
+	sim.send(frames[0])
+	sim.expect(ACK)
+	sim.send(frames[2])
+	sim.expect(NAK)
+	for _, frame := range frames[1:] {
+		sim.send(frame)
+		sim.expect(ACK)
+	}
+	sim.send([]byte{EOT})
+
+	if results := r.wait(t); len(results) != 1 {
+		t.Fatalf("got %d results, want 1", len(results))
+	}
+}
+
+func TestMalformedFramesAreRejected(t *testing.T) {
+	server, _ := startServer(t, mulago)
+	sim := connect(t, server)
+	sim.establish()
+	for _, frame := range [][]byte{
+		[]byte("\x021H|\\^&\r\x03E5\n\n"), // missing CR
+		[]byte("\x029H|\\^&\r\x03ED\r\n"), // invalid frame number
+		[]byte("\x021H|\\^&\r\x02"),       // abandoned for a new frame
+	} {
+		sim.send(frame)
+		sim.expect(NAK)
+	}
+}
+
+func TestPartialTransmissionIsDiscarded(t *testing.T) {
+	server, r := startServer(t, mulago)
+	sim := connect(t, server)
+
+	// EOT before the last record
+	sim.establish()
+	frames := Frames(geneXpertRecords)
+	for _, frame := range frames[:3] {
+		sim.send(frame)
+		sim.expect(ACK)
+	}
+	sim.send([]byte{EOT})
+	r.none(t)
+
+	// EOT in the middle of a record split across frames
+	sim.establish()
+	long := Frames([]string{"H|\\^&", "R|1|" + strings.Repeat("x", 2*MaxFrameText)})
+	for _, frame := range long[:2] {
+		sim.send(frame)
+		sim.expect(ACK)
+	}
+	sim.send([]byte{EOT})
+	r.none(t)
+
+	// the connection can still be used
+	sim.transmit(geneXpertRecords)
+	if results := r.wait(t); len(results) != 1 {
+		t.Fatalf("got %d results, want 1", len(results))
+	}
+}
+
+func TestStalledTransmissionTimesOut(t *testing.T) {
+	server, r := startServer(t, mulago)
+	sim := connect(t, server)
+	sim.establish()
+	frames := Frames(geneXpertRecords)
+	sim.send(frames[0])
+	sim.expect(ACK)
+	time.Sleep(2 * server.Timeout)
+	r.none(t)
+
+	// after the receiver timeout the server waits for a new transmission
+	sim.transmit(geneXpertRecords)
+	if results := r.wait(t); len(results) != 1 {
+		t.Fatalf("got %d results, want 1", len(results))
+	}
+}
+
+func TestTooManyCorruptedFramesAbortTheTransmission(t *testing.T) {
+	server, r := startServer(t, mulago)
+	sim := connect(t, server)
+	sim.establish()
+	corrupted := EncodeFrame(1, "H|\\^&\r", true)
+	corrupted[len(corrupted)-3] = 'X'
+	for i := 0; i < maxRetransmissions; i++ {
+		sim.send(corrupted)
+		sim.expect(NAK)
+	}
+	sim.send(corrupted)
+	sim.send([]byte{EOT})
+	r.none(t)
+
+	sim.transmit(geneXpertRecords)
+	if results := r.wait(t); len(results) != 1 {
+		t.Fatalf("got %d results, want 1", len(results))
+	}
+}
+
+func TestInvalidRecordsAreDiscarded(t *testing.T) {
+	server, r := startServer(t, mulago)
+	sim := connect(t, server)
+	// no terminator record
+	sim.transmit(geneXpertRecords[:len(geneXpertRecords)-1])
+	r.none(t)
+	// no header record
+	sim.transmit(geneXpertRecords[1:])
+	r.none(t)
+}
+
+func TestGarbageIsIgnoredWhileIdle(t *testing.T) {
+	server, r := startServer(t, mulago)
+	sim := connect(t, server)
+	sim.send([]byte("garbage\x02\x03\x04"))
+	sim.transmit(geneXpertRecords)
+	if results := r.wait(t); len(results) != 1 {
+		t.Fatalf("got %d results, want 1", len(results))
+	}
+}
+
+func TestServesConnectionsConcurrently(t *testing.T) {
+	server, r := startServer(t, mulago)
+	idle := connect(t, server)
+	idle.establish()
+	idle.send(Frames(geneXpertRecords)[0])
+	idle.expect(ACK)
+
+	sim := connect(t, server)
+	sim.transmit(geneXpertRecords)
+	if results := r.wait(t); len(results) != 1 {
+		t.Fatalf("got %d results, want 1", len(results))
+	}
+}
+
+func TestMessageResults(t *testing.T) {
+	tests := []struct {
+		name    string
+		records []string
+		want    []Result
+	}{
+		{
+			name: "analyte results",
+			records: []string{
+				`H|\^&|||GX-MULAGO^GeneXpert^6.4|||||LIS||P|1394-97|20250127130827`,
+				`P|1||1234567890`,
+				`O|1|SPEC-001||^^^MTB-RIF`,
+				`R|1|^^^MTB-RIF^Xpert MTB-RIF Assay G4^5^MTB^|DETECTED LOW^|||||F||||20250127130000`,
+				`R|2|^^^MTB-RIF^Xpert MTB-RIF Assay G4^5^Rif Resistance^|DETECTED^|||||F||||20250127130000`,
+				`L|1|N`,
+			},
+			want: []Result{{Instrument: "GX-MULAGO", PatientID: "1234567890", SpecimenID: "SPEC-001",
+				MTB: "DETECTED LOW", RR: "DETECTED", Completed: "20250127130000"}},
+		},
+		{
+			name: "several orders and an error result",
+			records: []string{
+				`H|\^&|||GX-MULAGO|||||LIS||P|1394-97|20250127130827`,
+				`P|1||1234567890`,
+				`O|1|SPEC-001||^^^MTB-RIF`,
+				`R|1|^^^MTB-RIF^Xpert MTB-RIF Assay G4^5^^|MTB NOT DETECTED^`,
+				`P|2|||2345678901`,
+				`O|1|SPEC-002||^^^MTB-RIF`,
+				`R|1|^^^MTB-RIF^Xpert MTB-RIF Assay G4^5^^|ERROR^|||||F||||20250127120000`,
+				`O|2|SPEC-003||^^^OTHER`,
+				`L|1|N`,
+			},
+			want: []Result{
+				{Instrument: "GX-MULAGO", PatientID: "1234567890", SpecimenID: "SPEC-001", MTB: "NOT DETECTED",
+					Completed: "20250127130827"},
+				{Instrument: "GX-MULAGO", PatientID: "2345678901", SpecimenID: "SPEC-002", MTB: "ERROR",
+					Completed: "20250127120000"},
+			},
+		},
+		{
+			name: "escaped delimiters and custom delimiters",
+			records: []string{
+				`H!@#$!!!GX-MULAGO#GeneXpert`,
+				`P!1!!12$F$34`,
+				`O!1!SPEC-001`,
+				`R!1!###MTB-RIF#Xpert#5##!MTB DETECTED MEDIUM;Rif Resistance INDETERMINATE`,
+				`L!1!N`,
+			},
+			want: []Result{{Instrument: "GX-MULAGO", PatientID: "12!34", SpecimenID: "SPEC-001",
+				MTB: "DETECTED MEDIUM", RR: "INDETERMINATE"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messages, err := ParseMessages(strings.Join(tt.records, "\r") + "\r")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := messages[0].Results()
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("result %d: got %+v, want %+v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	tm, dateOnly, err := ParseTime("20250127130827", time.UTC)
+	if err != nil || dateOnly || !tm.Equal(time.Date(2025, 1, 27, 13, 8, 27, 0, time.UTC)) {
+		t.Errorf("ParseTime() = %v, %v, %v", tm, dateOnly, err)
+	}
+	if _, dateOnly, err := ParseTime("20250127", time.UTC); err != nil || !dateOnly {
+		t.Errorf("ParseTime() = %v, %v", dateOnly, err)
+	}
+	if _, _, err := ParseTime("2025-01-27", time.UTC); err == nil {
+		t.Error("ParseTime() should fail for dates not in the ASTM format")
+	}
+}
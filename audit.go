@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"rtcgw/config"
+	"rtcgw/models"
+	"rtcgw/utils"
+)
+
+// patientIDFields are the payload fields identifying the patient a request is about
+var patientIDFields = []string{"echis_patient_id", "patient_id"}
+
+// AuditLog records every authenticated request, with PII redacted from its body, in the audit_log
+func AuditLog() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		body := readJSONBody(c)
+
+		c.Next()
+
+		saveAuditLog(c, body)
+	}
+}
+
+// readJSONBody returns the body of JSON and FHIR JSON requests, restoring it for the handlers
+func readJSONBody(c *gin.Context) []byte {
+	if c.ContentType() != "application/json" && c.ContentType() != "application/fhir+json" {
+		return nil
+	}
+	return readBody(c)
+}
+
+// readBody returns the request body, restoring it for the handlers
+func readBody(c *gin.Context) []byte {
+	if c.Request.Body == nil {
+		return nil
+	}
+	body, _ := io.ReadAll(c.Request.Body)
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	return body
+}
+
+// saveAuditLog records the request and the status of its response in the audit log
+func saveAuditLog(c *gin.Context, body []byte) {
+	entry := newAuditLog(c, body)
+	entry.Status = c.Writer.Status()
+	if err := entry.Save(); err != nil {
+		log.WithError(err).Error("Failed to save audit log")
+	}
+}
+
+// newAuditLog builds the audit log entry of the request from the gin context
+func newAuditLog(c *gin.Context, body []byte) *models.AuditLog {
+	entry := &models.AuditLog{
+		AuthMethod: c.GetString("authMethod"),
+		Method:     c.Request.Method,
+		Route:      c.FullPath(),
+		Path:       c.Request.URL.Path,
+		ClientIP:   c.ClientIP(),
+		TaskIDs:    c.GetStringSlice("taskIDs"),
+	}
+	if userID, ok := c.Get("currentUser"); ok {
+		id := userID.(int64)
+		entry.UserID = &id
+	}
+	if tokenID, ok := c.Get("currentToken"); ok {
+		id := tokenID.(int64)
+		entry.TokenID = &id
+	}
+	if len(body) > 0 {
+		entry.PatientIDs = utils.JSONFieldValues(body, patientIDFields)
+		entry.RequestBody = string(utils.RedactJSON(body, config.RTCGwConf.Security.AuditRedactFields))
+	}
+	for _, echisID := range append(c.GetStringSlice("patientIDs"), c.Param("echis_id")) {
+		if echisID != "" && !utils.Contains(entry.PatientIDs, echisID) {
+			entry.PatientIDs = append(entry.PatientIDs, echisID)
+		}
+	}
+	return entry
+}
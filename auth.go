@@ -1,83 +1,288 @@
 package main
 
 import (
+	"bytes"
 	"encoding/base64"
+	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"rtcgw/config"
+	"rtcgw/controllers"
 	"rtcgw/db"
 	"rtcgw/models"
+	"rtcgw/utils"
+	"strconv"
 	"strings"
+	"time"
 )
 
+// BasicAuthChallenge makes browsers ask for credentials when a page is opened without them, so that pages requiring
+// authentication such as /stats can be opened directly. Browsers then send the credentials with the page's own
+// requests, including its WebSocket
+func BasicAuthChallenge() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetHeader("Authorization") == "" && len(certificateIdentities(c.Request.TLS)) == 0 {
+			c.Header("WWW-Authenticate", `Basic realm="rtcgw", charset="UTF-8"`)
+		}
+		c.Next()
+	}
+}
+
 func BasicAuth() gin.HandlerFunc {
 
 	return func(c *gin.Context) {
 		c.Set("dbConn", db.GetDB())
 		c.Set("asynqClient", client)
-		auth := strings.SplitN(c.Request.Header.Get("Authorization"), " ", 2)
+		c.Set("asynqInspector", inspector)
+		header := c.Request.Header.Get("Authorization")
+		if header == "" {
+			// Machine clients can authenticate with a verified client certificate instead
+			if identities := certificateIdentities(c.Request.TLS); len(identities) > 0 {
+				userID, err := models.GetUserIDByCertSubject(identities)
+				if err != nil {
+					log.WithField("identities", identities).Info("No user matches client certificate")
+					RespondWithError(401, "Unauthorized", c)
+					return
+				}
+				c.Set("currentUser", userID)
+				c.Set("authMethod", "certificate")
+				if !sourceIPAllowed(c) {
+					return
+				}
+				c.Next()
+				return
+			}
+		}
+		auth := strings.SplitN(header, " ", 2)
 
-		if len(auth) != 2 || (auth[0] != "Basic" && auth[0] != "Token:") {
+		if len(auth) != 2 {
 			RespondWithError(401, "Unauthorized", c)
 			return
 		}
-		tokenAuthenticated, userUID := AuthenticateUserToken(auth[1])
-		if auth[0] == "Token:" {
+		var basicUser *models.User
+		switch auth[0] {
+		case "Bearer", "Token:":
+			// "Token:" is the legacy scheme kept for existing integrators
+			tokenAuthenticated, userToken := AuthenticateUserToken(strings.TrimSpace(auth[1]), c.ClientIP())
 			if !tokenAuthenticated {
 				RespondWithError(401, "Unauthorized", c)
 				return
 			}
-			c.Set("currentUser", userUID)
-			c.Next()
-			return
-		}
-
-		payload, _ := base64.StdEncoding.DecodeString(auth[1])
-		pair := strings.SplitN(string(payload), ":", 2)
-
-		basicAuthenticated, userUID := AuthenticateUser(pair[0], pair[1])
+			c.Set("currentUser", userToken.UserID)
+			c.Set("currentToken", userToken.ID)
+			c.Set("tokenScopes", []string(userToken.Scopes))
+			c.Set("authMethod", "token")
+		case "Basic":
+			payload, _ := base64.StdEncoding.DecodeString(auth[1])
+			pair := strings.SplitN(string(payload), ":", 2)
+			if len(pair) != 2 {
+				RespondWithError(401, "Unauthorized", c)
+				return
+			}
 
-		if len(pair) != 2 || !basicAuthenticated {
+			basicAuthenticated, user, err := AuthenticateUser(pair[0], pair[1], c.ClientIP())
+			var lockoutErr *models.LockoutError
+			if errors.As(err, &lockoutErr) {
+				c.Header("Retry-After", strconv.Itoa(int(time.Until(lockoutErr.Until).Seconds())+1))
+				RespondWithError(429, "Too many failed login attempts, try again later", c)
+				return
+			}
+			if !basicAuthenticated {
+				RespondWithError(401, "Unauthorized", c)
+				// c.Writer.Header().Set("WWW-Authenticate", "Basic realm=Restricted")
+				return
+			}
+			c.Set("currentUser", user.ID)
+			c.Set("authMethod", "basic")
+			basicUser = user
+		case HMACScheme:
+			hmacKey, err := AuthenticateHMAC(c, auth[1])
+			if err != nil {
+				log.WithError(err).WithField("ip", c.ClientIP()).Info("HMAC authentication failed")
+				RespondWithError(401, "Unauthorized", c)
+				return
+			}
+			c.Set("currentUser", hmacKey.UserID)
+			c.Set("currentHMACKey", hmacKey.KeyID)
+			c.Set("authMethod", "hmac")
+		default:
 			RespondWithError(401, "Unauthorized", c)
-			// c.Writer.Header().Set("WWW-Authenticate", "Basic realm=Restricted")
 			return
 		}
-		c.Set("currentUser", userUID)
+		if !sourceIPAllowed(c) {
+			return
+		}
+		if basicUser != nil {
+			// only logins from allowed addresses count, so that they cannot clear the user's lockout
+			models.RecordSuccessfulLogin(basicUser.ID)
+			// Users logging in with a one-time password may only change their password
+			if basicUser.MustChangePassword && c.FullPath() != PasswordChangePath {
+				RespondWithError(403, "Password change required, set a new password at "+PasswordChangePath, c)
+				return
+			}
+		}
 
 		c.Next()
 	}
 }
 
-func AuthenticateUser(username, password string) (bool, int64) {
+// sourceIPAllowed rejects requests from addresses outside the current user's allowlist, if they have one.
+// Rejected requests are recorded in the audit log
+func sourceIPAllowed(c *gin.Context) bool {
+	userID := c.GetInt64("currentUser")
+	allowed, err := models.IPAllowed(userID, c.ClientIP())
+	if err != nil {
+		log.WithError(err).WithField("ip", c.ClientIP()).Error("Failed to check user's allowed IP addresses")
+	}
+	if allowed {
+		return true
+	}
+	log.WithFields(log.Fields{"user": userID, "ip": c.ClientIP()}).Warn("Request from IP address outside the user's allowlist")
+	body := readJSONBody(c)
+	RespondWithError(403, "Requests from this IP address are not allowed", c)
+	saveAuditLog(c, body)
+	return false
+}
+
+// HMACScheme is the Authorization scheme of requests signed with a shared secret
+const HMACScheme = "HMAC-SHA256"
+
+// AuthenticateHMAC verifies a request signed by a machine client. The credentials take the form
+// <key_id>:<base64 signature> and the timestamp and nonce are sent in the X-RTCGW-Timestamp and X-RTCGW-Nonce headers.
+// Requests with stale timestamps or reused nonces are rejected
+func AuthenticateHMAC(c *gin.Context, credentials string) (*models.HMACKey, error) {
+	parts := strings.SplitN(strings.TrimSpace(credentials), ":", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("malformed credentials")
+	}
+	keyID, signature := parts[0], parts[1]
+	timestamp := c.GetHeader("X-RTCGW-Timestamp")
+	nonce := c.GetHeader("X-RTCGW-Nonce")
+	if timestamp == "" || nonce == "" {
+		return nil, errors.New("missing timestamp or nonce")
+	}
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid timestamp")
+	}
+	maxSkew := time.Duration(config.RTCGwConf.Security.HMACMaxSkewSeconds) * time.Second
+	skew := time.Since(time.Unix(ts, 0))
+	if skew > maxSkew || skew < -maxSkew {
+		return nil, errors.New("stale timestamp")
+	}
+
+	hmacKey, err := models.GetActiveHMACKey(keyID)
+	if err != nil {
+		return nil, fmt.Errorf("unknown key %s", keyID)
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return nil, err
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	if !hmacKey.Verify(signature, c.Request.Method, c.Request.URL.RequestURI(), timestamp, nonce, body) {
+		return nil, errors.New("invalid signature")
+	}
+
+	// nonces only need to be remembered for as long as their timestamps are accepted
+	fresh, err := db.GetRedis().SetNX(c.Request.Context(),
+		fmt.Sprintf("rtcgw:hmac:nonce:%s:%s", keyID, nonce), timestamp, 2*maxSkew).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to check nonce: %w", err)
+	}
+	if !fresh {
+		return nil, errors.New("reused nonce")
+	}
+
+	hmacKey.MarkUsed()
+	return hmacKey, nil
+}
+
+// PasswordChangePath is the only endpoint users required to change their password may access
+const PasswordChangePath = "/api/users/me/password"
+
+// AuthenticateUser checks the user's credentials, counting failed attempts against the user and clientIP.
+// An unexpired one-time password is accepted in place of the password.
+// A *models.LockoutError is returned if either is locked out. The successful login is left to be recorded by the
+// caller once the request is otherwise allowed, e.g. by the user's IP allowlist
+func AuthenticateUser(username, password, clientIP string) (bool, *models.User, error) {
+	if lockedUntil := models.IPLockedUntil(clientIP); lockedUntil != nil {
+		return false, nil, &models.LockoutError{Until: *lockedUntil}
+	}
 	// log.Printf("Username:%s, password:%s", username, password)
 	userObj := models.User{}
 	err := db.GetDB().QueryRowx(
 		`SELECT
-            id, uid, username, firstname, lastname , telephone, email
+            id, uid, username, firstname, lastname , telephone, email, locked_until, must_change_password
         FROM users
         WHERE
-            username = $1 AND password = crypt($2, password)`,
-		username, password).StructScan(&userObj)
+            username = $1 AND is_active = TRUE`,
+		username).StructScan(&userObj)
 	if err != nil {
 		// fmt.Printf("User:[%v]", err)
-		return false, 0
+		models.RecordFailedLogin(0, clientIP)
+		return false, nil, nil
+	}
+	if userObj.LockedUntil != nil && userObj.LockedUntil.After(time.Now()) {
+		return false, nil, &models.LockoutError{Until: *userObj.LockedUntil}
+	}
+
+	passwordMatches, err := userObj.CheckPassword(password)
+	if err != nil || !passwordMatches {
+		models.RecordFailedLogin(userObj.ID, clientIP)
+		return false, nil, nil
 	}
 	// fmt.Printf("User:[%v]", userObj)
-	return true, userObj.ID
+	return true, &userObj, nil
 }
 
-func AuthenticateUserToken(token string) (bool, int64) {
-	userToken := models.UserToken{}
-	err := db.GetDB().QueryRowx(
-		`SELECT
-            id, user_id, token, is_active
-        FROM user_apitoken
-        WHERE
-            token = $1 AND is_active = TRUE LIMIT 1`,
-		token).StructScan(&userToken)
+// AuthenticateUserToken checks the token against the stored token hashes and records its usage
+func AuthenticateUserToken(token, clientIP string) (bool, *models.UserToken) {
+	userToken, err := models.GetActiveUserToken(token)
 	if err != nil {
-		return false, 0
+		return false, nil
+	}
+	userToken.MarkUsed(clientIP)
+	return true, userToken
+}
+
+// RequirePermission rejects requests from users whose role lacks perm on the sys_module
+func RequirePermission(module, perm string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := c.Get("currentUser")
+		if !ok {
+			RespondWithError(401, "Unauthorized", c)
+			return
+		}
+		if !models.UserHasPermission(userID.(int64), module, perm) {
+			RespondWithError(403, "Forbidden", c)
+			return
+		}
+		// Requests authenticated with a token are further limited to the token's scopes
+		if scopes, ok := c.Get("tokenScopes"); ok {
+			scope := models.ScopeFor(module, perm)
+			if !utils.Contains(scopes.([]string), scope) {
+				RespondWithError(403, fmt.Sprintf("Token lacks the %s scope", scope), c)
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// TransactionQuota counts a submission against the user's transaction cap, rejecting it with 429 once the cap is exceeded
+func TransactionQuota() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !controllers.ConsumeTransactionQuota(c, 1) {
+			return
+		}
+		c.Next()
 	}
-	// fmt.Printf("User:[%v]", userObj)
-	return true, userToken.UserID
 }
 
 func RespondWithError(code int, message string, c *gin.Context) {
@@ -22,17 +22,49 @@ type Config struct {
 	} `yaml:"database"`
 
 	Server struct {
-		Host                string `mapstructure:"host" env:"RTCGW_HOST" env-default:"localhost"`
-		Port                string `mapstructure:"http_port" env:"RTCGW_SERVER_PORT" env-description:"Server port" env-default:"9292"`
-		ProxyPort           string `mapstructure:"proxy_port" env:"RTCGW_PROXY_PORT" env-description:"Server port" env-default:"9191"`
-		MaxConcurrent       int    `mapstructure:"max_concurrent" env-description:"Maximum number of concurrent processing of tasks."`
-		RedisAddress        string `mapstructure:"redis_address" env:"RTCGW_REDIS" env-description:"Redis address" env-default:"127.0.0.1:6379"`
-		Domain              string `mapstructure:"domain" env:"RTCGW_DOMAIN" env-description:"Domain" env-default:"localhost:9292"`
-		MigrationsDirectory string `mapstructure:"migrations_dir" env:"RTCGW_MIGRATTIONS_DIR" env-default:"file:///usr/share/rtcgw/db/migrations"`
-		StaticDirectory     string `mapstructure:"static_directory" env:"RTC_STATIC_DIR" env-default:"./static"`
-		TemplatesDirectory  string `mapstructure:"templates_directory" env:"RTC_TEMPLATES_DIR" env-default:"./templates"`
-		DocsDirectory       string `mapstructure:"docs_directory" env:"RTC_DOCS_DIR" env-default:"./docs/my_docs"`
+		Host                      string           `mapstructure:"host" env:"RTCGW_HOST" env-default:"localhost"`
+		Port                      string           `mapstructure:"http_port" env:"RTCGW_SERVER_PORT" env-description:"Server port" env-default:"9292"`
+		ProxyPort                 string           `mapstructure:"proxy_port" env:"RTCGW_PROXY_PORT" env-description:"Server port" env-default:"9191"`
+		MaxConcurrent             int              `mapstructure:"max_concurrent" env-description:"Maximum number of concurrent processing of tasks."`
+		MaxBatchSize              int              `mapstructure:"max_batch_size" env:"RTCGW_MAX_BATCH_SIZE" env-description:"Maximum number of clients in a batch submission" env-default:"100"`
+		MaxUploadRows             int              `mapstructure:"max_upload_rows" env:"RTCGW_MAX_UPLOAD_ROWS" env-description:"Maximum number of results in an uploaded spreadsheet" env-default:"1000"`
+		MaxUploadBytes            int64            `mapstructure:"max_upload_bytes" env:"RTCGW_MAX_UPLOAD_BYTES" env-description:"Maximum size in bytes of a results upload request" env-default:"10485760"`
+		SyncTimeoutSeconds        int              `mapstructure:"sync_timeout_seconds" env:"RTCGW_SYNC_TIMEOUT_SECONDS" env-description:"Seconds to wait for a synchronous submission before queueing it" env-default:"30"`
+		SyncRunTimeoutSeconds     int              `mapstructure:"sync_run_timeout_seconds" env:"RTCGW_SYNC_RUN_TIMEOUT_SECONDS" env-description:"Seconds after which a timed out synchronous submission still running is queued" env-default:"1800"`
+		RedisAddress              string           `mapstructure:"redis_address" env:"RTCGW_REDIS" env-description:"Redis address" env-default:"127.0.0.1:6379"`
+		Domain                    string           `mapstructure:"domain" env:"RTCGW_DOMAIN" env-description:"Domain" env-default:"localhost:9292"`
+		MigrationsDirectory       string           `mapstructure:"migrations_dir" env:"RTCGW_MIGRATTIONS_DIR" env-default:"file:///usr/share/rtcgw/db/migrations"`
+		StaticDirectory           string           `mapstructure:"static_directory" env:"RTC_STATIC_DIR" env-default:"./static"`
+		TemplatesDirectory        string           `mapstructure:"templates_directory" env:"RTC_TEMPLATES_DIR" env-default:"./templates"`
+		DocsDirectory             string           `mapstructure:"docs_directory" env:"RTC_DOCS_DIR" env-default:"./docs/my_docs"`
+		TokenPurgeSchedule        string           `mapstructure:"token_purge_schedule" env:"RTCGW_TOKEN_PURGE_SCHEDULE" env-description:"Cron spec for purging expired and inactive API tokens" env-default:"@daily"`
+		IdempotencyRetentionHours int              `mapstructure:"idempotency_retention_hours" env:"RTCGW_IDEMPOTENCY_RETENTION_HOURS" env-description:"Hours for which repeated submissions return the original response" env-default:"24"`
+		IdempotencyPurgeSchedule  string           `mapstructure:"idempotency_purge_schedule" env:"RTCGW_IDEMPOTENCY_PURGE_SCHEDULE" env-description:"Cron spec for purging stored submission responses" env-default:"@hourly"`
+		MissingClientsSchedule    string           `mapstructure:"missing_clients_schedule" env:"RTCGW_MISSING_CLIENTS_SCHEDULE" env-description:"Cron spec for searching DHIS2 for clients whose results had no sync log" env-default:"@hourly"`
+		TLSCertFile               string           `mapstructure:"tls_cert_file" env:"RTCGW_TLS_CERT_FILE" env-description:"Server certificate file. HTTPS is served when set together with tls_key_file"`
+		TLSKeyFile                string           `mapstructure:"tls_key_file" env:"RTCGW_TLS_KEY_FILE" env-description:"Server private key file"`
+		TLSClientCAFile           string           `mapstructure:"tls_client_ca_file" env:"RTCGW_TLS_CLIENT_CA_FILE" env-description:"CA certificates used to verify client certificates"`
+		TLSRequireClientCert      bool             `mapstructure:"tls_require_client_cert" env:"RTCGW_TLS_REQUIRE_CLIENT_CERT" env-description:"Reject connections without a client certificate signed by the client CA" env-default:"false"`
+		TrustedProxies            []string         `mapstructure:"trusted_proxies" env-description:"Reverse proxy addresses or CIDR ranges whose X-Forwarded-For and X-Real-IP headers are trusted"`
+		HL7Port                   string           `mapstructure:"hl7_port" env:"RTCGW_HL7_PORT" env-description:"Port of the MLLP listener receiving HL7 v2 ORU^R01 results. The listener is only started when set"`
+		HL7IdleTimeoutSeconds     int              `mapstructure:"hl7_idle_timeout_seconds" env:"RTCGW_HL7_IDLE_TIMEOUT_SECONDS" env-description:"Seconds after which idle MLLP connections are closed" env-default:"300"`
+		HL7Senders                []HL7Sender      `mapstructure:"hl7_senders" env-description:"The systems allowed to send HL7 messages to the MLLP listener"`
+		ASTMPort                  string           `mapstructure:"astm_port" env:"RTCGW_ASTM_PORT" env-description:"Port of the ASTM E1381 server receiving results from GeneXpert instruments. The server is only started when set"`
+		ASTMInstruments           []ASTMInstrument `mapstructure:"astm_instruments" env-description:"The instruments allowed to send results to the ASTM server"`
 	} `yaml:"server"`
+	Security struct {
+		MaxFailedAttempts     int      `mapstructure:"max_failed_attempts" env:"RTCGW_MAX_FAILED_ATTEMPTS" env-description:"Failed logins allowed per user or IP address before a lockout" env-default:"5"`
+		LockoutMinutes        int      `mapstructure:"lockout_minutes" env:"RTCGW_LOCKOUT_MINUTES" env-description:"Duration of the first lockout, doubled for every subsequent lockout" env-default:"15"`
+		MaxLockoutMinutes     int      `mapstructure:"max_lockout_minutes" env:"RTCGW_MAX_LOCKOUT_MINUTES" env-description:"Maximum duration of a lockout" env-default:"1440"`
+		HMACMaxSkewSeconds    int      `mapstructure:"hmac_max_skew_seconds" env:"RTCGW_HMAC_MAX_SKEW_SECONDS" env-description:"Maximum age of the timestamp of HMAC signed requests" env-default:"300"`
+		AuditRedactFields     []string `mapstructure:"audit_redact_fields" env-description:"Request body fields redacted before saving to the audit log"`
+		PasswordMinLength     int      `mapstructure:"password_min_length" env:"RTCGW_PASSWORD_MIN_LENGTH" env-description:"Minimum length of user passwords" env-default:"8"`
+		PasswordRequireUpper  bool     `mapstructure:"password_require_upper" env:"RTCGW_PASSWORD_REQUIRE_UPPER" env-description:"Require passwords to contain an uppercase letter" env-default:"true"`
+		PasswordRequireLower  bool     `mapstructure:"password_require_lower" env:"RTCGW_PASSWORD_REQUIRE_LOWER" env-description:"Require passwords to contain a lowercase letter" env-default:"true"`
+		PasswordRequireDigit  bool     `mapstructure:"password_require_digit" env:"RTCGW_PASSWORD_REQUIRE_DIGIT" env-description:"Require passwords to contain a digit" env-default:"true"`
+		PasswordRequireSymbol bool     `mapstructure:"password_require_symbol" env:"RTCGW_PASSWORD_REQUIRE_SYMBOL" env-description:"Require passwords to contain a symbol" env-default:"false"`
+		OnetimePasswordHours  int      `mapstructure:"onetime_password_hours" env:"RTCGW_ONETIME_PASSWORD_HOURS" env-description:"Hours for which a one-time password issued by an admin is valid" env-default:"24"`
+	} `yaml:"security"`
 	API struct {
 		DHIS2BaseURL                string                       `mapstructure:"dhis2_base_url" env:"DHIS2_BASE_URL" env-description:"The DHIS2 instance base API URL"`
 		DHIS2User                   string                       `mapstructure:"dhis2_user"  env:"DHIS2_USER" env-description:"The DHIS2 username"`
@@ -46,9 +78,47 @@ type Config struct {
 		DHIS2TrackedEntityType      string                       `mapstructure:"dhis2_tracked_entity_type"  env:"DHIS2_TRACKED_ENTITY_TYPE" env-description:"The DHIS2 tracked entity type"`
 		DHIS2SearchAttribute        string                       `mapstructure:"dhis2_search_attribute" env:"DHIS_SEARCH_ATTRIBUTE" env-description:"The DHIS2 Search Attribute"`
 		DHIS2Mapping                map[string]map[string]string `mapstructure:"dhis2_mapping" env:"DHIS_MAPPING" env-description:"The Request JSON keys mapping to DHIS2 Data Elements"`
+		ECHISSchema                 []ECHISField                 `mapstructure:"echis_schema" env-description:"The fields of eCHIS client requests. Defaults to the built-in fields mapped by dhis2_mapping"`
+		FHIRPatientIDSystem         string                       `mapstructure:"fhir_patient_id_system" env:"RTCGW_FHIR_PATIENT_ID_SYSTEM" env-description:"The FHIR identifier system of eCHIS patient ids"`
+		FHIRNINSystem               string                       `mapstructure:"fhir_nin_system" env:"RTCGW_FHIR_NIN_SYSTEM" env-description:"The FHIR identifier system of national identification numbers"`
+		FHIRMTBCode                 string                       `mapstructure:"fhir_mtb_code" env:"RTCGW_FHIR_MTB_CODE" env-description:"The LOINC code of GeneXpert MTB observations" env-default:"48176-2"`
+		FHIRRRCode                  string                       `mapstructure:"fhir_rr_code" env:"RTCGW_FHIR_RR_CODE" env-description:"The LOINC code of GeneXpert rifampicin resistance observations" env-default:"38379-4"`
+		ResultsUploadColumns        map[string]string            `mapstructure:"results_upload_columns" env-description:"The column headers of the result fields in uploaded spreadsheets. Defaults to the field names"`
+		HL7MTBCode                  string                       `mapstructure:"hl7_mtb_code" env:"RTCGW_HL7_MTB_CODE" env-description:"The OBX-3 code of GeneXpert MTB results in HL7 messages" env-default:"48176-2"`
+		HL7RRCode                   string                       `mapstructure:"hl7_rr_code" env:"RTCGW_HL7_RR_CODE" env-description:"The OBX-3 code of GeneXpert rifampicin resistance results in HL7 messages" env-default:"38379-4"`
+		HL7Facilities               map[string]string            `mapstructure:"hl7_facilities" env-description:"The DHIS2 UIDs of the sending facilities (MSH-4) of HL7 messages that do not send the UID itself"`
+		DHIS2DuplicateMarking       string                       `mapstructure:"dhis2_duplicate_marking" env:"RTCGW_DHIS2_DUPLICATE_MARKING" env-description:"How the duplicate tracked entity of merged clients is marked in DHIS2, inactive or potential_duplicate" env-default:"inactive"`
 	} `yaml:"api"`
 }
 
+// ECHISField defines a field of eCHIS client requests, how it is validated and where it is saved in DHIS2
+type ECHISField struct {
+	Name      string   `mapstructure:"name"`
+	Type      string   `mapstructure:"type"` // string, integer, number or boolean
+	Required  bool     `mapstructure:"required"`
+	Validator string   `mapstructure:"validator"` // ugandaNIN, dhis2UID, yesNo, maleFemale, regex or enum
+	Pattern   string   `mapstructure:"pattern"`   // the regular expression of the regex validator
+	Values    []string `mapstructure:"values"`    // the values allowed by the enum validator
+	Target    string   `mapstructure:"target"`    // attribute or data_element, empty if not saved in DHIS2
+	UID       string   `mapstructure:"uid"`       // defaults to the dhis2_mapping of the target
+	Message   string   `mapstructure:"message"`   // replaces the default validation error message
+}
+
+// HL7Sender is a system allowed to send HL7 messages, identified by its IP address or CIDR range and optionally
+// restricted to the sending facility (MSH-4) it may send results for
+type HL7Sender struct {
+	Address  string `mapstructure:"address"`
+	Facility string `mapstructure:"facility"`
+}
+
+// ASTMInstrument is an instrument sending results over ASTM, identified by its IP address if set or else by the
+// sender name of its header records
+type ASTMInstrument struct {
+	Name            string `mapstructure:"name"`
+	Address         string `mapstructure:"address"`
+	FacilityDHIS2ID string `mapstructure:"facility_dhis2_id"`
+}
+
 var RTCGwConf Config
 var ShowVersion *bool
 
@@ -95,6 +165,33 @@ func init() {
 	}
 
 	RTCGwConf.Server.MaxConcurrent = 10
+	RTCGwConf.Server.MaxBatchSize = 100
+	RTCGwConf.Server.MaxUploadRows = 1000
+	RTCGwConf.Server.MaxUploadBytes = 10 << 20
+	RTCGwConf.Server.SyncTimeoutSeconds = 30
+	RTCGwConf.Server.SyncRunTimeoutSeconds = 1800
+	RTCGwConf.Server.TokenPurgeSchedule = "@daily"
+	RTCGwConf.Server.IdempotencyRetentionHours = 24
+	RTCGwConf.Server.IdempotencyPurgeSchedule = "@hourly"
+	RTCGwConf.Server.MissingClientsSchedule = "@hourly"
+	RTCGwConf.API.FHIRMTBCode = "48176-2"
+	RTCGwConf.API.FHIRRRCode = "38379-4"
+	RTCGwConf.Server.HL7IdleTimeoutSeconds = 300
+	RTCGwConf.API.HL7MTBCode = "48176-2"
+	RTCGwConf.API.HL7RRCode = "38379-4"
+	RTCGwConf.API.DHIS2DuplicateMarking = "inactive"
+	RTCGwConf.Security.MaxFailedAttempts = 5
+	RTCGwConf.Security.LockoutMinutes = 15
+	RTCGwConf.Security.MaxLockoutMinutes = 1440
+	RTCGwConf.Security.HMACMaxSkewSeconds = 300
+	RTCGwConf.Security.AuditRedactFields = []string{
+		"national_identification_number", "patient_name", "patient_phone", "password",
+		"current_password", "new_password", "name", "telecom", "birthDate", "address", "identifier"}
+	RTCGwConf.Security.PasswordMinLength = 8
+	RTCGwConf.Security.PasswordRequireUpper = true
+	RTCGwConf.Security.PasswordRequireLower = true
+	RTCGwConf.Security.PasswordRequireDigit = true
+	RTCGwConf.Security.OnetimePasswordHours = 24
 	err := viper.Unmarshal(&RTCGwConf)
 	if err != nil {
 		log.Fatalf("unable to decode into struct, %v", err)
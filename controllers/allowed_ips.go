@@ -0,0 +1,81 @@
+package controllers
+
+import (
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"rtcgw/models"
+	"strconv"
+)
+
+type allowedIPRequest struct {
+	CIDR        string `json:"cidr" binding:"required"`
+	Description string `json:"description"`
+}
+
+// ListAllowedIPs returns the CIDR ranges the user identified by uid may authenticate from
+func (uc *UserController) ListAllowedIPs(c *gin.Context) {
+	user, err := models.GetUserByUID(c.Param("uid"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	allowed, err := models.GetUserAllowedIPs(user.ID)
+	if err != nil {
+		log.WithError(err).Error("Failed to list allowed IP ranges")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get allowed IP ranges"})
+		return
+	}
+	c.JSON(http.StatusOK, allowed)
+}
+
+// AddAllowedIP adds a CIDR range or single IP address to the allowlist of the user identified by uid.
+// Once a user has an allowlist, requests from addresses outside it are rejected
+func (uc *UserController) AddAllowedIP(c *gin.Context) {
+	var req allowedIPRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"errors": models.FormatValidationError(err)})
+		return
+	}
+	cidr, err := models.NormalizeCIDR(req.CIDR)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user, err := models.GetUserByUID(c.Param("uid"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	allowed := models.AllowedIP{UserID: user.ID, CIDR: cidr, Description: req.Description}
+	if err := allowed.Save(); err != nil {
+		log.WithError(err).Error("Failed to save allowed IP range")
+		c.JSON(http.StatusConflict, gin.H{"error": "Failed to add allowed IP range, it may already be allowed"})
+		return
+	}
+	c.JSON(http.StatusCreated, allowed)
+}
+
+// DeleteAllowedIP removes the range :id from the allowlist of the user identified by uid
+func (uc *UserController) DeleteAllowedIP(c *gin.Context) {
+	user, err := models.GetUserByUID(c.Param("uid"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid allowed IP id"})
+		return
+	}
+	allowed, err := models.GetUserAllowedIP(user.ID, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Allowed IP range not found"})
+		return
+	}
+	if err := allowed.Delete(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete allowed IP range"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Allowed IP range deleted"})
+}
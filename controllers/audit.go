@@ -0,0 +1,50 @@
+package controllers
+
+import (
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"rtcgw/models"
+	"time"
+)
+
+type AuditController struct{}
+
+// ListAuditLogs returns a page of audit log entries filtered by the user, route, patient_id,
+// from and to (YYYY-MM-DD, inclusive) query parameters
+func (ac *AuditController) ListAuditLogs(c *gin.Context) {
+	page, pageSize := getPaging(c)
+	filter := models.AuditFilter{
+		User:      c.Query("user"),
+		Route:     c.Query("route"),
+		PatientID: c.Query("patient_id"),
+	}
+	if from := c.Query("from"); from != "" {
+		fromDate, err := time.ParseInLocation("2006-01-02", from, time.Local)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from should be a date in the format YYYY-MM-DD"})
+			return
+		}
+		filter.From = &fromDate
+	}
+	if to := c.Query("to"); to != "" {
+		toDate, err := time.ParseInLocation("2006-01-02", to, time.Local)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to should be a date in the format YYYY-MM-DD"})
+			return
+		}
+		toDate = toDate.AddDate(0, 0, 1)
+		filter.To = &toDate
+	}
+
+	logs, total, err := models.GetAuditLogs(filter, page, pageSize)
+	if err != nil {
+		log.WithError(err).Error("Failed to query audit log")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get audit log"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"pager":     NewPager(page, pageSize, total),
+		"audit_log": logs,
+	})
+}
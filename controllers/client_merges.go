@@ -0,0 +1,115 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"rtcgw/models"
+)
+
+// MergeRequest names the surviving patient and their duplicate registration
+type MergeRequest struct {
+	SurvivorECHISID  string `json:"survivor_echis_id" binding:"required"`
+	DuplicateECHISID string `json:"duplicate_echis_id" binding:"required"`
+}
+
+// Merge merges a patient registered twice in eCHIS into the surviving patient. The duplicate's results and lab
+// enrollment are moved to the survivor, the duplicate's tracked entity is marked in DHIS2 and the duplicate's
+// echis id is made to point to the survivor. Every merge is recorded in the merge history
+func (b *ClientsController) Merge(c *gin.Context) {
+	var req MergeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"errors": models.FormatValidationError(err)})
+		return
+	}
+	if req.SurvivorECHISID == req.DuplicateECHISID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "survivor_echis_id and duplicate_echis_id should be different"})
+		return
+	}
+	c.Set("patientIDs", []string{req.SurvivorECHISID, req.DuplicateECHISID})
+
+	survivor, ok := getMergedClient(c, req.SurvivorECHISID)
+	if !ok {
+		return
+	}
+	duplicate, ok := getMergedClient(c, req.DuplicateECHISID)
+	if !ok {
+		return
+	}
+	if survivor.TrackedEntity == duplicate.TrackedEntity {
+		c.JSON(http.StatusConflict, gin.H{"error": "The clients have the same tracked entity in DHIS2"})
+		return
+	}
+
+	var userID *int64
+	if id, ok := c.Get("currentUser"); ok {
+		currentUser := id.(int64)
+		userID = &currentUser
+	}
+	merge, err := models.MergeClients(survivor.ECHISID, duplicate.ECHISID, userID)
+	if errors.Is(err, models.ErrClientMerged) {
+		// a concurrent merge of one of the clients finished first
+		c.JSON(http.StatusConflict, gin.H{"error": "One of the clients has already been merged into another"})
+		return
+	}
+	if err != nil {
+		log.WithError(err).WithField("duplicate_echis_id", req.DuplicateECHISID).Error("Failed to merge clients")
+		if merge == nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to merge clients"})
+			return
+		}
+		var conflictErr *models.ConflictError
+		if errors.As(err, &conflictErr) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{
+				"error":     "Merge rejected by DHIS2",
+				"conflicts": conflictErr.Conflicts,
+				"merge":     merge,
+			})
+			return
+		}
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to merge clients", "merge": merge})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": fmt.Sprintf("client %s merged into %s", req.DuplicateECHISID, req.SurvivorECHISID),
+		"merge":   merge,
+	})
+}
+
+// getMergedClient returns the sync log of a client to merge, responding with an error if the client is not found
+// or has already been merged into another
+func getMergedClient(c *gin.Context, echisID string) (*models.SyncLog, bool) {
+	syncLog, err := models.GetSyncLogRow(echisID)
+	if err != nil {
+		log.WithError(err).Error("Failed to get sync log of client")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get client"})
+		return nil, false
+	}
+	if syncLog == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Client %s not found", echisID)})
+		return nil, false
+	}
+	if syncLog.MergedInto != "" {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": fmt.Sprintf("Client %s has already been merged into %s", echisID, syncLog.MergedInto)})
+		return nil, false
+	}
+	return syncLog, true
+}
+
+// ListMerges returns a page of the merge history, latest first, optionally of the patient echis_patient_id
+func (b *ClientsController) ListMerges(c *gin.Context) {
+	page, pageSize := getPaging(c)
+	merges, total, err := models.GetClientMerges(c.Query("echis_patient_id"), page, pageSize)
+	if err != nil {
+		log.WithError(err).Error("Failed to query client merges")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get client merges"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"pager":  NewPager(page, pageSize, total),
+		"merges": merges,
+	})
+}
@@ -1,12 +1,16 @@
 package controllers
 
 import (
+	"fmt"
 	"github.com/gin-gonic/gin"
-	"github.com/hibiken/asynq"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/goccy/go-json"
 	log "github.com/sirupsen/logrus"
 	"net/http"
+	"rtcgw/config"
 	"rtcgw/models"
 	"rtcgw/tasks"
+	"time"
 )
 
 type ClientsController struct{}
@@ -20,18 +24,211 @@ func (b *ClientsController) Start(c *gin.Context) {
 		return
 	}
 
-	client := c.MustGet("asynqClient").(*asynq.Client)
 	task, err := tasks.NewClientTask(clientRequest)
-	if err != nil {
-		log.Fatalf("could not create task: %v", err)
+	var submission *models.Submission
+	if err == nil {
+		submission, err = submitTask(c, task, clientRequest.ECHISID, tasks.HandleClientTask)
 	}
-	info, err := client.Enqueue(task)
 	if err != nil {
-		log.Fatalf("could not enqueue task: %v", err)
+		log.WithError(err).WithField("echis_patient_id", clientRequest.ECHISID).Error("Failed to queue client")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue client for saving to DHIS2"})
+		return
+	}
+	respondWithSubmission(c, submission, "client")
+}
+
+// Statuses of the items of a batch submission
+const (
+	BatchItemQueued  = "queued"
+	BatchItemInvalid = "invalid"
+	BatchItemFailed  = "failed"
+)
+
+// BatchItemResult is the outcome of an item of a batch submission, identified by its index in the submitted array
+type BatchItemResult struct {
+	Index        int               `json:"index"`
+	Status       string            `json:"status"`
+	SubmissionID string            `json:"submission_id,omitempty"`
+	Errors       map[string]string `json:"errors,omitempty"`
+}
+
+// StartBatch validates each client in the submitted array and enqueues the valid ones,
+// so that invalid clients do not block the rest of the batch. The task of each client gets an id derived from the
+// client, so that a client submitted again in a later batch, e.g. a retried one, is not queued twice
+func (b *ClientsController) StartBatch(c *gin.Context) {
+	var items []json.RawMessage
+	if err := c.ShouldBindJSON(&items); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body should be an array of clients"})
+		return
+	}
+	maxBatchSize := config.RTCGwConf.Server.MaxBatchSize
+	if len(items) == 0 || len(items) > maxBatchSize {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("A batch should have between 1 and %d clients", maxBatchSize)})
+		return
+	}
+
+	results := make([]BatchItemResult, len(items))
+	var valid []models.ECHISRequest
+	var validIndexes []int
+	for i, item := range items {
+		results[i] = BatchItemResult{Index: i, Status: BatchItemInvalid}
+		var clientRequest models.ECHISRequest
+		if err := json.Unmarshal(item, &clientRequest); err != nil {
+			results[i].Errors = map[string]string{"client": "Should be a valid client JSON object"}
+			continue
+		}
+		if err := binding.Validator.ValidateStruct(&clientRequest); err != nil {
+			results[i].Errors = models.FormatValidationError(err)
+			continue
+		}
+		valid = append(valid, clientRequest)
+		validIndexes = append(validIndexes, i)
 	}
-	log.Printf("enqueued eCHIS task: id=%s queue=%s", info.ID, info.Queue)
 
-	c.JSON(200, gin.H{
-		"message": "client queued for saving to DHIS2",
+	if len(valid) > 0 && !ConsumeTransactionQuota(c, len(valid)) {
+		return
+	}
+
+	queued := 0
+	userID := c.GetInt64("currentUser")
+	for j, clientRequest := range valid {
+		result := &results[validIndexes[j]]
+		task, err := tasks.NewClientTask(clientRequest)
+		var submission *models.Submission
+		if err == nil {
+			key := models.HashToken(fmt.Sprintf("%d:%s:%s", userID, c.FullPath(), task.Payload()))
+			submission, err = enqueueKeyedTask(c, task, clientRequest.ECHISID, key)
+		}
+		if err != nil {
+			log.WithError(err).WithField("echis_patient_id", clientRequest.ECHISID).Error("Failed to queue client")
+			result.Status = BatchItemFailed
+			result.Errors = map[string]string{"client": "Failed to queue client for saving to DHIS2"}
+			continue
+		}
+		result.Status = BatchItemQueued
+		result.SubmissionID = submission.ID
+		queued++
+	}
+
+	status := http.StatusOK
+	if queued == 0 {
+		status = http.StatusBadRequest
+	}
+	c.JSON(status, gin.H{
+		"message": fmt.Sprintf("%d of %d clients queued for saving to DHIS2", queued, len(items)),
+		"results": results,
 	})
 }
+
+// Update applies the supplied fields of the client :echis_id to their tracked entity and screening event in DHIS2,
+// leaving the other attributes and data values unchanged. The fields are validated with the eCHIS schema
+func (b *ClientsController) Update(c *gin.Context) {
+	echisID := c.Param("echis_id")
+	var body json.RawMessage
+	var clientRequest models.ECHISRequest
+	if err := c.ShouldBindJSON(&body); err != nil || json.Unmarshal(body, &clientRequest) != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body should be a client JSON object"})
+		return
+	}
+	syncLog, err := models.GetSyncLogByECHISID(echisID)
+	if err != nil {
+		log.WithError(err).Error("Failed to get sync log of client")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get client"})
+		return
+	}
+	if syncLog == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Client not found"})
+		return
+	}
+
+	update := clientRequest.PartialUpdate(echisID)
+	errorMessages := make(map[string]string)
+	if err := binding.Validator.ValidateStruct(&update); err != nil {
+		errorMessages = models.FormatValidationError(err)
+	}
+	// the fields identifying the client may be supplied, but not changed
+	if id, ok := clientRequest.Values[models.FieldECHISID]; ok && id != echisID {
+		errorMessages[models.FieldECHISID] = "echis_patient_id cannot be changed."
+	}
+	if facility, ok := clientRequest.Values[models.FieldFacilityDHIS2ID]; ok && facility != syncLog.OrgUnit {
+		errorMessages[models.FieldFacilityDHIS2ID] = "facility_dhis2_id cannot be changed."
+	}
+	if len(errorMessages) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"errors": errorMessages})
+		return
+	}
+	if len(update.UpdatedFields()) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body has no fields to update"})
+		return
+	}
+
+	task, err := tasks.NewClientUpdateTask(update)
+	var submission *models.Submission
+	if err == nil {
+		submission, err = submitTask(c, task, echisID, tasks.HandleClientUpdateTask)
+	}
+	if err != nil {
+		log.WithError(err).WithField("echis_patient_id", echisID).Error("Failed to queue client update")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue client update for saving to DHIS2"})
+		return
+	}
+	respondWithSubmission(c, submission, "client update")
+}
+
+// ClientRecord is what the gateway knows about a patient from the sync_log
+type ClientRecord struct {
+	ECHISID              string              `json:"echis_patient_id"`
+	TrackedEntity        string              `json:"tracked_entity"`
+	ScreeningEvent       string              `json:"screening_event"`
+	EventDate            *time.Time          `json:"event_date"`
+	OrgUnit              string              `json:"org_unit"`
+	LabEnrollment        string              `json:"lab_enrollment"`
+	LabEvent             string              `json:"lab_event"`
+	ResultsUpdated       bool                `json:"results_updated"`
+	ClientCreationErrors string              `json:"client_creation_errors"`
+	ResultsUpdateErrors  string              `json:"results_update_errors"`
+	Created              time.Time           `json:"created"`
+	Updated              time.Time           `json:"updated"`
+	DHIS2                *models.DHIS2Record `json:"dhis2,omitempty"`
+}
+
+// GetClient returns the DHIS2 references of the patient :echis_id together with any errors saving them.
+// With live=true the current attribute and data values are also fetched from DHIS2
+func (b *ClientsController) GetClient(c *gin.Context) {
+	syncLog, err := models.GetSyncLogByECHISID(c.Param("echis_id"))
+	if err != nil {
+		log.WithError(err).Error("Failed to get sync log of client")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get client"})
+		return
+	}
+	if syncLog == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Client not found"})
+		return
+	}
+	record := ClientRecord{
+		ECHISID:              syncLog.ECHISID,
+		TrackedEntity:        syncLog.TrackedEntity,
+		ScreeningEvent:       syncLog.EventID,
+		OrgUnit:              syncLog.OrgUnit,
+		LabEnrollment:        syncLog.LabEnrollment,
+		LabEvent:             syncLog.LabEvent,
+		ResultsUpdated:       syncLog.ResultsUpdated,
+		ClientCreationErrors: syncLog.ECHISClientCreationErrors,
+		ResultsUpdateErrors:  syncLog.ResultsUpdateErrors,
+		Created:              syncLog.Created,
+		Updated:              syncLog.Updated,
+	}
+	if syncLog.EventDate.Valid {
+		record.EventDate = &syncLog.EventDate.Time
+	}
+	if c.Query("live") == "true" {
+		record.DHIS2, err = syncLog.FetchDHIS2Record()
+		if err != nil {
+			log.WithError(err).WithField("echis_patient_id", syncLog.ECHISID).Error("Failed to fetch client from DHIS2")
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to fetch client from DHIS2"})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, record)
+}
@@ -0,0 +1,256 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/goccy/go-json"
+	"github.com/hibiken/asynq"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"rtcgw/config"
+	"rtcgw/models"
+	"rtcgw/models/fhir"
+	"rtcgw/tasks"
+	"rtcgw/utils"
+	"sort"
+)
+
+type FHIRController struct{}
+
+// fhirExpressions are the FHIR elements the fields of eCHIS requests and LabXpert results are mapped from
+var fhirExpressions = map[string]map[string]string{
+	"Patient": {
+		models.FieldECHISID:              "Patient.identifier",
+		"national_identification_number": "Patient.identifier",
+		"patient_name":                   "Patient.name",
+		"patient_gender":                 "Patient.gender",
+		"patient_phone":                  "Patient.telecom",
+		"patient_age_in_years":           "Patient.birthDate",
+		"patient_age_in_months":          "Patient.birthDate",
+		"patient_age_in_days":            "Patient.birthDate",
+		models.FieldFacilityDHIS2ID:      "Patient.managingOrganization",
+	},
+	"Observation": {
+		"patient_id":        "Observation.subject",
+		"mtb":               "Observation.value",
+		"rr":                "Observation.component",
+		"result_date":       "Observation.effective",
+		"facility_dhis2_id": "Observation.performer",
+	},
+}
+
+// fhirSubmission is a resource of a FHIR request mapped onto the task that saves it to DHIS2
+type fhirSubmission struct {
+	task    *asynq.Task
+	echisID string
+	record  string
+	module  string
+}
+
+// CreatePatient registers the client given as a FHIR Patient, as POST /api/clients does
+func (fc *FHIRController) CreatePatient(c *gin.Context) {
+	submission, outcome := fc.bindResource(c, "Patient")
+	fc.respond(c, submission, outcome)
+}
+
+// CreateObservation submits the GeneXpert results given as a FHIR Observation, as POST /api/results does
+func (fc *FHIRController) CreateObservation(c *gin.Context) {
+	submission, outcome := fc.bindResource(c, "Observation")
+	fc.respond(c, submission, outcome)
+}
+
+// bindResource binds the request body to a resource of the expected type and maps it onto its task
+func (fc *FHIRController) bindResource(c *gin.Context, resourceType string) (*fhirSubmission, *fhir.OperationOutcome) {
+	body, err := c.GetRawData()
+	if err != nil {
+		return nil, fhirError(fhir.IssueStructure, "Failed to read the request body")
+	}
+	return newFHIRSubmission(body, resourceType, resourceType)
+}
+
+func (fc *FHIRController) respond(c *gin.Context, submission *fhirSubmission, outcome *fhir.OperationOutcome) {
+	if outcome != nil {
+		respondFHIR(c, http.StatusBadRequest, outcome)
+		return
+	}
+	queued, err := enqueueTask(c, submission.task, submission.echisID)
+	if err != nil {
+		log.WithError(err).WithField("echis_patient_id", submission.echisID).Error("Failed to queue FHIR resource")
+		respondFHIR(c, http.StatusInternalServerError, fhirError(fhir.IssueException,
+			fmt.Sprintf("Failed to queue %s for saving to DHIS2", submission.record)))
+		return
+	}
+	c.Header("Location", submissionLocation(queued))
+	respondFHIR(c, http.StatusAccepted, queuedOutcome(submission, queued))
+}
+
+// ProcessBundle processes the Patient and Observation entries of a transaction or batch Bundle. The entries of a
+// transaction are only queued if all of them are valid, while each valid entry of a batch is queued
+func (fc *FHIRController) ProcessBundle(c *gin.Context) {
+	var bundle fhir.Bundle
+	if err := c.ShouldBindJSON(&bundle); err != nil || bundle.ResourceType != "Bundle" {
+		respondFHIR(c, http.StatusBadRequest, fhirError(fhir.IssueStructure, "Request body should be a FHIR Bundle"))
+		return
+	}
+	if bundle.Type != fhir.BundleTransaction && bundle.Type != fhir.BundleBatch {
+		respondFHIR(c, http.StatusBadRequest, fhirError(fhir.IssueNotSupported, "Bundle type should be transaction or batch"))
+		return
+	}
+
+	submissions := make([]*fhirSubmission, len(bundle.Entry))
+	outcomes := make([]*fhir.OperationOutcome, len(bundle.Entry))
+	valid := 0
+	for i := range bundle.Entry {
+		path := fmt.Sprintf("Bundle.entry[%d].resource", i)
+		submissions[i], outcomes[i] = newFHIRSubmission(bundle.Entry[i].Resource, bundle.Entry[i].ResourceType(), path)
+		if outcomes[i] == nil && !hasPermission(c, submissions[i].module, models.PermAdd) {
+			outcomes[i] = fhirError(fhir.IssueForbidden,
+				fmt.Sprintf("Not permitted to add %s", submissions[i].record), path)
+		}
+		if outcomes[i] == nil {
+			valid++
+		}
+	}
+
+	if bundle.Type == fhir.BundleTransaction && valid < len(bundle.Entry) {
+		outcome := fhir.NewOperationOutcome()
+		for _, entryOutcome := range outcomes {
+			if entryOutcome != nil {
+				outcome.Issue = append(outcome.Issue, entryOutcome.Issue...)
+			}
+		}
+		respondFHIR(c, http.StatusBadRequest, outcome)
+		return
+	}
+	if valid > 0 && !ConsumeTransactionQuota(c, valid) {
+		return
+	}
+
+	response := fhir.Bundle{ResourceType: "Bundle", Type: bundle.Type + "-response"}
+	for i, submission := range submissions {
+		entry := fhir.BundleEntry{Response: &fhir.BundleEntryResponse{
+			Status: "400 Bad Request", Outcome: outcomes[i]}}
+		if outcomes[i] == nil {
+			queued, err := enqueueTask(c, submission.task, submission.echisID)
+			if err != nil {
+				log.WithError(err).WithField("echis_patient_id", submission.echisID).Error("Failed to queue FHIR resource")
+				entry.Response.Status = "500 Internal Server Error"
+				entry.Response.Outcome = fhirError(fhir.IssueException,
+					fmt.Sprintf("Failed to queue %s for saving to DHIS2", submission.record))
+			} else {
+				entry.Response.Status = "202 Accepted"
+				entry.Response.Location = submissionLocation(queued)
+				entry.Response.Outcome = queuedOutcome(submission, queued)
+			}
+		}
+		response.Entry = append(response.Entry, entry)
+	}
+	respondFHIR(c, http.StatusOK, response)
+}
+
+// newFHIRSubmission maps a Patient or Observation resource onto its task. Resources that cannot be mapped or
+// fail validation get an OperationOutcome with issues at the elements under path
+func newFHIRSubmission(resource []byte, resourceType, path string) (*fhirSubmission, *fhir.OperationOutcome) {
+	var submission *fhirSubmission
+	var taskErr error
+	var obj any
+	switch resourceType {
+	case "Patient":
+		var patient fhir.Patient
+		if err := json.Unmarshal(resource, &patient); err != nil || patient.ResourceType != "Patient" {
+			return nil, fhirError(fhir.IssueStructure, "Resource should be a FHIR Patient", path)
+		}
+		clientRequest := models.ECHISRequestFromPatient(patient)
+		obj = &clientRequest
+		submission = &fhirSubmission{echisID: clientRequest.ECHISID, record: "client", module: models.ModuleClients}
+		submission.task, taskErr = tasks.NewClientTask(clientRequest)
+	case "Observation":
+		var observation fhir.Observation
+		if err := json.Unmarshal(resource, &observation); err != nil || observation.ResourceType != "Observation" {
+			return nil, fhirError(fhir.IssueStructure, "Resource should be a FHIR Observation", path)
+		}
+		if !models.IsGeneXpertObservation(observation) {
+			return nil, fhirError(fhir.IssueNotSupported, fmt.Sprintf(
+				"Only GeneXpert observations coded with LOINC %s are supported", config.RTCGwConf.API.FHIRMTBCode), path+".code")
+		}
+		result := models.LabXpertResultFromObservation(observation)
+		obj = &result
+		submission = &fhirSubmission{echisID: result.PatientID, record: "results", module: models.ModuleResults}
+		submission.task, taskErr = tasks.NewResultsTask(result)
+	default:
+		return nil, fhirError(fhir.IssueNotSupported, "Only Patient and Observation resources are supported", path)
+	}
+	if err := binding.Validator.ValidateStruct(obj); err != nil {
+		return nil, validationOutcome(models.FormatValidationError(err), resourceType, path)
+	}
+	if taskErr != nil {
+		return nil, fhirError(fhir.IssueException, fmt.Sprintf("Failed to create the %s task", submission.record), path)
+	}
+	return submission, nil
+}
+
+// validationOutcome expresses the per-field validation errors as issues at the FHIR elements the fields are mapped from
+func validationOutcome(errors map[string]string, resourceType, path string) *fhir.OperationOutcome {
+	fields := make([]string, 0, len(errors))
+	for field := range errors {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	outcome := fhir.NewOperationOutcome()
+	for _, field := range fields {
+		issue := fhir.Issue{Severity: fhir.SeverityError, Code: fhir.IssueValue, Diagnostics: errors[field]}
+		if expression, ok := fhirExpressions[resourceType][field]; ok {
+			if path != resourceType {
+				expression = path + expression[len(resourceType):]
+			}
+			issue.Expression = []string{expression}
+		} else {
+			issue.Expression = []string{path + ".extension"}
+		}
+		outcome.Issue = append(outcome.Issue, issue)
+	}
+	if len(outcome.Issue) == 0 {
+		outcome.Issue = append(outcome.Issue, fhir.Issue{
+			Severity: fhir.SeverityError, Code: fhir.IssueInvalid, Expression: []string{path}})
+	}
+	return outcome
+}
+
+func queuedOutcome(submission *fhirSubmission, queued *models.Submission) *fhir.OperationOutcome {
+	return fhir.NewOperationOutcome(fhir.Issue{
+		Severity:    fhir.SeverityInformation,
+		Code:        fhir.IssueInformational,
+		Diagnostics: fmt.Sprintf("%s queued for saving to DHIS2 with submission_id %s", submission.record, queued.ID),
+	})
+}
+
+func submissionLocation(submission *models.Submission) string {
+	return "/api/submissions/" + submission.ID
+}
+
+// fhirError returns an OperationOutcome with a single error issue, at the given FHIR expressions if any
+func fhirError(code, diagnostics string, expression ...string) *fhir.OperationOutcome {
+	return fhir.NewOperationOutcome(fhir.Issue{
+		Severity:    fhir.SeverityError,
+		Code:        code,
+		Diagnostics: diagnostics,
+		Expression:  expression,
+	})
+}
+
+func respondFHIR(c *gin.Context, status int, resource any) {
+	c.Header("Content-Type", "application/fhir+json; charset=utf-8")
+	c.JSON(status, resource)
+}
+
+// hasPermission checks that the current user, and the token they authenticated with, may perm on module
+func hasPermission(c *gin.Context, module, perm string) bool {
+	if !models.UserHasPermission(c.GetInt64("currentUser"), module, perm) {
+		return false
+	}
+	if scopes, ok := c.Get("tokenScopes"); ok {
+		return utils.Contains(scopes.([]string), models.ScopeFor(module, perm))
+	}
+	return true
+}
@@ -0,0 +1,68 @@
+package controllers
+
+import (
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"rtcgw/models"
+)
+
+// ListHMACKeys returns the request signing keys of the user identified by uid, without their secrets
+func (uc *UserController) ListHMACKeys(c *gin.Context) {
+	user, err := models.GetUserByUID(c.Param("uid"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	keys, err := models.GetUserHMACKeys(user.ID)
+	if err != nil {
+		log.WithError(err).Error("Failed to list HMAC keys")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get HMAC keys"})
+		return
+	}
+	c.JSON(http.StatusOK, keys)
+}
+
+// CreateHMACKey generates a request signing key for the user identified by uid.
+// The secret is only returned in this response
+func (uc *UserController) CreateHMACKey(c *gin.Context) {
+	user, err := models.GetUserByUID(c.Param("uid"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	key, err := models.NewHMACKey(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate HMAC key"})
+		return
+	}
+	if err := key.Save(); err != nil {
+		log.WithError(err).Error("Failed to save HMAC key")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save HMAC key"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "HMAC key created successfully",
+		"key_id":  key.KeyID,
+		"secret":  key.Secret,
+	})
+}
+
+// RevokeHMACKey deactivates the request signing key :key_id of the user identified by uid
+func (uc *UserController) RevokeHMACKey(c *gin.Context) {
+	user, err := models.GetUserByUID(c.Param("uid"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	key, err := models.GetUserHMACKey(user.ID, c.Param("key_id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "HMAC key not found"})
+		return
+	}
+	if err := key.Revoke(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke HMAC key"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "HMAC key revoked"})
+}
@@ -0,0 +1,56 @@
+package controllers
+
+import (
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"rtcgw/models"
+)
+
+// ListLockouts returns the users and source IP addresses that are currently locked out
+func (uc *UserController) ListLockouts(c *gin.Context) {
+	users, err := models.GetLockedUsers()
+	if err != nil {
+		log.WithError(err).Error("Failed to get locked out users")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get lockouts"})
+		return
+	}
+	ips, err := models.GetLockedIPs()
+	if err != nil {
+		log.WithError(err).Error("Failed to get locked out IP addresses")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get lockouts"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"users": users,
+		"ips":   ips,
+	})
+}
+
+// ClearUserLockout unlocks the user identified by uid
+func (uc *UserController) ClearUserLockout(c *gin.Context) {
+	user, err := models.GetUserByUID(c.Param("uid"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err := user.ClearLockout(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to clear lockout"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "User lockout cleared"})
+}
+
+// ClearIPLockout unlocks the source IP address :ip
+func (uc *UserController) ClearIPLockout(c *gin.Context) {
+	cleared, err := models.ClearIPLockout(c.Param("ip"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to clear lockout"})
+		return
+	}
+	if !cleared {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No failed logins recorded for IP address"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "IP address lockout cleared"})
+}
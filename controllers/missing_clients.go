@@ -1,3 +1,73 @@
 package controllers
 
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/hibiken/asynq"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"rtcgw/models"
+	"rtcgw/tasks"
+	"strconv"
+)
+
 type MissingClientsController struct{}
+
+// ListMissingClients returns the patients whose results were received without a sync_log row,
+// optionally filtered by the status query parameter
+func (mc *MissingClientsController) ListMissingClients(c *gin.Context) {
+	status := c.Query("status")
+	if status != "" && status != models.MissingClientPending && status != models.MissingClientMatched {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status should be pending or matched"})
+		return
+	}
+	missing, err := models.GetMissingClients(status)
+	if err != nil {
+		log.WithError(err).Error("Failed to list missing clients")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get missing clients"})
+		return
+	}
+	c.JSON(http.StatusOK, missing)
+}
+
+// BackfillMissingClient searches DHIS2 for the missing client :id, creates their sync_log row if found and
+// queues their results again
+func (mc *MissingClientsController) BackfillMissingClient(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid missing client id"})
+		return
+	}
+	missing, err := models.GetMissingClient(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Missing client not found"})
+		return
+	}
+	found, err := missing.Backfill()
+	if err != nil {
+		log.WithError(err).WithField("echis_patient_id", missing.ECHISID).Error("Failed to backfill missing client")
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to search DHIS2 for missing client"})
+		return
+	}
+	if found {
+		client := c.MustGet("asynqClient").(*asynq.Client)
+		if err := tasks.QueueMissingClientResults(client, missing); err != nil {
+			log.WithError(err).WithField("echis_patient_id", missing.ECHISID).Error("Failed to queue results of missing client")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue the results of the missing client"})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, missing)
+}
+
+// BackfillMissingClients queues a search of DHIS2 for all pending missing clients, as is done on schedule
+func (mc *MissingClientsController) BackfillMissingClients(c *gin.Context) {
+	client := c.MustGet("asynqClient").(*asynq.Client)
+	info, err := client.Enqueue(tasks.NewBackfillMissingClientsTask())
+	if err != nil {
+		log.WithError(err).Error("Failed to queue missing clients backfill")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue missing clients backfill"})
+		return
+	}
+	addTaskID(c, info.ID)
+	c.JSON(http.StatusAccepted, gin.H{"message": "missing clients backfill queued"})
+}
@@ -0,0 +1,53 @@
+package controllers
+
+import (
+	"github.com/gin-gonic/gin"
+	"strconv"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// Pager describes the page of results returned by list endpoints
+type Pager struct {
+	Page      int   `json:"page"`
+	PageSize  int   `json:"page_size"`
+	Total     int64 `json:"total"`
+	PageCount int64 `json:"page_count"`
+}
+
+// NewPager returns a Pager for the given page, page size and total number of results
+func NewPager(page, pageSize int, total int64) Pager {
+	pageCount := total / int64(pageSize)
+	if total%int64(pageSize) != 0 {
+		pageCount++
+	}
+	return Pager{Page: page, PageSize: pageSize, Total: total, PageCount: pageCount}
+}
+
+// getPaging reads the page and page_size query parameters
+func getPaging(c *gin.Context) (int, int) {
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	pageSize, err := strconv.Atoi(c.DefaultQuery("page_size", strconv.Itoa(defaultPageSize)))
+	if err != nil || pageSize < 1 {
+		pageSize = defaultPageSize
+	}
+	if pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+	return page, pageSize
+}
+
+// getBoolQuery returns a pointer to the boolean value of query parameter key, nil if absent or invalid
+func getBoolQuery(c *gin.Context, key string) *bool {
+	v, err := strconv.ParseBool(c.Query(key))
+	if err != nil {
+		return nil
+	}
+	return &v
+}
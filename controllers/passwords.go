@@ -0,0 +1,80 @@
+package controllers
+
+import (
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"rtcgw/models"
+)
+
+type changePasswordRequest struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required"`
+}
+
+// ChangePassword changes the currently authenticated user's password after checking their current password.
+// All the user's API tokens are deactivated
+func (uc *UserController) ChangePassword(c *gin.Context) {
+	var req changePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"errors": models.FormatValidationError(err)})
+		return
+	}
+	user, err := models.GetUserById(c.GetInt64("currentUser"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	matches, err := user.CheckPassword(req.CurrentPassword)
+	if err != nil {
+		log.WithError(err).Error("Failed to check user password")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change password"})
+		return
+	}
+	if !matches {
+		models.RecordFailedLogin(user.ID, c.ClientIP())
+		c.JSON(http.StatusForbidden, gin.H{"error": "Current password is incorrect"})
+		return
+	}
+	if req.NewPassword == req.CurrentPassword {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "New password must differ from the current password"})
+		return
+	}
+	if err := models.ValidatePassword(req.NewPassword); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := user.SetPassword(req.NewPassword); err != nil {
+		log.WithError(err).Error("Failed to change user password")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change password"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Password changed, all API tokens have been revoked"})
+}
+
+// IssueOnetimePassword - Admin only. Issues a one-time password to the user identified by uid,
+// who must change their password on their next login
+func (uc *UserController) IssueOnetimePassword(c *gin.Context) {
+	user, err := models.GetUserByUID(c.Param("uid"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if !user.IsActive {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User is not active"})
+		return
+	}
+	password, expiry, err := user.IssueOnetimePassword()
+	if err != nil {
+		log.WithError(err).Error("Failed to issue one-time password")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue one-time password"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"message":          "One-time password issued, the user must change their password on their next login",
+		"onetime_password": password,
+		"expires":          expiry,
+	})
+}
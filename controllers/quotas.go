@@ -0,0 +1,75 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"rtcgw/models"
+	"strconv"
+)
+
+type quotaRequest struct {
+	TransactionCap    *int   `json:"transaction_cap" binding:"required,min=0"`
+	TransactionWindow string `json:"transaction_window" binding:"required,oneof=daily hourly"`
+}
+
+// ListUsage returns the submissions made by every active user in their current transaction window
+func (uc *UserController) ListUsage(c *gin.Context) {
+	usages, err := models.GetTransactionUsages()
+	if err != nil {
+		log.WithError(err).Error("Failed to get transaction usage")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get usage"})
+		return
+	}
+	c.JSON(http.StatusOK, usages)
+}
+
+// GetUsage returns the submissions made by the user identified by uid in the current transaction window
+func (uc *UserController) GetUsage(c *gin.Context) {
+	usage, err := models.GetTransactionUsage(c.Param("uid"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	c.JSON(http.StatusOK, usage)
+}
+
+// SetQuota sets the transaction cap and window of the user identified by uid
+func (uc *UserController) SetQuota(c *gin.Context) {
+	var req quotaRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		errorMessages := models.FormatValidationError(err)
+		c.JSON(http.StatusBadRequest, gin.H{"errors": errorMessages})
+		return
+	}
+	user, err := models.GetUserByUID(c.Param("uid"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err := user.SetTransactionQuota(*req.TransactionCap, req.TransactionWindow); err != nil {
+		log.WithError(err).Error("Failed to set transaction quota")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set quota"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Transaction quota updated"})
+}
+
+// ConsumeTransactionQuota counts n submissions against the current user's transaction cap. It responds with 429
+// and returns false if they would exceed the cap, in which case none of them is counted. Submissions are let
+// through if they cannot be counted
+func ConsumeTransactionQuota(c *gin.Context, n int) bool {
+	usage, err := models.ConsumeTransactionQuota(c.GetInt64("currentUser"), n)
+	if err != nil {
+		log.WithError(err).Error("Failed to count submission against transaction quota")
+		return true
+	}
+	if usage.Rejected {
+		c.Header("Retry-After", strconv.Itoa(int(usage.RetryAfter().Seconds())+1))
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": fmt.Sprintf(
+			"Transaction limit of %d %s submissions exceeded", *usage.TransactionCap, usage.TransactionWindow)})
+		return false
+	}
+	return true
+}
@@ -0,0 +1,311 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"rtcgw/config"
+	"rtcgw/models"
+	"rtcgw/tasks"
+	"rtcgw/utils"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Upload validates each row of an uploaded CSV or XLSX spreadsheet of results and enqueues the valid ones.
+// The first row of the sheet has the column headers, mapped to result fields by results_upload_columns. The
+// facility_dhis2_id form field gives the facility of rows without one. The task of each row gets an id derived
+// from the file's content and the row, so that uploading the same file again does not queue its results twice
+func (r *ResultsController) Upload(c *gin.Context) {
+	maxBytes := config.RTCGwConf.Server.MaxUploadBytes
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes)
+	header, err := c.FormFile("file")
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+				"error": fmt.Sprintf("The upload should not exceed %d bytes", maxBytes)})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A CSV or XLSX file should be uploaded as file"})
+		return
+	}
+	file, err := header.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read the uploaded file"})
+		return
+	}
+	defer func() { _ = file.Close() }()
+	hash := sha256.New()
+	if _, err = io.Copy(hash, file); err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read the uploaded file"})
+		return
+	}
+	fileHash := hex.EncodeToString(hash.Sum(nil))
+	sheet, err := utils.ReadSpreadsheet(header.Filename, file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Failed to read the uploaded file: %v", err)})
+		return
+	}
+
+	headerRow, columnIndexes := findHeaderRow(sheet)
+	if headerRow < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The file has no header row"})
+		return
+	}
+	facility := strings.TrimSpace(c.PostForm("facility_dhis2_id"))
+	var missing []string
+	for _, field := range []string{"patient_id", "mtb", "result_date", "facility_dhis2_id"} {
+		if _, ok := columnIndexes[field]; !ok && !(field == "facility_dhis2_id" && facility != "") {
+			missing = append(missing, models.ResultUploadColumns()[field])
+		}
+	}
+	if len(missing) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("The file has no %s column", strings.Join(missing, ", "))})
+		return
+	}
+
+	rows := readUploadRows(sheet, headerRow, columnIndexes, facility)
+	maxRows := config.RTCGwConf.Server.MaxUploadRows
+	if len(rows) == 0 || len(rows) > maxRows {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("A file should have between 1 and %d results", maxRows)})
+		return
+	}
+
+	var valid []models.LabXpertResult
+	var validRows []int
+	for i := range rows {
+		result := models.LabXpertResultFromRow(rows[i].Values)
+		if err := binding.Validator.ValidateStruct(&result); err != nil {
+			rows[i].Errors = models.FormatValidationError(err)
+			if len(rows[i].Errors) == 0 {
+				rows[i].Errors = map[string]string{"row": err.Error()}
+			}
+			continue
+		}
+		valid = append(valid, result)
+		validRows = append(validRows, i)
+	}
+
+	if len(valid) > 0 && !ConsumeTransactionQuota(c, len(valid)) {
+		return
+	}
+
+	userID := c.GetInt64("currentUser")
+	for j, result := range valid {
+		row := &rows[validRows[j]]
+		task, err := tasks.NewResultsTask(result)
+		var submission *models.Submission
+		if err == nil {
+			key := models.HashToken(fmt.Sprintf("%d:results/upload:%s:%d", userID, fileHash, row.Row))
+			submission, err = enqueueKeyedTask(c, task, result.PatientID, key)
+		}
+		if err != nil {
+			log.WithError(err).WithField("patient_id", result.PatientID).Error("Failed to queue results")
+			row.Status = BatchItemFailed
+			row.Errors = map[string]string{"row": "Failed to queue results for saving to DHIS2"}
+			continue
+		}
+		row.Status = BatchItemQueued
+		row.SubmissionID = submission.ID
+	}
+
+	upload := &models.ResultUpload{ID: uuid.NewString(), Filename: header.Filename}
+	if _, ok := c.Get("currentUser"); ok {
+		upload.UserID = &userID
+	}
+	columns := models.ResultUploadColumns()
+	for _, field := range models.ResultUploadFields {
+		if _, ok := columnIndexes[field]; ok {
+			upload.Columns = append(upload.Columns, columns[field])
+		} else {
+			upload.Columns = append(upload.Columns, "")
+		}
+	}
+	if err := upload.SetRows(rows); err == nil {
+		err = upload.Save()
+	}
+	if err != nil {
+		// the rows are queued, so the report is still returned although it cannot be downloaded later
+		log.WithError(err).WithField("upload_id", upload.ID).Error("Failed to save results upload")
+	}
+
+	status := http.StatusOK
+	if upload.Queued == 0 {
+		status = http.StatusBadRequest
+	}
+	c.JSON(status, gin.H{
+		"message":    fmt.Sprintf("%d of %d results queued for saving to DHIS2", upload.Queued, upload.TotalRows),
+		"upload_id":  upload.ID,
+		"report_csv": uploadReportLocation(upload),
+		"rows":       upload.TotalRows,
+		"queued":     upload.Queued,
+		"rejected":   upload.Rejected,
+		"results":    rows,
+	})
+}
+
+// findHeaderRow returns the index of the first non-empty row of the sheet and the index of the column of each
+// result field in it. Headers are matched without regard to case and surrounding spaces
+func findHeaderRow(sheet [][]string) (int, map[string]int) {
+	headers := make(map[string]string)
+	for field, header := range models.ResultUploadColumns() {
+		headers[strings.ToLower(strings.TrimSpace(header))] = field
+	}
+	for i, row := range sheet {
+		if isEmptyRow(row) {
+			continue
+		}
+		indexes := make(map[string]int)
+		for j, cell := range row {
+			if field, ok := headers[strings.ToLower(strings.TrimSpace(cell))]; ok {
+				if _, seen := indexes[field]; !seen {
+					indexes[field] = j
+				}
+			}
+		}
+		return i, indexes
+	}
+	return -1, nil
+}
+
+// readUploadRows returns the rows after the header row with the values of the result fields, skipping empty rows
+func readUploadRows(sheet [][]string, headerRow int, columnIndexes map[string]int, facility string) []models.ResultUploadRow {
+	var rows []models.ResultUploadRow
+	for i := headerRow + 1; i < len(sheet); i++ {
+		if isEmptyRow(sheet[i]) {
+			continue
+		}
+		row := models.ResultUploadRow{Row: i + 1, Status: BatchItemInvalid, Values: make(map[string]string)}
+		for field, j := range columnIndexes {
+			if j < len(sheet[i]) {
+				row.Values[field] = strings.TrimSpace(sheet[i][j])
+			}
+		}
+		if row.Values["facility_dhis2_id"] == "" && facility != "" {
+			row.Values["facility_dhis2_id"] = facility
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func isEmptyRow(row []string) bool {
+	for _, cell := range row {
+		if strings.TrimSpace(cell) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// GetUpload returns the report of the results upload :id. Users may only get their own uploads unless they have
+// read permission on the audit log
+func (r *ResultsController) GetUpload(c *gin.Context) {
+	upload, rows, ok := getResultUpload(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"upload_id":  upload.ID,
+		"filename":   upload.Filename,
+		"created":    upload.Created,
+		"report_csv": uploadReportLocation(upload),
+		"rows":       upload.TotalRows,
+		"queued":     upload.Queued,
+		"rejected":   upload.Rejected,
+		"results":    rows,
+	})
+}
+
+// GetUploadReport returns the rows of the results upload :id as a CSV file annotated with the status of each row,
+// the submission id of queued rows and the reasons rejected rows were not queued
+func (r *ResultsController) GetUploadReport(c *gin.Context) {
+	upload, rows, ok := getResultUpload(c)
+	if !ok {
+		return
+	}
+	var fields, headers []string
+	for i, field := range models.ResultUploadFields {
+		if i < len(upload.Columns) && upload.Columns[i] != "" {
+			fields = append(fields, field)
+			headers = append(headers, upload.Columns[i])
+		}
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, uploadReportFilename(upload)))
+	c.Status(http.StatusOK)
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	w := csv.NewWriter(c.Writer)
+	_ = w.Write(append(append([]string{"row"}, headers...), "status", "submission_id", "errors"))
+	for _, row := range rows {
+		record := []string{strconv.Itoa(row.Row)}
+		for _, field := range fields {
+			record = append(record, row.Values[field])
+		}
+		errorFields := make([]string, 0, len(row.Errors))
+		for field := range row.Errors {
+			errorFields = append(errorFields, field)
+		}
+		sort.Strings(errorFields)
+		var messages []string
+		for _, field := range errorFields {
+			messages = append(messages, row.Errors[field])
+		}
+		_ = w.Write(append(record, row.Status, row.SubmissionID, strings.Join(messages, "; ")))
+	}
+	w.Flush()
+}
+
+func getResultUpload(c *gin.Context) (*models.ResultUpload, []models.ResultUploadRow, bool) {
+	upload, err := models.GetResultUpload(c.Param("id"))
+	userID := c.GetInt64("currentUser")
+	if err != nil || ((upload.UserID == nil || *upload.UserID != userID) &&
+		!models.UserHasPermission(userID, models.ModuleAudit, models.PermRead)) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+		return nil, nil, false
+	}
+	rows, err := upload.Rows()
+	if err != nil {
+		log.WithError(err).WithField("upload_id", upload.ID).Error("Failed to read results upload report")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read the upload report"})
+		return nil, nil, false
+	}
+	return upload, rows, true
+}
+
+func uploadReportLocation(upload *models.ResultUpload) string {
+	return "/api/results/uploads/" + upload.ID + "/report.csv"
+}
+
+// uploadReportFilename names the annotated CSV after the uploaded file e.g. results-report.csv for results.xlsx
+func uploadReportFilename(upload *models.ResultUpload) string {
+	name := upload.Filename
+	if i := strings.LastIndex(name, "."); i > 0 {
+		name = name[:i]
+	}
+	name = strings.Map(func(r rune) rune {
+		if r == '"' || r == '\\' || r == '/' || r < ' ' {
+			return '_'
+		}
+		return r
+	}, name)
+	if name == "" {
+		name = "results"
+	}
+	return name + "-report.csv"
+}
@@ -2,7 +2,6 @@ package controllers
 
 import (
 	"github.com/gin-gonic/gin"
-	"github.com/hibiken/asynq"
 	log "github.com/sirupsen/logrus"
 	"net/http"
 	"rtcgw/models"
@@ -14,23 +13,24 @@ type ResultsController struct{}
 func (r *ResultsController) Start(c *gin.Context) {
 	var result models.LabXpertResult
 	if err := c.ShouldBindJSON(&result); err != nil {
+		if errorMessages := models.FormatValidationError(err); len(errorMessages) > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"errors": errorMessages})
+			return
+		}
 		RespondWithError(http.StatusBadRequest, err.Error(), c)
 		return
 	}
-	c.JSON(200, gin.H{
-		"message": "results queued for saving to DHIS2",
-	})
-	client := c.MustGet("asynqClient").(*asynq.Client)
 	task, err := tasks.NewResultsTask(result)
-	if err != nil {
-		log.Fatalf("could not create task: %v", err)
+	var submission *models.Submission
+	if err == nil {
+		submission, err = submitTask(c, task, result.PatientID, tasks.HandleResultsTask)
 	}
-	info, err := client.Enqueue(task)
 	if err != nil {
-		log.Fatalf("could not enqueue results task: %v", err)
+		log.WithError(err).WithField("patient_id", result.PatientID).Error("Failed to queue results")
+		RespondWithError(http.StatusInternalServerError, "Failed to queue results for saving to DHIS2", c)
+		return
 	}
-	log.Printf("enqueued task: id=%s queue=%s", info.ID, info.Queue)
-	return
+	respondWithSubmission(c, submission, "results")
 }
 
 // RespondWithError returns an error if request has an error
@@ -0,0 +1,120 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"rtcgw/models"
+	"strconv"
+)
+
+type RolesController struct{}
+
+type permissionRequest struct {
+	SysModule string `json:"sys_module" binding:"required"`
+	SysPerms  string `json:"sys_perms" binding:"required"`
+}
+
+// ListRoles returns all roles and their module permissions
+func (rc *RolesController) ListRoles(c *gin.Context) {
+	roles, err := models.GetUserRoles()
+	if err != nil {
+		log.WithError(err).Error("Failed to list user roles")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get roles"})
+		return
+	}
+	c.JSON(http.StatusOK, roles)
+}
+
+// GetRole returns a single role and its module permissions
+func (rc *RolesController) GetRole(c *gin.Context) {
+	role, ok := getRoleFromParam(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, role)
+}
+
+// CreateRole - Admin only
+func (rc *RolesController) CreateRole(c *gin.Context) {
+	var role models.UserRole
+	if err := c.ShouldBindJSON(&role); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	if err := role.Save(); err != nil {
+		log.WithError(err).Error("Failed to create user role")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create role"})
+		return
+	}
+	role.Permissions = []models.UserRolePermission{}
+	c.JSON(http.StatusCreated, role)
+}
+
+// GrantPermission adds the given sys_perms on sys_module to a role
+func (rc *RolesController) GrantPermission(c *gin.Context) {
+	role, ok := getRoleFromParam(c)
+	if !ok {
+		return
+	}
+	var req permissionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	if !models.IsValidModule(req.SysModule) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("Unknown sys_module, valid modules are %v", models.SysModules)})
+		return
+	}
+	perms, err := role.GrantPermission(req.SysModule, req.SysPerms)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message":    "Permission granted",
+		"sys_module": req.SysModule,
+		"sys_perms":  perms,
+	})
+}
+
+// RevokePermission removes the sys_perms query parameter permissions on :module from a role.
+// All permissions on the module are revoked if sys_perms is not provided
+func (rc *RolesController) RevokePermission(c *gin.Context) {
+	role, ok := getRoleFromParam(c)
+	if !ok {
+		return
+	}
+	module := c.Param("module")
+	if !models.IsValidModule(module) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("Unknown sys_module, valid modules are %v", models.SysModules)})
+		return
+	}
+	perms, err := role.RevokePermission(module, c.Query("sys_perms"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message":    "Permission revoked",
+		"sys_module": module,
+		"sys_perms":  perms,
+	})
+}
+
+func getRoleFromParam(c *gin.Context) (*models.UserRole, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role id"})
+		return nil, false
+	}
+	role, err := models.GetUserRoleByID(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Role not found"})
+		return nil, false
+	}
+	return role, true
+}
@@ -0,0 +1,93 @@
+package controllers
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/hibiken/asynq"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"rtcgw/models"
+)
+
+type SubmissionsController struct{}
+
+// SubmissionStatus is a submission together with the DHIS2 references of the patient once it is synced
+type SubmissionStatus struct {
+	*models.Submission
+	DHIS2 *DHIS2References `json:"dhis2,omitempty"`
+}
+
+// DHIS2References are the ids of the patient's tracked entity and events in DHIS2, as recorded in the sync_log
+type DHIS2References struct {
+	TrackedEntity string `json:"tracked_entity"`
+	Event         string `json:"event"`
+	LabEnrollment string `json:"lab_enrollment"`
+	LabEvent      string `json:"lab_event"`
+}
+
+// GetSubmission reports the status of the submission with the tracking id :id. Users may only get their own
+// submissions unless they have read permission on the audit log
+func (sc *SubmissionsController) GetSubmission(c *gin.Context) {
+	submission, err := models.GetSubmission(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Submission not found"})
+		return
+	}
+	userID := c.GetInt64("currentUser")
+	if (submission.UserID == nil || *submission.UserID != userID) &&
+		!models.UserHasPermission(userID, models.ModuleAudit, models.PermRead) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Submission not found"})
+		return
+	}
+
+	if submission.Status != models.SubmissionSynced && submission.Status != models.SubmissionFailed {
+		// the task gives the current state of submissions that are still being processed
+		inspector := c.MustGet("asynqInspector").(*asynq.Inspector)
+		info, err := inspector.GetTaskInfo(submission.Queue, submission.TaskID)
+		if err == nil {
+			updateFromTaskInfo(submission, info)
+		} else if err != asynq.ErrTaskNotFound {
+			log.WithError(err).WithField("task", submission.TaskID).Error("Failed to get task info")
+		}
+	}
+
+	c.JSON(http.StatusOK, newSubmissionStatus(submission))
+}
+
+// newSubmissionStatus adds the DHIS2 references of the patient to a synced submission
+func newSubmissionStatus(submission *models.Submission) SubmissionStatus {
+	status := SubmissionStatus{Submission: submission}
+	if submission.Status != models.SubmissionSynced {
+		return status
+	}
+	syncLog, err := models.GetSyncLogByECHISID(submission.ECHISID)
+	if err != nil {
+		log.WithError(err).Error("Failed to get sync log of submission")
+	}
+	if syncLog != nil {
+		status.DHIS2 = &DHIS2References{
+			TrackedEntity: syncLog.TrackedEntity,
+			Event:         syncLog.EventID,
+			LabEnrollment: syncLog.LabEnrollment,
+			LabEvent:      syncLog.LabEvent,
+		}
+	}
+	return status
+}
+
+// updateFromTaskInfo sets the status of the submission from the state of its task
+func updateFromTaskInfo(submission *models.Submission, info *asynq.TaskInfo) {
+	switch info.State {
+	case asynq.TaskStatePending, asynq.TaskStateScheduled, asynq.TaskStateAggregating:
+		submission.Status = models.SubmissionQueued
+	case asynq.TaskStateActive:
+		submission.Status = models.SubmissionProcessing
+	case asynq.TaskStateRetry:
+		submission.Status = models.SubmissionRetrying
+		submission.LastError = info.LastErr
+		submission.Retries = info.Retried
+	case asynq.TaskStateArchived:
+		submission.Status = models.SubmissionFailed
+		submission.LastError = info.LastErr
+		submission.Retries = info.Retried
+	}
+}
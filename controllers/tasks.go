@@ -0,0 +1,218 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"rtcgw/config"
+	"rtcgw/models"
+	"rtcgw/tasks"
+	"time"
+)
+
+// newSubmission saves the submission tracking the task for the patient echisID. Submissions with an idempotency key
+// get a task id derived from the key, so that the submission of an earlier identical submission whose task is still
+// retained is returned instead, with created false
+func newSubmission(c *gin.Context, task *asynq.Task, echisID string) (*models.Submission, bool, error) {
+	return newKeyedSubmission(c, task, echisID, c.GetString("idempotencyKey"))
+}
+
+// newKeyedSubmission is newSubmission for a submission identified by key rather than by the request's idempotency
+// key, e.g. one of several submissions made by a request. The task id is random if key is empty
+func newKeyedSubmission(c *gin.Context, task *asynq.Task, echisID, key string) (*models.Submission, bool, error) {
+	submission := &models.Submission{
+		ID:       uuid.NewString(),
+		TaskType: task.Type(),
+		Queue:    "default",
+		ECHISID:  echisID,
+	}
+	submission.TaskID = submission.ID
+	if key != "" {
+		submission.TaskID = task.Type() + ":" + key
+	}
+	if userID, ok := c.Get("currentUser"); ok {
+		id := userID.(int64)
+		submission.UserID = &id
+	}
+	created, err := models.CreateSubmission(submission)
+	if err == nil && echisID != "" {
+		// the audit log records the patients of submissions whose body does not name them e.g. FHIR resources
+		c.Set("patientIDs", append(c.GetStringSlice("patientIDs"), echisID))
+	}
+	return submission, created, err
+}
+
+// enqueueTask queues the task for the submission about the patient echisID and returns the submission tracking it
+func enqueueTask(c *gin.Context, task *asynq.Task, echisID string) (*models.Submission, error) {
+	submission, created, err := newSubmission(c, task, echisID)
+	if err != nil {
+		return nil, err
+	}
+	return submission, queueSubmission(c, submission, task, created)
+}
+
+// enqueueKeyedTask queues the task for the submission about the patient echisID identified by key, see
+// newKeyedSubmission, and returns the submission tracking it
+func enqueueKeyedTask(c *gin.Context, task *asynq.Task, echisID, key string) (*models.Submission, error) {
+	submission, created, err := newKeyedSubmission(c, task, echisID, key)
+	if err != nil {
+		return nil, err
+	}
+	return submission, queueSubmission(c, submission, task, created)
+}
+
+// queueSubmission queues the submission's task. The task of a repeated submission is not queued again
+// while the task of the earlier submission is retained
+func queueSubmission(c *gin.Context, submission *models.Submission, task *asynq.Task, created bool) error {
+	client := c.MustGet("asynqClient").(*asynq.Client)
+	// only the tasks of keyed submissions are retained, as random task ids are never repeated
+	taskID, err := enqueueSubmission(client, submission, task, created, submission.TaskID != submission.ID)
+	if err != nil {
+		return err
+	}
+	addTaskID(c, taskID)
+	return nil
+}
+
+// enqueueSubmission queues the submission's task with client and returns the task id. Tasks are retained after
+// they are processed if retain is set, so that repeated submissions are not queued again
+func enqueueSubmission(client *asynq.Client, submission *models.Submission, task *asynq.Task,
+	created, retain bool) (string, error) {
+	opts := []asynq.Option{asynq.Queue(submission.Queue), asynq.TaskID(submission.TaskID)}
+	if retain {
+		opts = append(opts, asynq.Retention(models.IdempotencyRetention()))
+	}
+	info, err := client.Enqueue(task, opts...)
+	if errors.Is(err, asynq.ErrTaskIDConflict) {
+		log.Infof("task %s for repeated submission is already queued", submission.TaskID)
+		return submission.TaskID, nil
+	}
+	if err != nil {
+		if created {
+			_ = submission.SetStatus(models.SubmissionFailed, err, 0)
+		}
+		return "", err
+	}
+	if !created {
+		// the task of the earlier submission has finished and is no longer retained
+		if err := submission.Requeue(); err != nil {
+			log.WithError(err).Error("Failed to requeue submission")
+		}
+	}
+	log.Printf("enqueued %s task: id=%s queue=%s", task.Type(), info.ID, info.Queue)
+	return info.ID, nil
+}
+
+// runTask processes the task for a synchronous submission about the patient echisID inline and returns the
+// submission tracking it. Submissions failing with an error that may be retried fall back to being queued.
+// Submissions not processed within sync_timeout_seconds are left to the inline run, which remains their only
+// processor so that the client is not saved to DHIS2 twice, and are only queued should that run fail or not finish
+// within sync_run_timeout_seconds
+func runTask(c *gin.Context, task *asynq.Task, echisID string, h asynq.HandlerFunc) (*models.Submission, error) {
+	submission, created, err := newSubmission(c, task, echisID)
+	if err != nil {
+		return nil, err
+	}
+	if !created {
+		// an identical submission is already being processed
+		return submission, nil
+	}
+
+	timeout := time.NewTimer(time.Duration(config.RTCGwConf.Server.SyncTimeoutSeconds) * time.Second)
+	defer timeout.Stop()
+	// the inline run gets its own copy of the submission and a context that is not cancelled with the request,
+	// as it may outlive the request, but that expires after sync_run_timeout_seconds
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(c.Request.Context()),
+		time.Duration(config.RTCGwConf.Server.SyncRunTimeoutSeconds)*time.Second)
+	inline := *submission
+	done := make(chan error, 1)
+	go func() {
+		done <- tasks.RunSubmission(ctx, &inline, task, h)
+	}()
+	select {
+	case err := <-done:
+		cancel()
+		if err == nil || errors.Is(err, asynq.SkipRetry) {
+			addTaskID(c, submission.TaskID)
+			return &inline, nil
+		}
+		log.WithError(err).WithField("submission", submission.ID).Info("Synchronous submission failed, queueing it")
+		submission = &inline
+	case <-timeout.C:
+		log.WithField("submission", submission.ID).Info("Synchronous submission timed out, finishing it in the background")
+		client := c.MustGet("asynqClient").(*asynq.Client)
+		retain := c.GetString("idempotencyKey") != ""
+		queued := *submission
+		go func() {
+			defer cancel()
+			var err error
+			select {
+			case err = <-done:
+			case <-ctx.Done():
+				log.WithField("submission", queued.ID).Warn("Synchronous submission did not finish in time, queueing it")
+				err = ctx.Err()
+			}
+			if err != nil && !errors.Is(err, asynq.SkipRetry) {
+				if _, err := enqueueSubmission(client, &queued, task, false, retain); err != nil {
+					log.WithError(err).WithField("submission", queued.ID).Error("Failed to queue submission")
+				}
+			}
+		}()
+		addTaskID(c, submission.TaskID)
+		return submission, nil
+	}
+	return submission, queueSubmission(c, submission, task, false)
+}
+
+// submitTask runs the task for the submission inline with h when the sync mode is requested, otherwise it queues it
+func submitTask(c *gin.Context, task *asynq.Task, echisID string, h asynq.HandlerFunc) (*models.Submission, error) {
+	if c.Query("mode") == "sync" {
+		return runTask(c, task, echisID, h)
+	}
+	return enqueueTask(c, task, echisID)
+}
+
+// respondWithSubmission reports the outcome of a submission of a record e.g. "client". Synchronous submissions
+// report the DHIS2 references once synced or the conflicts if DHIS2 rejected them
+func respondWithSubmission(c *gin.Context, submission *models.Submission, record string) {
+	if c.Query("mode") != "sync" {
+		c.JSON(http.StatusOK, gin.H{
+			"message":       record + " queued for saving to DHIS2",
+			"submission_id": submission.ID,
+		})
+		return
+	}
+	switch submission.Status {
+	case models.SubmissionSynced:
+		status := newSubmissionStatus(submission)
+		c.JSON(http.StatusOK, gin.H{
+			"message":       record + " saved to DHIS2",
+			"submission_id": submission.ID,
+			"status":        submission.Status,
+			"dhis2":         status.DHIS2,
+		})
+	case models.SubmissionFailed:
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error":         record + " rejected by DHIS2",
+			"submission_id": submission.ID,
+			"status":        submission.Status,
+			"last_error":    submission.LastError,
+			"conflicts":     submission.Conflicts,
+		})
+	default:
+		c.JSON(http.StatusAccepted, gin.H{
+			"message":       record + " queued for saving to DHIS2",
+			"submission_id": submission.ID,
+			"status":        submission.Status,
+		})
+	}
+}
+
+// addTaskID records the id of a task enqueued while handling the request for the audit log
+func addTaskID(c *gin.Context, taskID string) {
+	c.Set("taskIDs", append(c.GetStringSlice("taskIDs"), taskID))
+}
@@ -0,0 +1,136 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"rtcgw/models"
+	"rtcgw/utils"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultTokenValidityDays = 30
+	maxTokenValidityDays     = 365
+)
+
+type createTokenRequest struct {
+	Name          string   `json:"name" binding:"required"`
+	Scopes        []string `json:"scopes" binding:"required,min=1"`
+	ExpiresInDays int      `json:"expires_in_days" binding:"omitempty,min=1"`
+}
+
+// ListTokens returns all the API tokens of the currently authenticated user
+func (uc *UserController) ListTokens(c *gin.Context) {
+	tokens, err := models.GetUserTokens(c.GetInt64("currentUser"))
+	if err != nil {
+		log.WithError(err).Error("Failed to list user tokens")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get tokens"})
+		return
+	}
+	c.JSON(http.StatusOK, tokens)
+}
+
+// CreateToken issues a new named and scoped API token for the currently authenticated user.
+// Other tokens of the user remain active. A token may only create tokens with scopes it has itself
+func (uc *UserController) CreateToken(c *gin.Context) {
+	var req createTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		errorMessages := models.FormatValidationError(err)
+		c.JSON(http.StatusBadRequest, gin.H{"errors": errorMessages})
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !models.IsValidScope(scope) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("Invalid scope %s, valid scopes are %v", scope, models.AllScopes())})
+			return
+		}
+	}
+	if scopes, ok := c.Get("tokenScopes"); ok {
+		for _, scope := range req.Scopes {
+			if !utils.Contains(scopes.([]string), scope) {
+				c.JSON(http.StatusForbidden, gin.H{
+					"error": fmt.Sprintf("Token lacks the %s scope, so it cannot create tokens with it", scope)})
+				return
+			}
+		}
+	}
+	if req.ExpiresInDays == 0 {
+		req.ExpiresInDays = defaultTokenValidityDays
+	}
+	if req.ExpiresInDays > maxTokenValidityDays {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("expires_in_days cannot exceed %d", maxTokenValidityDays)})
+		return
+	}
+
+	userID := c.GetInt64("currentUser")
+	exists, err := models.ActiveTokenNameExists(userID, req.Name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create token"})
+		return
+	}
+	if exists {
+		c.JSON(http.StatusConflict, gin.H{"error": "An active token with this name already exists"})
+		return
+	}
+
+	token, userToken, err := models.NewUserToken(
+		userID, req.Name, req.Scopes, time.Duration(req.ExpiresInDays)*24*time.Hour)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+	if err = userToken.Save(); err != nil {
+		log.WithError(err).Error("Failed to save user token")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save user token"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Token created successfully",
+		"id":      userToken.ID,
+		"name":    userToken.Name,
+		"scopes":  userToken.Scopes,
+		"token":   token,
+		"expires": userToken.ExpiresAt,
+	})
+}
+
+// RevokeToken deactivates a single API token of the currently authenticated user
+func (uc *UserController) RevokeToken(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid token id"})
+		return
+	}
+	userToken, err := models.GetUserTokenByID(c.GetInt64("currentUser"), id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Token not found"})
+		return
+	}
+	if err := userToken.Revoke(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke token"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Token revoked"})
+}
+
+// limitToTokenScopes returns the scopes that the token authenticating the request also has, or all of them if the
+// request is not authenticated with a token, so that a token cannot be used to get a token with more scopes
+func limitToTokenScopes(c *gin.Context, scopes []string) []string {
+	tokenScopes, ok := c.Get("tokenScopes")
+	if !ok {
+		return scopes
+	}
+	limited := []string{}
+	for _, scope := range scopes {
+		if utils.Contains(tokenScopes.([]string), scope) {
+			limited = append(limited, scope)
+		}
+	}
+	return limited
+}
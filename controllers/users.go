@@ -8,6 +8,7 @@ import (
 	"rtcgw/db"
 	"rtcgw/models"
 	"rtcgw/utils"
+	"strconv"
 	"time"
 )
 
@@ -15,26 +16,46 @@ type UserController struct{}
 
 // CreateUser - Admin only
 func (uc *UserController) CreateUser(c *gin.Context) {
-	var user models.User
-	if err := c.ShouldBindJSON(&user); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+	var req models.CreateUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		errorMessages := models.FormatValidationError(err)
+		c.JSON(http.StatusBadRequest, gin.H{"errors": errorMessages})
 		return
 	}
 
-	// Generate UID
-	uid := utils.GenerateUID()
+	taken, err := models.UsernameTaken(req.Username, "")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
+		return
+	}
+	if taken {
+		c.JSON(http.StatusConflict, gin.H{"error": "Username already exists"})
+		return
+	}
+	if err := models.ValidatePassword(req.Password); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := models.GetUserRoleByID(req.UserRole); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user_role"})
+		return
+	}
 
-	user.UID = uid
-	created := time.Now()
-	user.Created = &created
-	user.Updated = &created
+	user := models.User{
+		UID:          utils.GenerateUID(),
+		Username:     req.Username,
+		FirstName:    req.FirstName,
+		LastName:     req.LastName,
+		Email:        req.Email,
+		Phone:        req.Phone,
+		UserRole:     req.UserRole,
+		IsActive:     true,
+		IsSystemUser: req.IsSystemUser,
+	}
 
 	// Save user
-	_, err := db.GetDB().NamedExec(`INSERT INTO users (uid, username, password, firstname, 
-			lastname, email, telephone, is_active, is_system_user, created, updated)
-		VALUES (:uid, :username, :password, :firstname, :lastname, :email, :telephone, 
-			:is_active, :is_system_user, :created, :updated)`, user)
-	if err != nil {
+	if err := user.Create(req.Password); err != nil {
+		log.WithError(err).Error("Failed to create user")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
 		return
 	}
@@ -42,6 +63,31 @@ func (uc *UserController) CreateUser(c *gin.Context) {
 	c.JSON(http.StatusCreated, user)
 }
 
+// ListUsers returns a page of users filtered by the q, user_role, is_active and is_system_user query parameters
+func (uc *UserController) ListUsers(c *gin.Context) {
+	page, pageSize := getPaging(c)
+	filter := models.UserFilter{
+		Query:        c.Query("q"),
+		IsActive:     getBoolQuery(c, "is_active"),
+		IsSystemUser: getBoolQuery(c, "is_system_user"),
+	}
+	if role, err := strconv.ParseInt(c.Query("user_role"), 10, 64); err == nil {
+		filter.UserRole = role
+	}
+
+	users, total, err := models.GetUsers(filter, page, pageSize)
+	if err != nil {
+		log.WithError(err).Error("Failed to list users")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get users"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"pager": NewPager(page, pageSize, total),
+		"users": users,
+	})
+}
+
 // GetUserByUID ...
 func (uc *UserController) GetUserByUID(c *gin.Context) {
 	uid := c.Param("uid")
@@ -65,10 +111,20 @@ func (uc *UserController) UpdateUser(c *gin.Context) {
 		return
 	}
 
+	taken, err := models.UsernameTaken(user.Username, uid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
+		return
+	}
+	if taken {
+		c.JSON(http.StatusConflict, gin.H{"error": "Username already exists"})
+		return
+	}
+
 	updated := time.Now()
 	user.Updated = &updated
 
-	_, err := db.GetDB().NamedExec(`
+	_, err = db.GetDB().NamedExec(`
 		UPDATE users 
 		SET username=:username, firstname=:firstname, lastname=:lastname, email=:email, telephone=:telephone, updated=:updated 
 		WHERE uid=:uid`, map[string]interface{}{
@@ -91,18 +147,92 @@ func (uc *UserController) UpdateUser(c *gin.Context) {
 
 // DeleteUser (Soft delete)
 func (uc *UserController) DeleteUser(c *gin.Context) {
-	uid := c.Param("uid")
+	uc.setUserActive(c, false)
+}
+
+// ActivateUser reactivates a previously deactivated user
+func (uc *UserController) ActivateUser(c *gin.Context) {
+	uc.setUserActive(c, true)
+}
+
+func (uc *UserController) setUserActive(c *gin.Context, active bool) {
+	user, err := models.GetUserByUID(c.Param("uid"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if !active && user.ID == c.GetInt64("currentUser") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot deactivate yourself"})
+		return
+	}
+
+	if err := user.SetActive(active); err != nil {
+		if active {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to activate user"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to deactivate user"})
+		}
+		return
+	}
+
+	if active {
+		c.JSON(http.StatusOK, gin.H{"message": "User activated"})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"message": "User deactivated"})
+	}
+}
 
-	_, err := db.GetDB().Exec(`UPDATE users SET is_active = FALSE WHERE uid = $1`, uid)
+// AssignRole sets the role of the user identified by uid
+func (uc *UserController) AssignRole(c *gin.Context) {
+	var req struct {
+		UserRole int64 `json:"user_role" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	user, err := models.GetUserByUID(c.Param("uid"))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to deactivate user"})
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	role, err := models.GetUserRoleByID(req.UserRole)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user_role"})
+		return
+	}
+	if err := user.SetRole(role.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to assign role"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "User deactivated"})
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("User assigned role %s", role.Name)})
 }
 
-// CreateUserToken generates and saves an API token for the currently authenticated user
+// SetCertificate maps a client certificate subject common name or SAN to the user identified by uid
+func (uc *UserController) SetCertificate(c *gin.Context) {
+	var req struct {
+		CertSubject string `json:"cert_subject"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	user, err := models.GetUserByUID(c.Param("uid"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err := user.SetCertSubject(req.CertSubject); err != nil {
+		log.WithError(err).Error("Failed to set user certificate subject")
+		c.JSON(http.StatusConflict, gin.H{"error": "Failed to set certificate subject, it may belong to another user"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "User certificate subject updated"})
+}
+
+// CreateUserToken generates and saves an API token for the currently authenticated user. A token gets all scopes,
+// unless the request is authenticated with a token, whose scopes it is then limited to
 func (uc *UserController) CreateUserToken(c *gin.Context) {
 	// Extract the authenticated user's UID from the request context
 	authUserUID, exists := c.Get("currentUser")
@@ -126,57 +256,25 @@ func (uc *UserController) CreateUserToken(c *gin.Context) {
 	}
 
 	dbConn := db.GetDB()
-	// Invalidate all existing active tokens for the user
-	_, err = dbConn.Exec(`UPDATE user_apitoken SET is_active = FALSE WHERE user_id = $1 AND is_active = TRUE`, user.ID)
+	// Invalidate the user's existing default token, named tokens are left untouched
+	_, err = dbConn.Exec(`UPDATE user_apitoken SET is_active = FALSE, updated_at = NOW()
+		WHERE user_id = $1 AND name = $2 AND is_active = TRUE`, user.ID, models.DefaultTokenName)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to invalidate existing tokens"})
 		return
 	}
 
-	var existingToken models.UserToken
-
-	// Check if an active, non-expired token already exists
-	err = dbConn.Get(&existingToken, `
-		SELECT * FROM user_apitoken 
-		WHERE user_id = $1 AND is_active = TRUE AND expires_at > NOW() 
-		LIMIT 1`, user.ID)
-
-	if err == nil {
-		// If an active token exists, return it instead of creating a new one
-		c.JSON(http.StatusOK, gin.H{
-			"message": "An active token already exists",
-			"token":   existingToken.Token,
-			"expires": existingToken.ExpiresAt,
-		})
-		return
-	}
-
-	// Generate a new token
-	token, err := models.GenerateToken()
+	// Generate a new token valid for 30 days, only its hash is saved
+	token, userToken, err := models.NewUserToken(
+		user.ID, models.DefaultTokenName, limitToTokenScopes(c, models.AllScopes()), 30*24*time.Hour)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
 	}
 
-	// Set token expiration (e.g., 30 days from now)
-	expirationTime := time.Now().Add(30 * 24 * time.Hour) // 30-day validity
-
-	// Create a new UserToken object
-	userToken := models.UserToken{
-		UserID:    user.ID,
-		Token:     token,
-		IsActive:  true,
-		ExpiresAt: expirationTime,
-		Created:   time.Now(),
-		Updated:   time.Now(),
-	}
-
 	// Save token in the database
-	_, err = dbConn.NamedExec(`
-		INSERT INTO user_apitoken (user_id, token, is_active, expires_at, created_at, updated_at)
-		VALUES (:user_id, :token, :is_active, :expires_at, :created, :updated)`, userToken)
-
-	if err != nil {
+	if err = userToken.Save(); err != nil {
+		log.WithError(err).Error("Failed to save user token")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save user token"})
 		return
 	}
@@ -184,11 +282,12 @@ func (uc *UserController) CreateUserToken(c *gin.Context) {
 	c.JSON(http.StatusCreated, gin.H{
 		"message": "Token created successfully",
 		"token":   token,
-		"expires": expirationTime,
+		"expires": userToken.ExpiresAt,
 	})
 }
 
-// RefreshUserToken allows the currently authenticated user to refresh their own API token
+// RefreshUserToken allows the currently authenticated user to refresh their own API token. Requests authenticated
+// with a token get a token limited to the scopes of both tokens
 func (uc *UserController) RefreshUserToken(c *gin.Context) {
 	// Extract the authenticated user's UID from context
 	authUserUID, exists := c.Get("currentUser")
@@ -214,11 +313,11 @@ func (uc *UserController) RefreshUserToken(c *gin.Context) {
 	dbConn := db.GetDB()
 	var existingToken models.UserToken
 
-	// Check for an active token belonging to the authenticated user
+	// Check for an active default token belonging to the authenticated user
 	err = dbConn.Get(&existingToken, `
 		SELECT * FROM user_apitoken 
-		WHERE user_id = $1 AND is_active = TRUE AND expires_at > NOW() 
-		LIMIT 1`, user.ID)
+		WHERE user_id = $1 AND name = $2 AND is_active = TRUE AND expires_at > NOW() 
+		LIMIT 1`, user.ID, models.DefaultTokenName)
 
 	if err != nil {
 		log.Infof("No token found for user: %s", err.Error())
@@ -233,32 +332,17 @@ func (uc *UserController) RefreshUserToken(c *gin.Context) {
 		return
 	}
 
-	// Generate a new token
-	newToken, err := models.GenerateToken()
+	// Generate a new token valid for 30 days with the same scopes, only its hash is saved
+	newToken, newUserToken, err := models.NewUserToken(
+		user.ID, existingToken.Name, limitToTokenScopes(c, existingToken.Scopes), 30*24*time.Hour)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate new token"})
 		return
 	}
 
-	// Set new expiration (e.g., 30 days from now)
-	newExpiration := time.Now().Add(30 * 24 * time.Hour)
-
-	// Create a new UserToken object
-	newUserToken := models.UserToken{
-		UserID:    user.ID,
-		Token:     newToken,
-		IsActive:  true,
-		ExpiresAt: newExpiration,
-		Created:   time.Now(),
-		Updated:   time.Now(),
-	}
-
 	// Save the new token
-	_, err = dbConn.NamedExec(`
-		INSERT INTO user_apitoken (user_id, token, is_active, expires_at, created_at, updated_at)
-		VALUES (:user_id, :token, :is_active, :expires_at, :created_at, :updated_at)`, newUserToken)
-
-	if err != nil {
+	if err = newUserToken.Save(); err != nil {
+		log.WithError(err).Error("Failed to save new user token")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save new token"})
 		return
 	}
@@ -266,6 +350,6 @@ func (uc *UserController) RefreshUserToken(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Token refreshed successfully",
 		"token":   newToken,
-		"expires": newExpiration,
+		"expires": newUserToken.ExpiresAt,
 	})
 }
@@ -0,0 +1,3 @@
+DELETE FROM user_role_permissions
+WHERE sys_module IN ('Clients', 'Results', 'Tokens', 'Stats')
+  AND user_role IN (SELECT id FROM user_roles WHERE name IN ('Administrator', 'SMS User'));
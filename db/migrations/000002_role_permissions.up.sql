@@ -0,0 +1,9 @@
+INSERT INTO user_role_permissions(user_role, sys_module, sys_perms)
+VALUES ((SELECT id FROM user_roles WHERE name = 'Administrator'), 'Clients', 'rmad'),
+       ((SELECT id FROM user_roles WHERE name = 'Administrator'), 'Results', 'rmad'),
+       ((SELECT id FROM user_roles WHERE name = 'Administrator'), 'Tokens', 'rmad'),
+       ((SELECT id FROM user_roles WHERE name = 'Administrator'), 'Stats', 'rmad'),
+       ((SELECT id FROM user_roles WHERE name = 'SMS User'), 'Clients', 'rma'),
+       ((SELECT id FROM user_roles WHERE name = 'SMS User'), 'Results', 'rma'),
+       ((SELECT id FROM user_roles WHERE name = 'SMS User'), 'Tokens', 'rmad')
+ON CONFLICT (sys_module, user_role) DO NOTHING;
@@ -0,0 +1,6 @@
+-- hashed tokens cannot be restored, deactivate them instead
+UPDATE user_apitoken SET is_active = FALSE;
+
+DROP INDEX IF EXISTS user_apitoken_token_idx;
+ALTER TABLE user_apitoken DROP COLUMN IF EXISTS last_used_ip;
+ALTER TABLE user_apitoken DROP COLUMN IF EXISTS last_used_at;
@@ -0,0 +1,7 @@
+ALTER TABLE user_apitoken ADD COLUMN IF NOT EXISTS last_used_at timestamptz;
+ALTER TABLE user_apitoken ADD COLUMN IF NOT EXISTS last_used_ip TEXT;
+
+-- tokens are only stored as SHA-256 hashes
+UPDATE user_apitoken SET token = encode(digest(token, 'sha256'), 'hex');
+
+CREATE INDEX IF NOT EXISTS user_apitoken_token_idx ON user_apitoken (token);
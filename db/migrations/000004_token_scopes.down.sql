@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS user_apitoken_user_id_idx;
+ALTER TABLE user_apitoken DROP COLUMN IF EXISTS scopes;
+ALTER TABLE user_apitoken DROP COLUMN IF EXISTS name;
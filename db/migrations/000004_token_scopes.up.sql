@@ -0,0 +1,9 @@
+ALTER TABLE user_apitoken ADD COLUMN IF NOT EXISTS name TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE user_apitoken ADD COLUMN IF NOT EXISTS scopes TEXT[] NOT NULL DEFAULT '{}';
+
+-- existing tokens keep full access
+UPDATE user_apitoken SET scopes = ARRAY [
+    'clients:read', 'clients:write', 'results:read', 'results:write', 'users:read', 'users:write',
+    'tokens:read', 'tokens:write', 'stats:read', 'stats:write'];
+
+CREATE INDEX IF NOT EXISTS user_apitoken_user_id_idx ON user_apitoken (user_id);
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS ip_lockouts;
+
+ALTER TABLE users DROP COLUMN IF EXISTS locked_until;
+ALTER TABLE users DROP COLUMN IF EXISTS lockout_count;
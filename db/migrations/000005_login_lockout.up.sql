@@ -0,0 +1,12 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS lockout_count INT NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS locked_until timestamptz;
+
+CREATE TABLE IF NOT EXISTS ip_lockouts
+(
+    ip              TEXT NOT NULL PRIMARY KEY,
+    failed_attempts TEXT NOT NULL DEFAULT '0/' || to_char(NOW(), 'YYYYmmdd'),
+    lockout_count   INT  NOT NULL DEFAULT 0,
+    locked_until    timestamptz,
+    created         timestamptz   DEFAULT CURRENT_TIMESTAMP,
+    updated         timestamptz   DEFAULT CURRENT_TIMESTAMP
+);
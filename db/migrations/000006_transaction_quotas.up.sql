@@ -0,0 +1,3 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS transaction_cap INT; -- NULL or 0 means no cap
+ALTER TABLE users ADD COLUMN IF NOT EXISTS transaction_window TEXT NOT NULL DEFAULT 'daily'
+    CHECK (transaction_window IN ('daily', 'hourly'));
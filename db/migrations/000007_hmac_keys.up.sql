@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS hmac_keys
+(
+    id           bigserial NOT NULL PRIMARY KEY,
+    user_id      BIGINT    NOT NULL REFERENCES users ON DELETE CASCADE ON UPDATE CASCADE,
+    key_id       TEXT      NOT NULL UNIQUE,
+    secret       TEXT      NOT NULL, -- shared secret, needed in the clear to verify signatures
+    is_active    BOOLEAN   NOT NULL DEFAULT 't',
+    last_used_at timestamptz,
+    created      timestamptz        DEFAULT CURRENT_TIMESTAMP,
+    updated      timestamptz        DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS hmac_keys_user_id_idx ON hmac_keys (user_id);
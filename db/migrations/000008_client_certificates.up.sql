@@ -0,0 +1,2 @@
+-- the client certificate subject common name or SAN identifying the user
+ALTER TABLE users ADD COLUMN IF NOT EXISTS cert_subject TEXT UNIQUE;
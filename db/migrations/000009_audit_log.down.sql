@@ -0,0 +1,3 @@
+DELETE FROM user_role_permissions WHERE sys_module = 'Audit';
+
+DROP TABLE IF EXISTS audit_log;
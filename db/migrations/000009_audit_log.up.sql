@@ -0,0 +1,24 @@
+CREATE TABLE IF NOT EXISTS audit_log
+(
+    id           bigserial NOT NULL PRIMARY KEY,
+    user_id      BIGINT    REFERENCES users ON DELETE SET NULL ON UPDATE CASCADE,
+    token_id     BIGINT, -- not a foreign key since expired tokens are purged
+    auth_method  TEXT      NOT NULL DEFAULT '',
+    method       TEXT      NOT NULL,
+    route        TEXT      NOT NULL DEFAULT '',
+    path         TEXT      NOT NULL,
+    client_ip    TEXT      NOT NULL DEFAULT '',
+    patient_ids  TEXT[]    NOT NULL DEFAULT '{}', -- submitted echis_patient_id or patient_id values
+    status       INT       NOT NULL DEFAULT 0,
+    task_ids     TEXT[]    NOT NULL DEFAULT '{}',
+    request_body TEXT      NOT NULL DEFAULT '', -- with PII fields redacted
+    created      timestamptz        DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_user_id_idx ON audit_log (user_id);
+CREATE INDEX IF NOT EXISTS audit_log_created_idx ON audit_log (created);
+CREATE INDEX IF NOT EXISTS audit_log_patient_ids_idx ON audit_log USING GIN (patient_ids);
+
+INSERT INTO user_role_permissions(user_role, sys_module, sys_perms)
+VALUES ((SELECT id FROM user_roles WHERE name = 'Administrator'), 'Audit', 'r')
+ON CONFLICT (sys_module, user_role) DO NOTHING;
@@ -0,0 +1,3 @@
+ALTER TABLE users DROP COLUMN IF EXISTS password_changed;
+ALTER TABLE users DROP COLUMN IF EXISTS must_change_password;
+ALTER TABLE users DROP COLUMN IF EXISTS onetime_password_expiry;
@@ -0,0 +1,4 @@
+-- onetime_password holds the blowfish hash of a one-time password issued by an admin
+ALTER TABLE users ADD COLUMN IF NOT EXISTS onetime_password_expiry timestamptz;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS must_change_password BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS password_changed timestamptz;
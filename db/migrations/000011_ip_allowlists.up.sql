@@ -0,0 +1,10 @@
+-- a user with allowed addresses may only authenticate from within one of the CIDR ranges
+CREATE TABLE IF NOT EXISTS user_allowed_ips
+(
+    id          bigserial NOT NULL PRIMARY KEY,
+    user_id     BIGINT    NOT NULL REFERENCES users ON DELETE CASCADE ON UPDATE CASCADE,
+    cidr        CIDR      NOT NULL,
+    description TEXT      NOT NULL DEFAULT '',
+    created     timestamptz        DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (user_id, cidr)
+);
@@ -0,0 +1,15 @@
+-- responses to client and result submissions, replayed when a submission is repeated within the retention window
+CREATE TABLE IF NOT EXISTS idempotent_requests
+(
+    id              bigserial NOT NULL PRIMARY KEY,
+    user_id         BIGINT    NOT NULL REFERENCES users ON DELETE CASCADE ON UPDATE CASCADE,
+    route           TEXT      NOT NULL,
+    idempotency_key TEXT      NOT NULL, -- the Idempotency-Key header or the request hash
+    request_hash    TEXT      NOT NULL, -- hex SHA-256 of the request method, path and body
+    status          INT       NOT NULL,
+    response_body   TEXT      NOT NULL DEFAULT '',
+    created         timestamptz        DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (user_id, route, idempotency_key)
+);
+
+CREATE INDEX IF NOT EXISTS idempotent_requests_created_idx ON idempotent_requests (created);
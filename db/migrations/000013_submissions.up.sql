@@ -0,0 +1,17 @@
+-- tracks each accepted client or result submission through its task until it is synced to DHIS2
+CREATE TABLE IF NOT EXISTS submissions
+(
+    id         TEXT      NOT NULL PRIMARY KEY, -- the tracking id returned to the integrator
+    user_id    BIGINT    REFERENCES users ON DELETE SET NULL ON UPDATE CASCADE,
+    task_type  TEXT      NOT NULL,
+    task_id    TEXT      NOT NULL UNIQUE,
+    queue      TEXT      NOT NULL DEFAULT 'default',
+    echis_id   TEXT      NOT NULL DEFAULT '',
+    status     TEXT      NOT NULL DEFAULT 'queued', -- queued, processing, retrying, synced or failed
+    last_error TEXT      NOT NULL DEFAULT '',
+    retries    INT       NOT NULL DEFAULT 0,
+    created    timestamptz        DEFAULT CURRENT_TIMESTAMP,
+    updated    timestamptz        DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS submissions_echis_id_idx ON submissions (echis_id);
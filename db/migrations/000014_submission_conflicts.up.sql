@@ -0,0 +1,2 @@
+-- the import conflicts of submissions rejected by DHIS2
+ALTER TABLE submissions ADD COLUMN IF NOT EXISTS conflicts TEXT[];
@@ -0,0 +1,15 @@
+-- patients whose results arrived before they had a sync_log row, to be searched for in DHIS2
+CREATE TABLE IF NOT EXISTS missing_clients
+(
+    id              bigserial NOT NULL PRIMARY KEY,
+    echis_id        TEXT      NOT NULL UNIQUE,
+    facility_id     TEXT      NOT NULL DEFAULT '', -- the DHIS2 org unit the results were sent for
+    status          TEXT      NOT NULL DEFAULT 'pending', -- pending or matched
+    search_attempts INT       NOT NULL DEFAULT 0,
+    last_error      TEXT      NOT NULL DEFAULT '',
+    last_searched   timestamptz,
+    created         timestamptz        DEFAULT CURRENT_TIMESTAMP,
+    updated         timestamptz        DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS missing_clients_status_idx ON missing_clients (status);
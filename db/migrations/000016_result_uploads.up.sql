@@ -0,0 +1,15 @@
+-- reports of spreadsheet uploads of results, kept so that the annotated CSV can be downloaded later
+CREATE TABLE IF NOT EXISTS result_uploads
+(
+    id         TEXT      NOT NULL PRIMARY KEY, -- the upload id returned to the user
+    user_id    BIGINT    REFERENCES users ON DELETE SET NULL ON UPDATE CASCADE,
+    filename   TEXT      NOT NULL DEFAULT '',
+    total_rows INT       NOT NULL DEFAULT 0,
+    queued     INT       NOT NULL DEFAULT 0,
+    rejected   INT       NOT NULL DEFAULT 0,
+    columns    TEXT[]    NOT NULL DEFAULT '{}', -- the headers of the uploaded columns, by result field
+    report     TEXT      NOT NULL DEFAULT '', -- JSON array of the outcome of each row
+    created    timestamptz        DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS result_uploads_user_id_idx ON result_uploads (user_id);
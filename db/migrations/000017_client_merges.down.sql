@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS client_merges;
+DROP INDEX IF EXISTS sync_log_merged_into_idx;
+ALTER TABLE sync_log DROP COLUMN IF EXISTS merged_into;
@@ -0,0 +1,24 @@
+-- duplicate patients merged into a surviving patient, whose sync_log row is used for both echis ids
+ALTER TABLE sync_log ADD COLUMN IF NOT EXISTS merged_into TEXT;
+
+CREATE INDEX IF NOT EXISTS sync_log_merged_into_idx ON sync_log (merged_into);
+
+CREATE TABLE IF NOT EXISTS client_merges
+(
+    id                       bigserial NOT NULL PRIMARY KEY,
+    survivor_echis_id        TEXT      NOT NULL,
+    duplicate_echis_id       TEXT      NOT NULL,
+    survivor_tracked_entity  TEXT      NOT NULL DEFAULT '',
+    duplicate_tracked_entity TEXT      NOT NULL DEFAULT '',
+    moved_results            BOOLEAN   NOT NULL DEFAULT 'f', -- the screening results were copied to the survivor
+    lab_enrollment           TEXT      NOT NULL DEFAULT '', -- the survivor's lab enrollment created for the duplicate's
+    lab_event                TEXT      NOT NULL DEFAULT '', -- the survivor's lab event created for the duplicate's
+    duplicate_marking        TEXT      NOT NULL DEFAULT '', -- inactive or potential_duplicate
+    status                   TEXT      NOT NULL DEFAULT 'merged', -- merged or failed
+    error                    TEXT      NOT NULL DEFAULT '',
+    user_id                  BIGINT REFERENCES users ON DELETE SET NULL,
+    created                  timestamptz        DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS client_merges_survivor_idx ON client_merges (survivor_echis_id);
+CREATE INDEX IF NOT EXISTS client_merges_duplicate_idx ON client_merges (duplicate_echis_id);
@@ -0,0 +1 @@
+ALTER TABLE missing_clients DROP COLUMN IF EXISTS results;
@@ -0,0 +1,2 @@
+-- results received for missing clients, queued again for saving to DHIS2 once the client is matched
+ALTER TABLE missing_clients ADD COLUMN IF NOT EXISTS results JSONB NOT NULL DEFAULT '[]';
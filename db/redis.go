@@ -0,0 +1,17 @@
+package db
+
+import (
+	"github.com/redis/go-redis/v9"
+	"rtcgw/config"
+)
+
+var redisClient *redis.Client
+
+func init() {
+	redisClient = redis.NewClient(&redis.Options{Addr: config.RTCGwConf.Server.RedisAddress})
+}
+
+// GetRedis ...
+func GetRedis() *redis.Client {
+	return redisClient
+}
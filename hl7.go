@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin/binding"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"rtcgw/config"
+	"rtcgw/hl7"
+	"rtcgw/models"
+	"rtcgw/tasks"
+	"strings"
+	"sync"
+	"time"
+)
+
+// startHL7Listener receives GeneXpert results as HL7 v2 ORU^R01 messages over MLLP on hl7_port
+func startHL7Listener(wg *sync.WaitGroup) {
+	defer wg.Done()
+	server := &hl7.Server{
+		Addr:        ":" + config.RTCGwConf.Server.HL7Port,
+		Handler:     handleORU,
+		ReadTimeout: time.Duration(config.RTCGwConf.Server.HL7IdleTimeoutSeconds) * time.Second,
+	}
+	for _, sender := range config.RTCGwConf.Server.HL7Senders {
+		if _, err := models.NormalizeCIDR(sender.Address); err != nil {
+			log.Fatalf("Invalid address of hl7_senders: %v", err)
+		}
+	}
+	if len(config.RTCGwConf.Server.HL7Senders) == 0 {
+		log.Warn("No hl7_senders are configured, so all HL7 messages will be rejected")
+	}
+	log.Infof("Receiving HL7 messages over MLLP on %s", server.Addr)
+	if err := server.ListenAndServe(); err != nil {
+		log.Fatalf("Could not start HL7 listener: %v", err)
+	}
+}
+
+// handleORU queues the results of an ORU^R01 message for saving to DHIS2. The message is only accepted if all its
+// results are valid, otherwise it is acknowledged with AE and the errors. Messages whose results cannot be queued
+// are rejected with AR, so that the sender sends them again. Messages from senders not in hl7_senders are rejected
+// with AR and every accepted message is recorded in the audit log
+func handleORU(msg *hl7.Message, remoteAddr net.Addr) hl7.Ack {
+	host := remoteHost(remoteAddr)
+	msh := msg.Segment("MSH")
+	logger := log.WithFields(log.Fields{"control_id": msg.ControlID(), "remote_addr": host})
+	if !hl7SenderAllowed(host, msh.Component(4, 1)) {
+		logger.WithField("facility", msh.Component(4, 1)).Warn("Rejecting HL7 message from a sender not in hl7_senders")
+		return hl7.Ack{Code: hl7.AcceptReject, Text: "Sender not allowed",
+			Errors: []hl7.Error{{Code: hl7.ErrApplicationInternal, Message: "Sender not allowed"}}}
+	}
+	results, errs := models.LabXpertResultsFromORU(msg)
+	for i := range results {
+		if err := binding.Validator.ValidateStruct(&results[i].LabXpertResult); err != nil {
+			errs = append(errs, results[i].Errors(models.FormatValidationError(err))...)
+		}
+	}
+	if len(errs) > 0 {
+		logger.WithField("errors", errs).Warn("Rejecting invalid HL7 results")
+		code := hl7.AcceptError
+		if errs[0].Code == hl7.ErrUnsupportedMessage || errs[0].Code == hl7.ErrUnsupportedEvent {
+			code = hl7.AcceptReject
+		}
+		return hl7.Ack{Code: code, Text: "Invalid results", Errors: errs}
+	}
+
+	var submissionIDs, taskIDs, patientIDs []string
+	for i, result := range results {
+		// the task id is derived from the sender and message control id, so that the results of messages sent
+		// again, e.g. after a lost ACK, are not queued twice
+		taskID := fmt.Sprintf("%s:hl7:%s:%s:%s:%d",
+			tasks.TypeSendResults, msh.Component(3, 1), msh.Component(4, 1), msg.ControlID(), i)
+		submission, err := queueLabResult(taskID, result.LabXpertResult)
+		if err != nil {
+			logger.WithError(err).WithField("patient_id", result.PatientID).Error("Failed to queue HL7 results")
+			return hl7.Ack{Code: hl7.AcceptReject, Text: "Failed to queue results for saving to DHIS2",
+				Errors: []hl7.Error{{Code: hl7.ErrApplicationInternal, Message: "Failed to queue results"}}}
+		}
+		submissionIDs = append(submissionIDs, submission.ID)
+		taskIDs = append(taskIDs, submission.TaskID)
+		patientIDs = append(patientIDs, result.PatientID)
+	}
+	entry := &models.AuditLog{
+		AuthMethod: "mllp",
+		Method:     "MLLP",
+		Route:      "ORU^R01",
+		Path:       msh.Component(3, 1) + "^" + msh.Component(4, 1) + "^" + msg.ControlID(),
+		ClientIP:   host,
+		PatientIDs: patientIDs,
+		Status:     http.StatusOK,
+		TaskIDs:    taskIDs,
+	}
+	if err := entry.Save(); err != nil {
+		logger.WithError(err).Error("Failed to save audit log")
+	}
+	return hl7.Ack{Code: hl7.AcceptAccept,
+		Text: "results queued for saving to DHIS2 with submission_id " + strings.Join(submissionIDs, ", ")}
+}
+
+// hl7SenderAllowed reports whether an entry of hl7_senders has the address of host, and either has no facility or
+// the sending facility of the message
+func hl7SenderAllowed(host, facility string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, sender := range config.RTCGwConf.Server.HL7Senders {
+		if sender.Facility != "" && !strings.EqualFold(sender.Facility, facility) {
+			continue
+		}
+		cidr, err := models.NormalizeCIDR(sender.Address)
+		if err != nil {
+			continue
+		}
+		if _, network, err := net.ParseCIDR(cidr); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteHost returns the IP address of a remote address without its port
+func remoteHost(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,104 @@
+package hl7
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Acknowledgment codes of MSA-1
+const (
+	AcceptAccept     = "AA" // the message was accepted
+	AcceptError      = "AE" // the message has errors and should not be sent again unchanged
+	AcceptReject     = "AR" // the message was rejected and may be sent again later
+	ackApplication   = "RTCGW"
+	ackSeverityError = "E"
+)
+
+// Error codes of HL7 table 0357, given in the ERR segments of negative acknowledgments
+const (
+	ErrSegmentSequence      = 100
+	ErrRequiredFieldMissing = 101
+	ErrDataType             = 102
+	ErrTableValueNotFound   = 103
+	ErrUnsupportedMessage   = 200
+	ErrUnsupportedEvent     = 201
+	ErrApplicationInternal  = 207
+)
+
+var errorTexts = map[int]string{
+	ErrSegmentSequence:      "Segment sequence error",
+	ErrRequiredFieldMissing: "Required field missing",
+	ErrDataType:             "Data type error",
+	ErrTableValueNotFound:   "Table value not found",
+	ErrUnsupportedMessage:   "Unsupported message type",
+	ErrUnsupportedEvent:     "Unsupported event code",
+	ErrApplicationInternal:  "Application internal error",
+}
+
+// Error is an error in a message, reported in an ERR segment. Segment, Sequence and Field give its location
+// e.g. PID, 1 and 3 for the patient identifier list of the first PID segment
+type Error struct {
+	Segment  string
+	Sequence int
+	Field    int
+	Code     int
+	Message  string
+}
+
+func (e Error) Error() string {
+	if e.Segment == "" {
+		return e.Message
+	}
+	return fmt.Sprintf("%s-%d: %s", e.Segment, e.Field, e.Message)
+}
+
+// Ack is how a handler acknowledges a message
+type Ack struct {
+	Code   string
+	Text   string
+	Errors []Error
+}
+
+var ackCounter atomic.Uint64
+
+// NewACK returns the ACK message acknowledging msg. msg may be nil if the received message could not be parsed
+func NewACK(msg *Message, ack Ack) string {
+	d := DefaultDelimiters
+	var msh *Segment
+	if msg != nil {
+		msh = msg.Segment("MSH")
+	}
+	field := func(n int, fallback string) string {
+		if msh == nil || msh.Field(n) == "" {
+			return fallback
+		}
+		return d.Escape(msh.Value(n))
+	}
+
+	now := time.Now()
+	controlID := fmt.Sprintf("%s%04d", now.Format("20060102150405"), ackCounter.Add(1)%10000)
+	trigger := ""
+	if msh != nil {
+		trigger = d.Escape(msh.Component(9, 2))
+	}
+	sep := string(d.Field)
+	segments := []string{
+		strings.Join([]string{"MSH", string([]byte{d.Component, d.Repetition, d.EscapeChar, d.Subcomponent}),
+			field(5, ackApplication), field(6, ""), field(3, ""), field(4, ""),
+			now.Format("20060102150405-0700"), "", "ACK" + string(d.Component) + trigger + string(d.Component) + "ACK",
+			controlID, field(11, "P"), field(12, "2.5.1")}, sep),
+		strings.Join([]string{"MSA", ack.Code, field(10, ""), d.Escape(ack.Text)}, sep),
+	}
+	for _, e := range ack.Errors {
+		location := ""
+		if e.Segment != "" {
+			location = strings.Join([]string{e.Segment, fmt.Sprint(e.Sequence), fmt.Sprint(e.Field)}, string(d.Component))
+		}
+		code := strings.Join([]string{fmt.Sprint(e.Code), errorTexts[e.Code], "HL70357"}, string(d.Component))
+		segments = append(segments, strings.Join(
+			[]string{"ERR", "", location, code, ackSeverityError, "", "", "", d.Escape(e.Message)}, sep))
+	}
+	return strings.Join(segments, "\r") + "\r"
+}
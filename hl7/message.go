@@ -0,0 +1,222 @@
+// Package hl7 parses HL7 v2 messages and serves them over MLLP, acknowledging each message with an ACK
+package hl7
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Delimiters are the separators and escape character of a message, given by MSH-1 and MSH-2
+type Delimiters struct {
+	Field        byte
+	Component    byte
+	Repetition   byte
+	EscapeChar   byte
+	Subcomponent byte
+}
+
+// DefaultDelimiters are the recommended delimiters |^~\&, which are used for the ACKs sent by the server
+var DefaultDelimiters = Delimiters{Field: '|', Component: '^', Repetition: '~', EscapeChar: '\\', Subcomponent: '&'}
+
+// Segment is a segment of a message. Fields are numbered as in the HL7 standard, so for MSH, Field(1) is the
+// field separator and Field(2) the encoding characters
+type Segment struct {
+	Name       string
+	Sequence   int // the occurrence of the segment among the segments with the same name, starting at 1
+	fields     []string
+	delimiters Delimiters
+}
+
+// Message is a parsed HL7 v2 message
+type Message struct {
+	Segments   []*Segment
+	Delimiters Delimiters
+}
+
+// Parse parses an HL7 v2 message whose segments are separated by carriage returns or newlines
+func Parse(data string) (*Message, error) {
+	data = strings.TrimLeft(data, "\r\n")
+	if !strings.HasPrefix(data, "MSH") || len(data) < 8 {
+		return nil, errors.New("message does not start with an MSH segment")
+	}
+	d := Delimiters{Field: data[3], Component: data[4], Repetition: data[5], EscapeChar: data[6], Subcomponent: data[7]}
+	if d.Subcomponent == d.Field {
+		// MSH-2 may leave out the subcomponent separator
+		d.Subcomponent = DefaultDelimiters.Subcomponent
+	}
+
+	msg := &Message{Delimiters: d}
+	counts := make(map[string]int)
+	for _, line := range strings.FieldsFunc(data, func(r rune) bool { return r == '\r' || r == '\n' }) {
+		fields := strings.Split(line, string(d.Field))
+		name := fields[0]
+		if len(name) != 3 {
+			return nil, fmt.Errorf("invalid segment %q", truncate(line, 20))
+		}
+		if name == "MSH" {
+			// MSH-1 is the field separator itself
+			fields = append([]string{name, string(d.Field)}, fields[1:]...)
+		}
+		counts[name]++
+		msg.Segments = append(msg.Segments, &Segment{Name: name, Sequence: counts[name], fields: fields, delimiters: d})
+	}
+	return msg, nil
+}
+
+// Segment returns the first segment with the given name, nil if there is none
+func (m *Message) Segment(name string) *Segment {
+	for _, s := range m.Segments {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// Type returns the message code and trigger event of MSH-9, e.g. ORU and R01
+func (m *Message) Type() (string, string) {
+	msh := m.Segment("MSH")
+	if msh == nil {
+		return "", ""
+	}
+	return msh.Component(9, 1), msh.Component(9, 2)
+}
+
+// ControlID returns the message control id of MSH-10, which the ACK of the message refers to
+func (m *Message) ControlID() string {
+	if msh := m.Segment("MSH"); msh != nil {
+		return msh.Field(10)
+	}
+	return ""
+}
+
+// Field returns the raw value of field n, including any repetitions, components and escape sequences
+func (s *Segment) Field(n int) string {
+	if n < 0 || n >= len(s.fields) {
+		return ""
+	}
+	return s.fields[n]
+}
+
+// Repetitions returns the repetitions of field n
+func (s *Segment) Repetitions(n int) []string {
+	field := s.Field(n)
+	if field == "" || (s.Name == "MSH" && n <= 2) {
+		return []string{field}
+	}
+	return strings.Split(field, string(s.delimiters.Repetition))
+}
+
+// Component returns the unescaped component c of the first repetition of field n
+func (s *Segment) Component(n, c int) string {
+	return s.RepetitionComponent(s.Repetitions(n)[0], c)
+}
+
+// RepetitionComponent returns the unescaped component c of a repetition of one of the segment's fields
+func (s *Segment) RepetitionComponent(repetition string, c int) string {
+	components := strings.Split(repetition, string(s.delimiters.Component))
+	if c < 1 || c > len(components) {
+		return ""
+	}
+	return s.delimiters.Unescape(components[c-1])
+}
+
+// Value returns the unescaped first repetition of field n with its components
+func (s *Segment) Value(n int) string {
+	return s.delimiters.Unescape(s.Repetitions(n)[0])
+}
+
+// Unescape replaces the escape sequences of the delimiters in value with the delimiters. Formatting and other
+// escape sequences are dropped
+func (d Delimiters) Unescape(value string) string {
+	if strings.IndexByte(value, d.EscapeChar) < 0 {
+		return value
+	}
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != d.EscapeChar {
+			b.WriteByte(value[i])
+			continue
+		}
+		end := strings.IndexByte(value[i+1:], d.EscapeChar)
+		if end < 0 {
+			b.WriteString(value[i:])
+			break
+		}
+		switch value[i+1 : i+1+end] {
+		case "F":
+			b.WriteByte(d.Field)
+		case "S":
+			b.WriteByte(d.Component)
+		case "R":
+			b.WriteByte(d.Repetition)
+		case "E":
+			b.WriteByte(d.EscapeChar)
+		case "T":
+			b.WriteByte(d.Subcomponent)
+		}
+		i += end + 1
+	}
+	return b.String()
+}
+
+// Escape replaces the delimiters in value with their escape sequences
+func (d Delimiters) Escape(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case d.EscapeChar:
+			b.WriteString(string(d.EscapeChar) + "E" + string(d.EscapeChar))
+		case d.Field:
+			b.WriteString(string(d.EscapeChar) + "F" + string(d.EscapeChar))
+		case d.Component:
+			b.WriteString(string(d.EscapeChar) + "S" + string(d.EscapeChar))
+		case d.Repetition:
+			b.WriteString(string(d.EscapeChar) + "R" + string(d.EscapeChar))
+		case d.Subcomponent:
+			b.WriteString(string(d.EscapeChar) + "T" + string(d.EscapeChar))
+		case '\r', '\n':
+			b.WriteByte(' ')
+		default:
+			b.WriteByte(value[i])
+		}
+	}
+	return b.String()
+}
+
+// timeLayouts are the layouts of the HL7 DTM data type by precision, without the fraction of a second
+var timeLayouts = map[int]string{
+	4: "2006", 6: "200601", 8: "20060102", 10: "2006010215", 12: "200601021504", 14: "20060102150405",
+}
+
+// ParseTime parses an HL7 date/time, YYYY[MM[DD[HH[MM[SS[.S[S[S[S]]]]]]]]][+/-ZZZZ], in loc unless it has a
+// time zone offset. dateOnly is true if it has no time of day
+func ParseTime(value string, loc *time.Location) (t time.Time, dateOnly bool, err error) {
+	value = strings.TrimSpace(value)
+	zone := ""
+	if i := strings.IndexAny(value, "+-"); i >= 0 {
+		value, zone = value[:i], value[i:]
+	}
+	if i := strings.IndexByte(value, '.'); i >= 0 {
+		value = value[:i]
+	}
+	layout, ok := timeLayouts[len(value)]
+	if !ok {
+		return time.Time{}, false, fmt.Errorf("invalid HL7 date/time %q", value+zone)
+	}
+	if zone != "" {
+		t, err = time.Parse(layout+"-0700", value+zone)
+	} else {
+		t, err = time.ParseInLocation(layout, value, loc)
+	}
+	return t, len(value) <= 8, err
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n] + "..."
+	}
+	return s
+}
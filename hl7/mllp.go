@@ -0,0 +1,201 @@
+package hl7
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// MLLP framing bytes. A message is sent as <VT> message <FS><CR>
+const (
+	startBlock     = 0x0b
+	endBlock       = 0x1c
+	carriageReturn = 0x0d
+)
+
+// ErrMessageTooLarge is returned when a message exceeds the server's MaxMessageSize
+var ErrMessageTooLarge = errors.New("message exceeds the maximum message size")
+
+// Handler processes a parsed message received from remoteAddr and returns its acknowledgment
+type Handler func(msg *Message, remoteAddr net.Addr) Ack
+
+// Server receives HL7 v2 messages over MLLP connections and replies to each with the ACK returned by its Handler.
+// Messages that cannot be parsed are rejected with an AR ACK
+type Server struct {
+	Addr           string
+	Handler        Handler
+	ReadTimeout    time.Duration // closes connections idle for longer, if set
+	MaxMessageSize int           // defaults to 1MB
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+}
+
+// ListenAndServe listens on the server's TCP address and serves connections until the server is closed
+func (s *Server) ListenAndServe() error {
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l, serving each in its own goroutine, until the server is closed
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return net.ErrClosed
+	}
+	s.listener = l
+	s.conns = make(map[net.Conn]struct{})
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops the server, closing its listener and open connections
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	if s.listener != nil {
+		return s.listener.Close()
+	}
+	return nil
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() {
+		_ = conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+	logger := log.WithField("remote_addr", conn.RemoteAddr().String())
+	reader := bufio.NewReader(conn)
+	for {
+		if s.ReadTimeout > 0 {
+			_ = conn.SetReadDeadline(time.Now().Add(s.ReadTimeout))
+		}
+		frame, err := ReadFrame(reader, s.maxMessageSize())
+		if err != nil {
+			if errors.Is(err, ErrMessageTooLarge) {
+				logger.WithError(err).Warn("Rejecting HL7 message")
+				_ = WriteFrame(conn, NewACK(nil, Ack{Code: AcceptReject, Text: err.Error()}))
+			} else if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				logger.WithError(err).Warn("Closing HL7 connection")
+			}
+			return
+		}
+
+		ack := s.handle(frame, conn.RemoteAddr(), logger)
+		_ = conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+		if err := WriteFrame(conn, ack); err != nil {
+			logger.WithError(err).Warn("Failed to send HL7 ACK")
+			return
+		}
+	}
+}
+
+func (s *Server) handle(frame string, remoteAddr net.Addr, logger *log.Entry) (ack string) {
+	msg, err := Parse(frame)
+	if err != nil {
+		logger.WithError(err).Warn("Rejecting unparseable HL7 message")
+		return NewACK(nil, Ack{Code: AcceptReject, Text: err.Error(),
+			Errors: []Error{{Code: ErrSegmentSequence, Message: err.Error()}}})
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			logger.WithField("control_id", msg.ControlID()).Errorf("HL7 handler panicked: %v", r)
+			ack = NewACK(msg, Ack{Code: AcceptReject, Text: "Failed to process message",
+				Errors: []Error{{Code: ErrApplicationInternal, Message: "Failed to process message"}}})
+		}
+	}()
+	return NewACK(msg, s.Handler(msg, remoteAddr))
+}
+
+func (s *Server) maxMessageSize() int {
+	if s.MaxMessageSize > 0 {
+		return s.MaxMessageSize
+	}
+	return 1 << 20
+}
+
+// ReadFrame reads the next MLLP framed message, skipping any bytes before its start block
+func ReadFrame(r *bufio.Reader, maxSize int) (string, error) {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b == startBlock {
+			break
+		}
+	}
+	var frame []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return "", io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		if b == endBlock {
+			if next, err := r.ReadByte(); err != nil || next != carriageReturn {
+				return "", fmt.Errorf("end block not followed by a carriage return")
+			}
+			return string(frame), nil
+		}
+		if b == startBlock {
+			// the sender gave up on the previous message
+			frame = frame[:0]
+			continue
+		}
+		if len(frame) >= maxSize {
+			return "", ErrMessageTooLarge
+		}
+		frame = append(frame, b)
+	}
+}
+
+// WriteFrame writes msg as an MLLP frame
+func WriteFrame(w io.Writer, msg string) error {
+	frame := make([]byte, 0, len(msg)+3)
+	frame = append(frame, startBlock)
+	frame = append(frame, msg...)
+	frame = append(frame, endBlock, carriageReturn)
+	_, err := w.Write(frame)
+	return err
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"rtcgw/models"
+)
+
+// IdempotencyKeyHeader identifies the retries of a submission
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// responseRecorder keeps a copy of the response body written by the handlers
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *responseRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// Idempotent replays the original response to a submission repeated within the retention window instead of
+// processing it again. Submissions are identified by their Idempotency-Key header, or the hash of the request
+func Idempotent() gin.HandlerFunc {
+	return idempotent(false)
+}
+
+// IdempotentByKey is Idempotent for submissions that may be legitimately repeated with the same body, such as
+// updates setting a field back to an earlier value. Only submissions with an Idempotency-Key header are replayed
+func IdempotentByKey() gin.HandlerFunc {
+	return idempotent(true)
+}
+
+func idempotent(requireKey bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(IdempotencyKeyHeader)
+		if len(key) > 255 {
+			RespondWithError(http.StatusBadRequest, IdempotencyKeyHeader+" should not exceed 255 characters", c)
+			return
+		}
+		if key == "" && requireKey {
+			c.Next()
+			return
+		}
+		userID := c.GetInt64("currentUser")
+		route := c.FullPath()
+		requestHash := models.RequestHash(c.Request.Method, c.Request.URL.Path, readBody(c))
+		if key == "" {
+			key = requestHash
+		}
+
+		stored, err := models.GetIdempotentRequest(userID, route, key)
+		if err != nil {
+			log.WithError(err).Error("Failed to get stored response for submission")
+		}
+		if stored != nil {
+			if stored.RequestHash != requestHash {
+				RespondWithError(http.StatusUnprocessableEntity,
+					IdempotencyKeyHeader+" was already used for a different submission", c)
+				return
+			}
+			c.Header("Idempotent-Replayed", "true")
+			c.Data(stored.Status, gin.MIMEJSON+"; charset=utf-8", []byte(stored.ResponseBody))
+			c.Abort()
+			return
+		}
+
+		// tasks get ids derived from the key so that concurrent retries are only queued once
+		c.Set("idempotencyKey", models.HashToken(fmt.Sprintf("%d:%s:%s", userID, route, key)))
+		recorder := &responseRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+		c.Next()
+
+		if status := c.Writer.Status(); status >= 200 && status < 300 {
+			request := models.IdempotentRequest{
+				UserID:         userID,
+				Route:          route,
+				IdempotencyKey: key,
+				RequestHash:    requestHash,
+				Status:         status,
+				ResponseBody:   recorder.body.String(),
+			}
+			if err := request.Save(); err != nil {
+				log.WithError(err).Error("Failed to store response for submission")
+			}
+		}
+	}
+}
@@ -41,6 +41,7 @@ var splash = `
 `
 
 var client *asynq.Client
+var inspector *asynq.Inspector
 
 func main() {
 	fmt.Printf(splash)
@@ -49,24 +50,30 @@ func main() {
 	defer func(client *asynq.Client) {
 		_ = client.Close()
 	}(client)
+	inspector = asynq.NewInspector(asynq.RedisClientOpt{Addr: config.RTCGwConf.Server.RedisAddress})
+	defer func(inspector *asynq.Inspector) {
+		_ = inspector.Close()
+	}(inspector)
+
+	registerValidations()
 
 	wg.Add(1)
 	go startAPIServer(&wg)
+	if config.RTCGwConf.Server.HL7Port != "" {
+		wg.Add(1)
+		go startHL7Listener(&wg)
+	}
+	if config.RTCGwConf.Server.ASTMPort != "" {
+		wg.Add(1)
+		go startASTMServer(&wg)
+	}
 
 	wg.Wait()
 }
 
-// WebSocket upgrader
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow all origins (adjust for production)
-	},
-}
-
-func startAPIServer(wg *sync.WaitGroup) {
-	defer wg.Done()
-	router := gin.Default()
-
+// registerValidations registers the custom validations of requests, which are also used to validate results
+// received over HL7 and ASTM
+func registerValidations() {
 	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
 		v.RegisterTagNameFunc(func(fld reflect.StructField) string {
 			name := strings.SplitN(fld.Tag.Get("json"), ",", 2)[0]
@@ -79,6 +86,27 @@ func startAPIServer(wg *sync.WaitGroup) {
 		v.RegisterValidation("dhis2UID", utils.Dhis2UIDValidation)
 		v.RegisterValidation("yesNo", utils.YesNoValidation)
 		v.RegisterValidation("maleFemale", utils.MaleFemaleValidation)
+		v.RegisterValidation("mtbResult", utils.MTBValidation)
+		v.RegisterValidation("rrResult", utils.RRValidation)
+		v.RegisterValidation("resultDate", utils.ResultDateValidation)
+		v.RegisterStructValidation(models.LabXpertResultValidation, models.LabXpertResult{})
+		v.RegisterStructValidation(models.ECHISRequestValidation, models.ECHISRequest{})
+	}
+	for _, problem := range models.CheckECHISSchema() {
+		log.Warnf("echis_schema: %s", problem)
+	}
+}
+
+// WebSocket upgrader. Only pages served by the gateway may connect, as browsers send the credentials of the user
+// with the WebSocket handshake
+var upgrader = websocket.Upgrader{}
+
+func startAPIServer(wg *sync.WaitGroup) {
+	defer wg.Done()
+	router := gin.Default()
+	// The client IP is only taken from X-Forwarded-For or X-Real-IP on requests from trusted proxies
+	if err := router.SetTrustedProxies(config.RTCGwConf.Server.TrustedProxies); err != nil {
+		log.Fatalf("Invalid trusted_proxies: %v", err)
 	}
 
 	// Define template functions
@@ -101,10 +129,16 @@ func startAPIServer(wg *sync.WaitGroup) {
 			"title": "API Documentation",
 		})
 	})
-	router.GET("/stats", func(c *gin.Context) {
+	router.GET("/upload", func(c *gin.Context) {
+		c.HTML(http.StatusOK, "upload.html", gin.H{"title": "Upload Results"})
+	})
+
+	// the stats page and its WebSocket require read permission on the Stats module
+	statsGroup := router.Group("/", BasicAuthChallenge(), BasicAuth(), RequirePermission(models.ModuleStats, models.PermRead))
+	statsGroup.GET("/stats", func(c *gin.Context) {
 		c.HTML(http.StatusOK, "stats.html", gin.H{"title": "Stats"})
 	})
-	router.GET("/ws", func(c *gin.Context) {
+	statsGroup.GET("/ws", func(c *gin.Context) {
 		conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 		if err != nil {
 			log.Println("WebSocket upgrade error:", err)
@@ -169,28 +203,103 @@ func startAPIServer(wg *sync.WaitGroup) {
 		})
 	})
 
-	v2 := router.Group("/api", BasicAuth())
+	fhirController := &controllers.FHIRController{}
+	fhirGroup := router.Group("/fhir", BasicAuth(), AuditLog())
+	{
+		fhirGroup.POST("", fhirController.ProcessBundle)
+		fhirGroup.POST("/Bundle", fhirController.ProcessBundle)
+		fhirGroup.POST("/Patient", RequirePermission(models.ModuleClients, models.PermAdd), Idempotent(), TransactionQuota(), fhirController.CreatePatient)
+		fhirGroup.POST("/Observation", RequirePermission(models.ModuleResults, models.PermAdd), Idempotent(), TransactionQuota(), fhirController.CreateObservation)
+	}
+
+	v2 := router.Group("/api", BasicAuth(), AuditLog())
 	{
 		v2.GET("/test2", func(c *gin.Context) {
 			c.String(200, "Authorized")
 		})
 		r := new(controllers.ResultsController)
-		v2.POST("/results", r.Start)
+		v2.POST("/results", RequirePermission(models.ModuleResults, models.PermAdd), Idempotent(), TransactionQuota(), r.Start)
+		v2.POST("/results/upload", RequirePermission(models.ModuleResults, models.PermAdd), r.Upload)
+		v2.GET("/results/uploads/:id", r.GetUpload)
+		v2.GET("/results/uploads/:id/report.csv", r.GetUploadReport)
 
 		e := new(controllers.ClientsController)
-		v2.POST("/clients", e.Start)
+		v2.POST("/clients", RequirePermission(models.ModuleClients, models.PermAdd), Idempotent(), TransactionQuota(), e.Start)
+		v2.POST("/clients/batch", RequirePermission(models.ModuleClients, models.PermAdd), e.StartBatch)
+		v2.POST("/clients/merge", RequirePermission(models.ModuleClients, models.PermDelete), e.Merge)
+		v2.GET("/clients/merges", RequirePermission(models.ModuleClients, models.PermRead), e.ListMerges)
+		v2.GET("/clients/:echis_id", RequirePermission(models.ModuleClients, models.PermRead), e.GetClient)
+		v2.PATCH("/clients/:echis_id", RequirePermission(models.ModuleClients, models.PermModify), IdempotentByKey(), TransactionQuota(), e.Update)
+
+		missingClientsController := &controllers.MissingClientsController{}
+		v2.GET("/missing_clients", RequirePermission(models.ModuleClients, models.PermRead), missingClientsController.ListMissingClients)
+		v2.POST("/missing_clients/backfill", RequirePermission(models.ModuleClients, models.PermModify), missingClientsController.BackfillMissingClients)
+		v2.POST("/missing_clients/:id/backfill", RequirePermission(models.ModuleClients, models.PermModify), missingClientsController.BackfillMissingClient)
+
+		submissionsController := &controllers.SubmissionsController{}
+		v2.GET("/submissions/:id", submissionsController.GetSubmission)
 
 		userController := &controllers.UserController{}
-		v2.GET("/users/:uid", userController.GetUserByUID)
-		v2.PUT("/users/:uid", userController.UpdateUser)
-		v2.POST("/users/getToken", userController.CreateUserToken)
-		v2.POST("/users/refreshToken", userController.RefreshUserToken)
+		v2.GET("/users", RequirePermission(models.ModuleUsers, models.PermRead), userController.ListUsers)
+		v2.POST("/users", RequirePermission(models.ModuleUsers, models.PermAdd), userController.CreateUser)
+		v2.GET("/users/:uid", RequirePermission(models.ModuleUsers, models.PermRead), userController.GetUserByUID)
+		v2.PUT("/users/:uid", RequirePermission(models.ModuleUsers, models.PermModify), userController.UpdateUser)
+		v2.DELETE("/users/:uid", RequirePermission(models.ModuleUsers, models.PermDelete), userController.DeleteUser)
+		v2.POST("/users/:uid/activate", RequirePermission(models.ModuleUsers, models.PermModify), userController.ActivateUser)
+		v2.PUT("/users/:uid/role", RequirePermission(models.ModuleUsers, models.PermModify), userController.AssignRole)
+		v2.DELETE("/users/:uid/lockout", RequirePermission(models.ModuleUsers, models.PermModify), userController.ClearUserLockout)
+		v2.GET("/users/:uid/usage", RequirePermission(models.ModuleUsers, models.PermRead), userController.GetUsage)
+		v2.PUT("/users/:uid/quota", RequirePermission(models.ModuleUsers, models.PermModify), userController.SetQuota)
+		v2.POST("/users/:uid/onetime_password", RequirePermission(models.ModuleUsers, models.PermModify), userController.IssueOnetimePassword)
+		v2.GET("/users/:uid/allowed_ips", RequirePermission(models.ModuleUsers, models.PermRead), userController.ListAllowedIPs)
+		v2.POST("/users/:uid/allowed_ips", RequirePermission(models.ModuleUsers, models.PermModify), userController.AddAllowedIP)
+		v2.DELETE("/users/:uid/allowed_ips/:id", RequirePermission(models.ModuleUsers, models.PermModify), userController.DeleteAllowedIP)
+		v2.PUT("/users/:uid/certificate", RequirePermission(models.ModuleUsers, models.PermModify), userController.SetCertificate)
+		v2.GET("/users/:uid/hmac_keys", RequirePermission(models.ModuleUsers, models.PermRead), userController.ListHMACKeys)
+		v2.POST("/users/:uid/hmac_keys", RequirePermission(models.ModuleUsers, models.PermAdd), userController.CreateHMACKey)
+		v2.DELETE("/users/:uid/hmac_keys/:key_id", RequirePermission(models.ModuleUsers, models.PermDelete), userController.RevokeHMACKey)
+		v2.GET("/usage", RequirePermission(models.ModuleUsers, models.PermRead), userController.ListUsage)
+		auditController := &controllers.AuditController{}
+		v2.GET("/audit", RequirePermission(models.ModuleAudit, models.PermRead), auditController.ListAuditLogs)
+		v2.GET("/lockouts", RequirePermission(models.ModuleUsers, models.PermRead), userController.ListLockouts)
+		v2.DELETE("/lockouts/ips/:ip", RequirePermission(models.ModuleUsers, models.PermModify), userController.ClearIPLockout)
+		v2.POST("/users/getToken", RequirePermission(models.ModuleTokens, models.PermAdd), userController.CreateUserToken)
+		v2.POST("/users/refreshToken", RequirePermission(models.ModuleTokens, models.PermModify), userController.RefreshUserToken)
+		v2.POST("/users/me/password", userController.ChangePassword)
+		v2.GET("/users/me/tokens", RequirePermission(models.ModuleTokens, models.PermRead), userController.ListTokens)
+		v2.POST("/users/me/tokens", RequirePermission(models.ModuleTokens, models.PermAdd), userController.CreateToken)
+		v2.DELETE("/users/me/tokens/:id", RequirePermission(models.ModuleTokens, models.PermDelete), userController.RevokeToken)
+
+		rolesController := &controllers.RolesController{}
+		v2.GET("/roles", RequirePermission(models.ModuleUsers, models.PermRead), rolesController.ListRoles)
+		v2.POST("/roles", RequirePermission(models.ModuleUsers, models.PermAdd), rolesController.CreateRole)
+		v2.GET("/roles/:id", RequirePermission(models.ModuleUsers, models.PermRead), rolesController.GetRole)
+		v2.POST("/roles/:id/permissions", RequirePermission(models.ModuleUsers, models.PermModify), rolesController.GrantPermission)
+		v2.DELETE("/roles/:id/permissions/:module", RequirePermission(models.ModuleUsers, models.PermModify), rolesController.RevokePermission)
 	}
 	// Handle error response when a route is not defined
 	router.NoRoute(func(c *gin.Context) {
 		c.String(404, "Page Not Found!")
 	})
 
+	if tlsEnabled() {
+		tlsConfig, err := newTLSConfig()
+		if err != nil {
+			log.Fatalf("Could not configure TLS: %v", err)
+		}
+		server := &http.Server{
+			Addr:      ":" + config.RTCGwConf.Server.Port,
+			Handler:   router,
+			TLSConfig: tlsConfig,
+		}
+		log.Infof("Serving HTTPS on %s", server.Addr)
+		if err := server.ListenAndServeTLS(
+			config.RTCGwConf.Server.TLSCertFile, config.RTCGwConf.Server.TLSKeyFile); err != nil {
+			log.Fatalf("Could not start GIN server: %v", err)
+		}
+		return
+	}
+
 	if err := router.Run(":" + fmt.Sprintf("%s", config.RTCGwConf.Server.Port)); err != nil {
 		log.Fatalf("Could not start GIN server: %v", err)
 	}
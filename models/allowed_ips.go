@@ -0,0 +1,74 @@
+package models
+
+import (
+	"fmt"
+	"net"
+	"rtcgw/db"
+	"time"
+)
+
+// AllowedIP is a CIDR range from which a user may authenticate
+type AllowedIP struct {
+	ID          int64      `db:"id" json:"id"`
+	UserID      int64      `db:"user_id" json:"-"`
+	CIDR        string     `db:"cidr" json:"cidr"`
+	Description string     `db:"description" json:"description"`
+	Created     *time.Time `db:"created" json:"created"`
+}
+
+// NormalizeCIDR validates a CIDR range, turning a single IP address into a /32 or /128 range
+func NormalizeCIDR(cidr string) (string, error) {
+	if ip := net.ParseIP(cidr); ip != nil {
+		if ip.To4() != nil {
+			return ip.String() + "/32", nil
+		}
+		return ip.String() + "/128", nil
+	}
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return "", fmt.Errorf("invalid CIDR range %s", cidr)
+	}
+	return network.String(), nil
+}
+
+// Save adds the range to the user's allowlist
+func (a *AllowedIP) Save() error {
+	return db.GetDB().QueryRowx(`INSERT INTO user_allowed_ips (user_id, cidr, description)
+		VALUES ($1, $2, $3) RETURNING id, created`, a.UserID, a.CIDR, a.Description).Scan(&a.ID, &a.Created)
+}
+
+// Delete removes the range from the user's allowlist
+func (a *AllowedIP) Delete() error {
+	_, err := db.GetDB().Exec(`DELETE FROM user_allowed_ips WHERE id = $1`, a.ID)
+	return err
+}
+
+// GetUserAllowedIPs returns the allowlist of the user identified by userID
+func GetUserAllowedIPs(userID int64) ([]AllowedIP, error) {
+	allowed := []AllowedIP{}
+	err := db.GetDB().Select(&allowed, `SELECT id, user_id, cidr, description, created
+		FROM user_allowed_ips WHERE user_id = $1 ORDER BY id`, userID)
+	return allowed, err
+}
+
+// GetUserAllowedIP returns the allowlist entry with the given id belonging to the user identified by userID
+func GetUserAllowedIP(userID, id int64) (*AllowedIP, error) {
+	allowed := AllowedIP{}
+	err := db.GetDB().Get(&allowed, `SELECT id, user_id, cidr, description, created
+		FROM user_allowed_ips WHERE user_id = $1 AND id = $2`, userID, id)
+	if err != nil {
+		return nil, err
+	}
+	return &allowed, nil
+}
+
+// IPAllowed returns true if the user has no allowlist or ip falls within one of its ranges
+func IPAllowed(userID int64, ip string) (bool, error) {
+	if net.ParseIP(ip) == nil {
+		return false, fmt.Errorf("invalid IP address %s", ip)
+	}
+	var allowed bool
+	err := db.GetDB().Get(&allowed, `SELECT NOT EXISTS (SELECT 1 FROM user_allowed_ips WHERE user_id = $1)
+		OR EXISTS (SELECT 1 FROM user_allowed_ips WHERE user_id = $1 AND cidr >>= $2::inet)`, userID, ip)
+	return allowed, err
+}
@@ -0,0 +1,28 @@
+package models
+
+import (
+	"rtcgw/astm"
+	"rtcgw/utils"
+	"time"
+)
+
+// LabXpertResultFromASTM maps a GeneXpert result received over ASTM onto a LabXpert result. Completion dates that
+// cannot be parsed are kept as they are to fail validation
+func LabXpertResultFromASTM(result astm.Result) LabXpertResult {
+	labXpertResult := LabXpertResult{
+		PatientID:  result.PatientID,
+		Lab:        result.Instrument,
+		MTB:        normalizeResult(result.MTB, utils.MTBResults),
+		RR:         normalizeResult(result.RR, utils.RRResults),
+		ResultDate: result.Completed,
+		FacilityID: result.FacilityID,
+	}
+	if t, dateOnly, err := astm.ParseTime(result.Completed, time.Local); err == nil {
+		if dateOnly {
+			labXpertResult.ResultDate = t.Format("2006-01-02")
+		} else {
+			labXpertResult.ResultDate = t.Format(time.RFC3339)
+		}
+	}
+	return labXpertResult
+}
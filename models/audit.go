@@ -0,0 +1,92 @@
+package models
+
+import (
+	"fmt"
+	"github.com/lib/pq"
+	"rtcgw/db"
+	"time"
+)
+
+// AuditLog records an authenticated API request
+type AuditLog struct {
+	ID          int64          `db:"id" json:"id"`
+	UserID      *int64         `db:"user_id" json:"-"`
+	Username    *string        `db:"username" json:"username"`
+	TokenID     *int64         `db:"token_id" json:"token_id"`
+	AuthMethod  string         `db:"auth_method" json:"auth_method"`
+	Method      string         `db:"method" json:"method"`
+	Route       string         `db:"route" json:"route"`
+	Path        string         `db:"path" json:"path"`
+	ClientIP    string         `db:"client_ip" json:"client_ip"`
+	PatientIDs  pq.StringArray `db:"patient_ids" json:"patient_ids"`
+	Status      int            `db:"status" json:"status"`
+	TaskIDs     pq.StringArray `db:"task_ids" json:"task_ids"`
+	RequestBody string         `db:"request_body" json:"request_body"`
+	Created     *time.Time     `db:"created" json:"created"`
+}
+
+// AuditFilter holds the optional filters used when querying the audit log
+type AuditFilter struct {
+	User      string // user uid or username
+	Route     string
+	PatientID string
+	From      *time.Time
+	To        *time.Time
+}
+
+// Save inserts the audit log entry
+func (a *AuditLog) Save() error {
+	if a.PatientIDs == nil {
+		a.PatientIDs = pq.StringArray{}
+	}
+	if a.TaskIDs == nil {
+		a.TaskIDs = pq.StringArray{}
+	}
+	return db.GetDB().QueryRowx(`INSERT INTO audit_log (user_id, token_id, auth_method, method, route, path,
+			client_ip, patient_ids, status, task_ids, request_body)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id, created`,
+		a.UserID, a.TokenID, a.AuthMethod, a.Method, a.Route, a.Path, a.ClientIP, a.PatientIDs, a.Status,
+		a.TaskIDs, a.RequestBody).Scan(&a.ID, &a.Created)
+}
+
+// GetAuditLogs returns a page of audit log entries matching filter, most recent first,
+// together with the total number of matching entries
+func GetAuditLogs(filter AuditFilter, page, pageSize int) ([]AuditLog, int64, error) {
+	where := "WHERE TRUE"
+	var args []interface{}
+	if filter.User != "" {
+		args = append(args, filter.User)
+		where += fmt.Sprintf(" AND (u.uid = $%[1]d OR u.username = $%[1]d)", len(args))
+	}
+	if filter.Route != "" {
+		args = append(args, filter.Route)
+		where += fmt.Sprintf(" AND (a.route = $%[1]d OR a.path = $%[1]d)", len(args))
+	}
+	if filter.PatientID != "" {
+		args = append(args, pq.StringArray{filter.PatientID})
+		where += fmt.Sprintf(" AND a.patient_ids @> $%d", len(args))
+	}
+	if filter.From != nil {
+		args = append(args, *filter.From)
+		where += fmt.Sprintf(" AND a.created >= $%d", len(args))
+	}
+	if filter.To != nil {
+		args = append(args, *filter.To)
+		where += fmt.Sprintf(" AND a.created < $%d", len(args))
+	}
+
+	dbConn := db.GetDB()
+	from := "FROM audit_log a LEFT JOIN users u ON u.id = a.user_id " + where
+	var total int64
+	if err := dbConn.Get(&total, "SELECT count(*) "+from, args...); err != nil {
+		return nil, 0, err
+	}
+	logs := []AuditLog{}
+	args = append(args, pageSize, (page-1)*pageSize)
+	err := dbConn.Select(&logs, fmt.Sprintf(`SELECT a.*, u.username %s
+		ORDER BY a.created DESC, a.id DESC LIMIT $%d OFFSET $%d`, from, len(args)-1, len(args)), args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	return logs, total, nil
+}
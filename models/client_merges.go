@@ -0,0 +1,335 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"rtcgw/clients"
+	"rtcgw/config"
+	"rtcgw/db"
+	"rtcgw/models/tracker"
+	"sort"
+	"time"
+)
+
+// Ways of marking the duplicate tracked entity of merged clients in DHIS2, set by dhis2_duplicate_marking
+const (
+	DuplicateMarkingInactive           = "inactive"
+	DuplicateMarkingPotentialDuplicate = "potential_duplicate"
+)
+
+// Statuses of a client merge
+const (
+	ClientMergeMerged = "merged"
+	ClientMergeFailed = "failed"
+)
+
+// ClientMerge is the history of a merge of a patient registered twice in eCHIS into the surviving patient
+type ClientMerge struct {
+	ID                     int64      `db:"id" json:"id"`
+	SurvivorECHISID        string     `db:"survivor_echis_id" json:"survivor_echis_id"`
+	DuplicateECHISID       string     `db:"duplicate_echis_id" json:"duplicate_echis_id"`
+	SurvivorTrackedEntity  string     `db:"survivor_tracked_entity" json:"survivor_tracked_entity"`
+	DuplicateTrackedEntity string     `db:"duplicate_tracked_entity" json:"duplicate_tracked_entity"`
+	MovedResults           bool       `db:"moved_results" json:"moved_results"`
+	LabEnrollment          string     `db:"lab_enrollment" json:"lab_enrollment,omitempty"`
+	LabEvent               string     `db:"lab_event" json:"lab_event,omitempty"`
+	DuplicateMarking       string     `db:"duplicate_marking" json:"duplicate_marking"`
+	Status                 string     `db:"status" json:"status"`
+	Error                  string     `db:"error" json:"error,omitempty"`
+	UserID                 *int64     `db:"user_id" json:"user_id"`
+	Created                *time.Time `db:"created" json:"created"`
+}
+
+// ErrClientMerged is returned when a patient to merge has been merged into another
+var ErrClientMerged = errors.New("client has already been merged into another")
+
+// MergeClients merges the patient duplicateECHISID into survivorECHISID. The duplicate's screening results are
+// copied to the survivor's screening event and their lab enrollment and event are created for the survivor, unless
+// the survivor has their own. The duplicate's tracked entity is then marked in DHIS2 as set by
+// dhis2_duplicate_marking, and the duplicate's echis id made to point to the survivor. The sync log rows of both
+// patients stay locked throughout, so that concurrent merges of either patient wait for the merge to finish and
+// then fail with ErrClientMerged. The merge is recorded in the history whether or not it succeeds.
+// A *ConflictError is returned if DHIS2 rejects a step of the merge
+func MergeClients(survivorECHISID, duplicateECHISID string, userID *int64) (*ClientMerge, error) {
+	tx, err := db.GetDB().Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+	survivor, duplicate, err := lockMergedClients(tx, survivorECHISID, duplicateECHISID)
+	if err != nil {
+		return nil, err
+	}
+
+	merge := &ClientMerge{
+		SurvivorECHISID:        survivor.ECHISID,
+		DuplicateECHISID:       duplicate.ECHISID,
+		SurvivorTrackedEntity:  survivor.TrackedEntity,
+		DuplicateTrackedEntity: duplicate.TrackedEntity,
+		DuplicateMarking:       config.RTCGwConf.API.DHIS2DuplicateMarking,
+		Status:                 ClientMergeMerged,
+		UserID:                 userID,
+	}
+	err = merge.merge(survivor, duplicate)
+	if err == nil {
+		err = merge.saveMerged(tx, survivor)
+	}
+	if err != nil {
+		// what was already created in DHIS2 is recorded for the survivor, so that merging again does not repeat it
+		merge.Status, merge.Error = ClientMergeFailed, err.Error()
+		saveErr := updateMergeSurvivor(tx, survivor)
+		if saveErr == nil {
+			saveErr = merge.insert(tx)
+		}
+		if saveErr == nil {
+			saveErr = tx.Commit()
+		}
+		if saveErr != nil {
+			return merge, fmt.Errorf("%w, and failed to record the merge: %v", err, saveErr)
+		}
+		return merge, err
+	}
+	return merge, tx.Commit()
+}
+
+// lockMergedClients returns the sync log rows of the patients to merge, locked until the transaction tx ends.
+// The rows are locked in the order of their echis ids, so that concurrent merges of the same patients do not
+// deadlock. ErrClientMerged is returned if either patient has been merged into another
+func lockMergedClients(tx *sqlx.Tx, survivorECHISID, duplicateECHISID string) (*SyncLog, *SyncLog, error) {
+	echisIDs := []string{survivorECHISID, duplicateECHISID}
+	sort.Strings(echisIDs)
+	syncLogs := make(map[string]*SyncLog)
+	for _, echisID := range echisIDs {
+		syncLog, err := lockSyncLogRow(tx, echisID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if syncLog == nil {
+			return nil, nil, fmt.Errorf("client %s not found", echisID)
+		}
+		if syncLog.MergedInto != "" {
+			return nil, nil, ErrClientMerged
+		}
+		syncLogs[echisID] = syncLog
+	}
+	return syncLogs[survivorECHISID], syncLogs[duplicateECHISID], nil
+}
+
+func (m *ClientMerge) merge(survivor, duplicate *SyncLog) error {
+	if m.DuplicateMarking != DuplicateMarkingInactive && m.DuplicateMarking != DuplicateMarkingPotentialDuplicate {
+		return fmt.Errorf("unknown dhis2_duplicate_marking %s", m.DuplicateMarking)
+	}
+	if duplicate.ResultsUpdated && !survivor.ResultsUpdated {
+		if err := moveScreeningResults(survivor, duplicate); err != nil {
+			return err
+		}
+		m.MovedResults = true
+	}
+	if duplicate.LabEnrollment != "" && survivor.LabEnrollment == "" {
+		enrollment, event, err := moveLabEnrollment(survivor, duplicate)
+		m.LabEnrollment, m.LabEvent = enrollment, event
+		if err != nil {
+			return err
+		}
+	}
+	if m.DuplicateMarking == DuplicateMarkingPotentialDuplicate {
+		return flagPotentialDuplicate(survivor.TrackedEntity, duplicate.TrackedEntity)
+	}
+	return deactivateTrackedEntity(duplicate.TrackedEntity)
+}
+
+// moveScreeningResults copies the results data values of the duplicate's screening event to the survivor's
+func moveScreeningResults(survivor, duplicate *SyncLog) error {
+	event, err := fetchDHIS2Event(duplicate.EventID)
+	if err != nil {
+		return err
+	}
+	dataElements := config.RTCGwConf.API.DHIS2Mapping["data_elements"]
+	for _, name := range []string{"results", "results_date", "diagnosed"} {
+		for _, dv := range event.DataValues {
+			if dv.DataElement != dataElements[name] || dv.Value == "" {
+				continue
+			}
+			ep := tracker.EventUpdatePayload{
+				Event:         survivor.EventID,
+				Program:       config.RTCGwConf.API.DHIS2TrackerProgram,
+				OrgUnit:       survivor.OrgUnit,
+				Status:        "ACTIVE",
+				ProgramStage:  config.RTCGwConf.API.DHIS2TrackerProgramStage,
+				DataValues:    []tracker.DataValue{{DataElement: dv.DataElement, Value: dv.Value}},
+				TrackedEntity: survivor.TrackedEntity,
+			}
+			resp, err := clients.Dhis2Client.PutResource(
+				fmt.Sprintf("events/%s/%s", survivor.EventID, dv.DataElement), ep)
+			if err != nil {
+				return err
+			}
+			if !resp.IsSuccess() {
+				return responseError(resp.StatusCode(), resp.Body())
+			}
+		}
+	}
+	survivor.ResultsUpdated = true
+	return nil
+}
+
+// moveLabEnrollment enrolls the survivor in the laboratory program as the duplicate is, with a lab event with the
+// data values of the duplicate's. DHIS2 does not move enrollments between tracked entities, so they are created
+func moveLabEnrollment(survivor, duplicate *SyncLog) (string, string, error) {
+	var enrollment struct {
+		OrgUnit        string `json:"orgUnit"`
+		EnrollmentDate string `json:"enrollmentDate"`
+		IncidentDate   string `json:"incidentDate"`
+	}
+	err := getDHIS2Resource(fmt.Sprintf("enrollments/%s", duplicate.LabEnrollment),
+		"orgUnit,enrollmentDate,incidentDate", &enrollment)
+	if err != nil {
+		return "", "", err
+	}
+	payload := tracker.EnrollmentPayload{
+		Program:               config.RTCGwConf.API.DHIS2LaboratoryProgram,
+		Status:                "ACTIVE",
+		OrgUnit:               enrollment.OrgUnit,
+		EnrollmentDate:        enrollment.EnrollmentDate,
+		IncidentDate:          enrollment.IncidentDate,
+		TrackedEntityInstance: survivor.TrackedEntity,
+	}
+	enrollmentID, err := payload.Create()
+	if err != nil {
+		return "", "", err
+	}
+	survivor.LabEnrollment = enrollmentID
+	if duplicate.LabEvent == "" {
+		return enrollmentID, "", nil
+	}
+
+	labEvent, err := fetchDHIS2Event(duplicate.LabEvent)
+	if err != nil {
+		return enrollmentID, "", err
+	}
+	event := tracker.EventCreationPayload{
+		Program:               config.RTCGwConf.API.DHIS2LaboratoryProgram,
+		Status:                "ACTIVE",
+		OrgUnit:               labEvent.OrgUnit,
+		ProgramStage:          config.RTCGwConf.API.DHIS2LaboratoryProgramStage,
+		Enrollment:            enrollmentID,
+		EventDate:             labEvent.EventDate,
+		TrackedEntityInstance: survivor.TrackedEntity,
+	}
+	for _, dv := range labEvent.DataValues {
+		event.DataValues = append(event.DataValues, tracker.DataValue{DataElement: dv.DataElement, Value: dv.Value})
+	}
+	eventID, err := event.Create()
+	if err != nil {
+		return enrollmentID, "", err
+	}
+	survivor.LabEvent = eventID
+	return enrollmentID, eventID, nil
+}
+
+// deactivateTrackedEntity marks the tracked entity inactive in DHIS2. DHIS2 replaces all the attributes of
+// a tracked entity on update, so its current attributes are sent with it
+func deactivateTrackedEntity(trackedEntity string) error {
+	var te struct {
+		OrgUnit           string                    `json:"orgUnit"`
+		TrackedEntityType string                    `json:"trackedEntityType"`
+		Attributes        []tracker.NestedAttribute `json:"attributes"`
+	}
+	teURL := fmt.Sprintf("trackedEntityInstances/%s", trackedEntity)
+	if err := getDHIS2Resource(teURL, "orgUnit,trackedEntityType,attributes[attribute,value]", &te); err != nil {
+		return err
+	}
+	payload := tracker.TrackedEntityUpdatePayload{
+		TrackedEntityInstance: trackedEntity,
+		TrackedEntityType:     te.TrackedEntityType,
+		OrgUnit:               te.OrgUnit,
+		Attributes:            te.Attributes,
+		Inactive:              true,
+	}
+	resp, err := clients.Dhis2Client.PutResource(teURL, payload)
+	if err != nil {
+		return err
+	}
+	if !resp.IsSuccess() {
+		return responseError(resp.StatusCode(), resp.Body())
+	}
+	return nil
+}
+
+// flagPotentialDuplicate flags the duplicate tracked entity as a potential duplicate of the original in DHIS2,
+// for it to be reviewed and merged in the DHIS2 deduplication workflow
+func flagPotentialDuplicate(original, duplicate string) error {
+	payload := map[string]string{"original": original, "duplicate": duplicate}
+	resp, err := clients.Dhis2Client.PostResource("potentialDuplicates", nil, payload)
+	if err != nil {
+		return err
+	}
+	if !resp.IsSuccess() {
+		return responseError(resp.StatusCode(), resp.Body())
+	}
+	return nil
+}
+
+// saveMerged records the survivor's new lab references, points the duplicate, and any patients already merged
+// into the duplicate, to the survivor, and records the merge. If any of these fails, none of them is kept
+func (m *ClientMerge) saveMerged(tx *sqlx.Tx, survivor *SyncLog) (err error) {
+	if _, err = tx.Exec(`SAVEPOINT save_merged`); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_, _ = tx.Exec(`ROLLBACK TO SAVEPOINT save_merged`)
+		}
+	}()
+	if err = updateMergeSurvivor(tx, survivor); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE sync_log SET merged_into = $1, updated = NOW() WHERE echis_id = $2 OR merged_into = $2`,
+		m.SurvivorECHISID, m.DuplicateECHISID)
+	if err != nil {
+		return err
+	}
+	return m.insert(tx)
+}
+
+// updateMergeSurvivor records the results and lab references of the survivor of a merge
+func updateMergeSurvivor(tx *sqlx.Tx, survivor *SyncLog) error {
+	_, err := tx.Exec(`UPDATE sync_log SET results_updated = $1, lab_enrollment = $2, lab_event = $3, updated = NOW()
+		WHERE id = $4`, survivor.ResultsUpdated, survivor.LabEnrollment, survivor.LabEvent, survivor.ID)
+	return err
+}
+
+// insert records the merge in the history
+func (m *ClientMerge) insert(tx *sqlx.Tx) error {
+	rows, err := tx.NamedQuery(`INSERT INTO client_merges
+			(survivor_echis_id, duplicate_echis_id, survivor_tracked_entity, duplicate_tracked_entity, moved_results,
+			lab_enrollment, lab_event, duplicate_marking, status, error, user_id)
+		VALUES (:survivor_echis_id, :duplicate_echis_id, :survivor_tracked_entity, :duplicate_tracked_entity,
+			:moved_results, :lab_enrollment, :lab_event, :duplicate_marking, :status, :error, :user_id)
+		RETURNING id, created`, m)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	if rows.Next() {
+		return rows.Scan(&m.ID, &m.Created)
+	}
+	return rows.Err()
+}
+
+// GetClientMerges returns a page of the merges of the patient echisID, as survivor or duplicate, latest first.
+// All merges are returned if echisID is empty
+func GetClientMerges(echisID string, page, pageSize int) ([]ClientMerge, int64, error) {
+	var total int64
+	err := db.GetDB().Get(&total, `SELECT COUNT(*) FROM client_merges
+		WHERE $1 = '' OR survivor_echis_id = $1 OR duplicate_echis_id = $1`, echisID)
+	if err != nil {
+		return nil, 0, err
+	}
+	merges := []ClientMerge{}
+	err = db.GetDB().Select(&merges, `SELECT * FROM client_merges
+		WHERE $1 = '' OR survivor_echis_id = $1 OR duplicate_echis_id = $1
+		ORDER BY created DESC, id DESC LIMIT $2 OFFSET $3`, echisID, pageSize, (page-1)*pageSize)
+	return merges, total, err
+}
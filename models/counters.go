@@ -0,0 +1,31 @@
+package models
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// counterIncrement returns the SQL expression incrementing a "count/period" counter column such as
+// users.failed_attempts by n. The count restarts when the period, formatted using the SQL expression
+// periodFormat, changes
+func counterIncrement(column, periodFormat, n string) string {
+	return fmt.Sprintf(`%s::TEXT || '/' || to_char(NOW(), %s)`, counterNext(column, periodFormat, n), periodFormat)
+}
+
+// counterNext returns the SQL expression of the count of a "count/period" counter column once incremented by n,
+// see counterIncrement
+func counterNext(column, periodFormat, n string) string {
+	return fmt.Sprintf(`(CASE WHEN split_part(COALESCE(%[1]s, ''), '/', 2) = to_char(NOW(), %[2]s)
+		THEN split_part(%[1]s, '/', 1)::INT + %[3]s ELSE %[3]s END)`, column, periodFormat, n)
+}
+
+// ParseCounter splits a "count/period" counter such as users.failed_attempts into its count and period
+func ParseCounter(counter string) (int, string) {
+	parts := strings.SplitN(counter, "/", 2)
+	count, _ := strconv.Atoi(parts[0])
+	if len(parts) < 2 {
+		return count, ""
+	}
+	return count, parts[1]
+}
@@ -0,0 +1,90 @@
+package models
+
+import (
+	"fmt"
+	"github.com/goccy/go-json"
+	"rtcgw/clients"
+)
+
+// DHIS2Record is the current state in DHIS2 of a patient recorded in the sync_log
+type DHIS2Record struct {
+	TrackedEntity  string            `json:"tracked_entity"`
+	OrgUnit        string            `json:"org_unit"`
+	Attributes     []DHIS2Attribute  `json:"attributes"`
+	ScreeningEvent *DHIS2EventRecord `json:"screening_event"`
+	LabEvent       *DHIS2EventRecord `json:"lab_event"`
+}
+
+// DHIS2Attribute is a tracked entity attribute value
+type DHIS2Attribute struct {
+	Attribute   string `json:"attribute"`
+	DisplayName string `json:"displayName,omitempty"`
+	Value       string `json:"value"`
+}
+
+// DHIS2EventRecord is an event together with its data values
+type DHIS2EventRecord struct {
+	Event        string               `json:"event"`
+	ProgramStage string               `json:"programStage"`
+	OrgUnit      string               `json:"orgUnit"`
+	Status       string               `json:"status"`
+	EventDate    string               `json:"eventDate"`
+	DataValues   []DHIS2DataValueItem `json:"dataValues"`
+}
+
+// DHIS2DataValueItem is a data value of an event
+type DHIS2DataValueItem struct {
+	DataElement string `json:"dataElement"`
+	Value       string `json:"value"`
+}
+
+// FetchDHIS2Record gets the current attribute values of the patient's tracked entity and the data values of
+// their screening and lab events from DHIS2
+func (s *SyncLog) FetchDHIS2Record() (*DHIS2Record, error) {
+	record := &DHIS2Record{}
+	var te struct {
+		TrackedEntityInstance string           `json:"trackedEntityInstance"`
+		OrgUnit               string           `json:"orgUnit"`
+		Attributes            []DHIS2Attribute `json:"attributes"`
+	}
+	err := getDHIS2Resource(fmt.Sprintf("trackedEntityInstances/%s", s.TrackedEntity),
+		"trackedEntityInstance,orgUnit,attributes[attribute,displayName,value]", &te)
+	if err != nil {
+		return nil, err
+	}
+	record.TrackedEntity, record.OrgUnit, record.Attributes = te.TrackedEntityInstance, te.OrgUnit, te.Attributes
+
+	if s.EventID != "" {
+		if record.ScreeningEvent, err = fetchDHIS2Event(s.EventID); err != nil {
+			return nil, err
+		}
+	}
+	if s.LabEvent != "" {
+		if record.LabEvent, err = fetchDHIS2Event(s.LabEvent); err != nil {
+			return nil, err
+		}
+	}
+	return record, nil
+}
+
+func fetchDHIS2Event(event string) (*DHIS2EventRecord, error) {
+	var record DHIS2EventRecord
+	err := getDHIS2Resource(fmt.Sprintf("events/%s", event),
+		"event,programStage,orgUnit,status,eventDate,dataValues[dataElement,value]", &record)
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// getDHIS2Resource gets the given fields of the resource at path from DHIS2 into v
+func getDHIS2Resource(path, fields string, v any) error {
+	resp, err := clients.Dhis2Client.GetResource(path, map[string]string{"fields": fields})
+	if err != nil {
+		return err
+	}
+	if !resp.IsSuccess() {
+		return fmt.Errorf("failed to get %s from DHIS2: %s", path, resp.Status())
+	}
+	return json.Unmarshal(resp.Body(), v)
+}
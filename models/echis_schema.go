@@ -0,0 +1,377 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/go-playground/validator/v10"
+	"github.com/goccy/go-json"
+	log "github.com/sirupsen/logrus"
+	"reflect"
+	"regexp"
+	"rtcgw/config"
+	"rtcgw/models/tracker"
+	"rtcgw/utils"
+	"strconv"
+	"strings"
+)
+
+// Targets of eCHIS fields in DHIS2
+const (
+	TargetAttribute   = "attribute"
+	TargetDataElement = "data_element"
+)
+
+// Types of eCHIS fields
+const (
+	FieldTypeString  = "string"
+	FieldTypeInteger = "integer"
+	FieldTypeNumber  = "number"
+	FieldTypeBoolean = "boolean"
+)
+
+// Names of the eCHIS fields the gateway relies on, which are always required
+const (
+	FieldECHISID         = "echis_patient_id"
+	FieldFacilityDHIS2ID = "facility_dhis2_id"
+)
+
+// echisRequestFields are the built-in eCHIS fields, used when no echis_schema is configured.
+// use_as gives the target of a field, attr or de, and binding its validation
+type echisRequestFields struct {
+	ECHISID             string `use_as:"attr" json:"echis_patient_id" binding:"required"`
+	NIN                 string `use_as:"attr" json:"national_identification_number" binding:"omitempty,ugandaNIN"`
+	Name                string `use_as:"attr" json:"patient_name" binding:"required"`
+	Sex                 string `use_as:"attr" json:"patient_gender" binding:"omitempty,maleFemale"`
+	FacilityID          string `use_as:"" json:"facility_id"`
+	FacilityDHIS2ID     string `use_as:"" json:"facility_dhis2_id" binding:"required,dhis2UID"`
+	PatientPhone        string `use_as:"attr" json:"patient_phone"`
+	PatientCategory     string `use_as:"attr" json:"patient_category"`
+	PatientAgeInYears   string `use_as:"attr" json:"patient_age_in_years"`
+	PatientAgeInMonths  string `use_as:"attr" json:"patient_age_in_months,omitempty"`
+	PatientAgeInDays    string `use_as:"attr" json:"patient_age_in_days,omitempty"`
+	ClientCategory      string `use_as:"attr" json:"client_category,omitempty"`
+	Cough               string `use_as:"de" json:"cough,omitempty" binding:"omitempty,yesNo"`
+	Fever               string `use_as:"de" json:"fever,omitempty" binding:"omitempty,yesNo"`
+	WeightLoss          string `use_as:"de" json:"weight_loss,omitempty" binding:"omitempty,yesNo"`
+	ExcessiveNightSweat string `use_as:"de" json:"excessive_night_sweat,omitempty" binding:"omitempty,yesNo"`
+	IsOnTBTreatment     string `use_as:"de" json:"is_on_tb_treatment,omitempty" binding:"omitempty,yesNo"`
+	PoorWeightGain      string `use_as:"de" json:"poor_weight_gain,omitempty"`
+}
+
+// ECHISSchema returns the configured echis_schema, or the built-in fields if none is configured.
+// The echis_patient_id and facility_dhis2_id fields are always included and required
+func ECHISSchema() []config.ECHISField {
+	schema := config.RTCGwConf.API.ECHISSchema
+	if len(schema) == 0 {
+		return defaultECHISSchema()
+	}
+	schema = append([]config.ECHISField{}, schema...)
+	for _, name := range []string{FieldECHISID, FieldFacilityDHIS2ID} {
+		found := false
+		for i := range schema {
+			if schema[i].Name == name {
+				schema[i].Required, found = true, true
+			}
+		}
+		if !found {
+			field, _ := schemaField(defaultECHISSchema(), name)
+			schema = append(schema, field)
+		}
+	}
+	return schema
+}
+
+// defaultECHISSchema builds the schema of the built-in fields from the tags of echisRequestFields
+func defaultECHISSchema() []config.ECHISField {
+	typ := reflect.TypeOf(echisRequestFields{})
+	schema := make([]config.ECHISField, 0, typ.NumField())
+	for i := 0; i < typ.NumField(); i++ {
+		structField := typ.Field(i)
+		field := config.ECHISField{
+			Name: strings.Split(structField.Tag.Get("json"), ",")[0],
+			Type: FieldTypeString,
+		}
+		for _, rule := range strings.Split(structField.Tag.Get("binding"), ",") {
+			switch rule {
+			case "", "omitempty":
+			case "required":
+				field.Required = true
+			default:
+				field.Validator = rule
+			}
+		}
+		switch structField.Tag.Get("use_as") {
+		case "attr":
+			field.Target = TargetAttribute
+		case "de":
+			field.Target = TargetDataElement
+		}
+		schema = append(schema, field)
+	}
+	return schema
+}
+
+func schemaField(schema []config.ECHISField, name string) (config.ECHISField, bool) {
+	for _, field := range schema {
+		if field.Name == name {
+			return field, true
+		}
+	}
+	return config.ECHISField{}, false
+}
+
+// CheckECHISSchema returns the problems with the configured echis_schema, e.g. unknown validators
+func CheckECHISSchema() []string {
+	var problems []string
+	for _, field := range config.RTCGwConf.API.ECHISSchema {
+		switch {
+		case field.Name == "":
+			problems = append(problems, "echis_schema field without a name")
+		case field.Type != "" && !utils.Contains(
+			[]string{FieldTypeString, FieldTypeInteger, FieldTypeNumber, FieldTypeBoolean}, field.Type):
+			problems = append(problems, fmt.Sprintf("%s: unknown type %s", field.Name, field.Type))
+		case field.Target != "" && field.Target != TargetAttribute && field.Target != TargetDataElement:
+			problems = append(problems, fmt.Sprintf("%s: unknown target %s", field.Name, field.Target))
+		case field.Target != "" && schemaFieldUID(field) == "":
+			problems = append(problems, fmt.Sprintf("%s: no uid and no dhis2_mapping for the %s", field.Name, field.Target))
+		}
+		switch field.Validator {
+		case "", "ugandaNIN", "dhis2UID", "yesNo", "maleFemale":
+		case "regex":
+			if _, err := regexp.Compile(field.Pattern); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: invalid pattern: %v", field.Name, err))
+			}
+		case "enum":
+			if len(field.Values) == 0 {
+				problems = append(problems, fmt.Sprintf("%s: enum without values", field.Name))
+			}
+		default:
+			problems = append(problems, fmt.Sprintf("%s: unknown validator %s", field.Name, field.Validator))
+		}
+	}
+	return problems
+}
+
+// schemaFieldUID returns the DHIS2 attribute or data element the field is saved to,
+// which defaults to the dhis2_mapping of its target
+func schemaFieldUID(field config.ECHISField) string {
+	if field.UID != "" {
+		return field.UID
+	}
+	switch field.Target {
+	case TargetAttribute:
+		return config.RTCGwConf.API.DHIS2Mapping["attributes"][field.Name]
+	case TargetDataElement:
+		return config.RTCGwConf.API.DHIS2Mapping["data_elements"][field.Name]
+	}
+	return ""
+}
+
+// schemaValue converts a JSON value to the string saved in DHIS2, returning false if it is not of the field type
+func schemaValue(field config.ECHISField, value any) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		switch field.Type {
+		case FieldTypeInteger:
+			_, err := strconv.ParseInt(v, 10, 64)
+			return v, err == nil
+		case FieldTypeNumber:
+			_, err := strconv.ParseFloat(v, 64)
+			return v, err == nil
+		case FieldTypeBoolean:
+			b, err := strconv.ParseBool(v)
+			return strconv.FormatBool(b), err == nil
+		}
+		return v, true
+	case json.Number:
+		switch field.Type {
+		case FieldTypeInteger:
+			_, err := v.Int64()
+			return v.String(), err == nil
+		case FieldTypeBoolean:
+			return "", false
+		}
+		return v.String(), true
+	case bool:
+		if field.Type == FieldTypeInteger || field.Type == FieldTypeNumber {
+			return "", false
+		}
+		return strconv.FormatBool(v), true
+	}
+	return "", false
+}
+
+// schemaValueValid checks a non-empty value against the validator of the field
+func schemaValueValid(field config.ECHISField, value string) bool {
+	switch field.Validator {
+	case "":
+		return true
+	case "ugandaNIN":
+		return utils.IsUgandaNIN(value)
+	case "dhis2UID":
+		return utils.IsDHIS2UID(value)
+	case "yesNo":
+		return utils.IsYesNo(value)
+	case "maleFemale":
+		return utils.IsMaleFemale(value)
+	case "regex":
+		pattern, err := regexp.Compile(field.Pattern)
+		if err != nil {
+			log.WithError(err).WithField("field", field.Name).Error("Invalid echis_schema pattern")
+			return false
+		}
+		return pattern.MatchString(value)
+	case "enum":
+		return utils.Contains(field.Values, value)
+	}
+	log.WithField("field", field.Name).Errorf("Unknown echis_schema validator %s", field.Validator)
+	return false
+}
+
+// schemaValidationMessage is the message for a value of the field failing validation on tag
+func schemaValidationMessage(field config.ECHISField, tag string) string {
+	if field.Message != "" {
+		return field.Message
+	}
+	switch tag {
+	case "required":
+		return fmt.Sprintf("%s is required and must be provided.", field.Name)
+	case "type":
+		return fmt.Sprintf("%s should be of type %s.", field.Name, field.Type)
+	case "ugandaNIN":
+		return fmt.Sprintf("invalid %s provided.", field.Name)
+	case "dhis2UID":
+		return fmt.Sprintf("%s must be a valid DHIS2 UID.", field.Name)
+	case "yesNo":
+		return "Should be exactly 'Yes' or 'No'. Notice the case"
+	case "maleFemale":
+		return fmt.Sprintf("%s should be Male or Female", field.Name)
+	case "regex":
+		return fmt.Sprintf("%s should match the pattern %s", field.Name, field.Pattern)
+	case "enum":
+		return fmt.Sprintf("%s should be one of %s", field.Name, strings.Join(field.Values, ", "))
+	}
+	return fmt.Sprintf("Validation failed on '%s' condition", tag)
+}
+
+// ECHISRequest is a client registration from eCHIS. Its fields are defined by the eCHIS schema and kept in
+// Values by name, with the fields the gateway relies on also kept in ECHISID and FacilityDHIS2ID
+type ECHISRequest struct {
+	ECHISID         string
+	FacilityDHIS2ID string
+	Values          map[string]string
+	// invalidTypes are the fields whose JSON values are not of the field type
+	invalidTypes []string
+	// partial requests only update the fields in Values, so only those are validated
+	partial bool
+}
+
+// NewECHISRequest returns the eCHIS request with the given field values
+func NewECHISRequest(values map[string]string) ECHISRequest {
+	return ECHISRequest{
+		ECHISID:         values[FieldECHISID],
+		FacilityDHIS2ID: values[FieldFacilityDHIS2ID],
+		Values:          values,
+	}
+}
+
+// PartialUpdate returns the request as a partial update of the client echisID, with only the supplied fields.
+// facility_dhis2_id is left out, as the update does not move the client to another facility
+func (r ECHISRequest) PartialUpdate(echisID string) ECHISRequest {
+	values := make(map[string]string)
+	for name, value := range r.Values {
+		if name != FieldFacilityDHIS2ID {
+			values[name] = value
+		}
+	}
+	values[FieldECHISID] = echisID
+	update := NewECHISRequest(values)
+	update.invalidTypes, update.partial = r.invalidTypes, true
+	return update
+}
+
+// UpdatedFields returns the names of the supplied fields that are saved to DHIS2, other than echis_patient_id
+func (r ECHISRequest) UpdatedFields() []string {
+	var fields []string
+	for _, field := range ECHISSchema() {
+		if _, ok := r.Values[field.Name]; ok && field.Name != FieldECHISID && field.Target != "" &&
+			schemaFieldUID(field) != "" {
+			fields = append(fields, field.Name)
+		}
+	}
+	return fields
+}
+
+// UnmarshalJSON keeps the values of the schema fields of a JSON object, ignoring other fields
+func (r *ECHISRequest) UnmarshalJSON(data []byte) error {
+	var raw map[string]any
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&raw); err != nil {
+		return err
+	}
+	values := make(map[string]string)
+	var invalidTypes []string
+	for _, field := range ECHISSchema() {
+		v, ok := raw[field.Name]
+		if !ok || v == nil {
+			continue
+		}
+		value, ok := schemaValue(field, v)
+		if !ok {
+			invalidTypes = append(invalidTypes, field.Name)
+			continue
+		}
+		values[field.Name] = value
+	}
+	*r = NewECHISRequest(values)
+	r.invalidTypes = invalidTypes
+	return nil
+}
+
+// MarshalJSON returns the field values as a JSON object
+func (r ECHISRequest) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.Values)
+}
+
+// ECHISRequestValidation validates an eCHIS request against the eCHIS schema. Errors are reported with the field
+// name and the failing validator, or required or type, so that FormatValidationError gives the schema messages.
+// Partial updates are only validated on the supplied fields
+func ECHISRequestValidation(sl validator.StructLevel) {
+	r := sl.Current().Interface().(ECHISRequest)
+	for _, field := range ECHISSchema() {
+		value, supplied := r.Values[field.Name]
+		switch {
+		case utils.Contains(r.invalidTypes, field.Name):
+			sl.ReportError(value, field.Name, field.Name, "type", field.Type)
+		case r.partial && !supplied:
+		case value == "":
+			if field.Required {
+				sl.ReportError(value, field.Name, field.Name, "required", "")
+			}
+		case !schemaValueValid(field, value):
+			sl.ReportError(value, field.Name, field.Name, field.Validator, "")
+		}
+	}
+}
+
+// dhis2Values returns the values of the request as DHIS2 tracked entity attributes and screening event
+// data values, in the order of the eCHIS schema
+func (r ECHISRequest) dhis2Values() ([]tracker.NestedAttribute, []tracker.DataValue) {
+	var attributes []tracker.NestedAttribute
+	var dataValues []tracker.DataValue
+	for _, field := range ECHISSchema() {
+		value, ok := r.Values[field.Name]
+		uid := schemaFieldUID(field)
+		if !ok || uid == "" {
+			continue
+		}
+		switch field.Target {
+		case TargetAttribute:
+			attributes = append(attributes, tracker.NestedAttribute{Attribute: uid, Value: value})
+		case TargetDataElement:
+			dataValues = append(dataValues, tracker.DataValue{DataElement: uid, Value: value})
+		}
+	}
+	return attributes, dataValues
+}
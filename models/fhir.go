@@ -0,0 +1,155 @@
+package models
+
+import (
+	"rtcgw/config"
+	"rtcgw/models/fhir"
+	"rtcgw/utils"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LOINCSystem is the FHIR code system of LOINC codes
+const LOINCSystem = "http://loinc.org"
+
+// ECHISRequestFromPatient maps a FHIR Patient onto an eCHIS request. The eCHIS patient id and national
+// identification number are taken from the identifiers with the configured systems, or with the MR and NI
+// identifier types. Extensions whose url ends with the name of an eCHIS schema field give that field
+func ECHISRequestFromPatient(patient fhir.Patient) ECHISRequest {
+	conf := config.RTCGwConf.API
+	values := make(map[string]string)
+	for _, extension := range patient.Extension {
+		name := extension.URL[strings.LastIndex(extension.URL, "/")+1:]
+		if value, ok := extensionValue(extension); ok {
+			values[name] = value
+		}
+	}
+
+	for _, identifier := range patient.Identifier {
+		switch {
+		case identifier.Value == "":
+		case conf.FHIRPatientIDSystem != "" && identifier.System == conf.FHIRPatientIDSystem,
+			identifierHasType(identifier, "MR"):
+			values[FieldECHISID] = identifier.Value
+		case conf.FHIRNINSystem != "" && identifier.System == conf.FHIRNINSystem,
+			identifierHasType(identifier, "NI"):
+			values["national_identification_number"] = identifier.Value
+		}
+	}
+	if _, ok := values[FieldECHISID]; !ok && len(patient.Identifier) == 1 {
+		values[FieldECHISID] = patient.Identifier[0].Value
+	}
+
+	for i, name := range patient.Name {
+		if i == 0 || name.Use == "official" {
+			values["patient_name"] = name.FullName()
+		}
+	}
+	if patient.Gender != "" {
+		values["patient_gender"] = strings.ToUpper(patient.Gender[:1]) + patient.Gender[1:]
+	}
+	for _, telecom := range patient.Telecom {
+		if telecom.System == "phone" && telecom.Value != "" {
+			values["patient_phone"] = telecom.Value
+			break
+		}
+	}
+	if birthDate, err := time.Parse("2006-01-02", patient.BirthDate); err == nil {
+		years, months, days := ageOn(birthDate, time.Now())
+		values["patient_age_in_years"] = strconv.Itoa(years)
+		if years == 0 {
+			values["patient_age_in_months"] = strconv.Itoa(months)
+		}
+		if months == 0 {
+			values["patient_age_in_days"] = strconv.Itoa(days)
+		}
+	}
+	if facility := patient.ManagingOrganization.ID("Organization"); facility != "" {
+		values[FieldFacilityDHIS2ID] = facility
+	}
+	return NewECHISRequest(values)
+}
+
+func identifierHasType(identifier fhir.Identifier, code string) bool {
+	if identifier.Type == nil {
+		return false
+	}
+	for _, coding := range identifier.Type.Coding {
+		if coding.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+func extensionValue(extension fhir.Extension) (string, bool) {
+	switch {
+	case extension.ValueString != nil:
+		return *extension.ValueString, true
+	case extension.ValueCode != nil:
+		return *extension.ValueCode, true
+	case extension.ValueBoolean != nil:
+		return strconv.FormatBool(*extension.ValueBoolean), true
+	case extension.ValueInteger != nil:
+		return strconv.Itoa(*extension.ValueInteger), true
+	case extension.ValueDecimal != nil:
+		return extension.ValueDecimal.String(), true
+	case extension.ValueCoding != nil:
+		return extension.ValueCoding.Code, true
+	case extension.ValueConcept != nil:
+		return extension.ValueConcept.Value(), true
+	}
+	return "", false
+}
+
+// ageOn returns the age in completed years, months and days on the given date of someone born on birthDate
+func ageOn(birthDate, date time.Time) (int, int, int) {
+	months := (date.Year()-birthDate.Year())*12 + int(date.Month()-birthDate.Month())
+	if date.Day() < birthDate.Day() {
+		months--
+	}
+	days := int(date.Sub(birthDate).Hours() / 24)
+	return months / 12, months, days
+}
+
+// IsGeneXpertObservation returns true if the observation is coded with the configured LOINC code of GeneXpert MTB results
+func IsGeneXpertObservation(observation fhir.Observation) bool {
+	return observation.Code.HasCode(LOINCSystem, config.RTCGwConf.API.FHIRMTBCode)
+}
+
+// LabXpertResultFromObservation maps a GeneXpert FHIR Observation onto a LabXpert result. The MTB result is the
+// value of the observation and the rifampicin resistance result the value of its component with the configured
+// LOINC code. The patient is the subject and the facility the Organization performer
+func LabXpertResultFromObservation(observation fhir.Observation) LabXpertResult {
+	result := LabXpertResult{
+		PatientID:  observation.Subject.ID("Patient"),
+		MTB:        normalizeResult(observation.Value(), utils.MTBResults),
+		ResultDate: observation.EffectiveDateTime,
+	}
+	if result.ResultDate == "" {
+		result.ResultDate = observation.Issued
+	}
+	for _, component := range observation.Component {
+		if component.Code.HasCode(LOINCSystem, config.RTCGwConf.API.FHIRRRCode) {
+			result.RR = normalizeResult(component.Value(), utils.RRResults)
+		}
+	}
+	for i := range observation.Performer {
+		if facility := observation.Performer[i].ID("Organization"); facility != "" {
+			result.FacilityID = facility
+			break
+		}
+	}
+	return result
+}
+
+// normalizeResult returns the result with the case of the matching allowed result, e.g. Invalid for INVALID
+func normalizeResult(result string, allowed []string) string {
+	result = strings.TrimSpace(result)
+	for _, a := range allowed {
+		if strings.EqualFold(a, result) {
+			return a
+		}
+	}
+	return result
+}
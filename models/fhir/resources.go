@@ -0,0 +1,250 @@
+// Package fhir has the subset of the FHIR R4 resources the gateway accepts from national systems
+package fhir
+
+import (
+	"github.com/goccy/go-json"
+	"strings"
+)
+
+// Bundle types and the corresponding response types
+const (
+	BundleTransaction         = "transaction"
+	BundleBatch               = "batch"
+	BundleTransactionResponse = "transaction-response"
+	BundleBatchResponse       = "batch-response"
+)
+
+// OperationOutcome issue severities
+const (
+	SeverityError       = "error"
+	SeverityInformation = "information"
+)
+
+// OperationOutcome issue types
+const (
+	IssueStructure     = "structure"
+	IssueRequired      = "required"
+	IssueValue         = "value"
+	IssueInvalid       = "invalid"
+	IssueNotSupported  = "not-supported"
+	IssueForbidden     = "forbidden"
+	IssueException     = "exception"
+	IssueInformational = "informational"
+)
+
+// Coding is a code from a code system e.g. LOINC
+type Coding struct {
+	System  string `json:"system,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Display string `json:"display,omitempty"`
+}
+
+// CodeableConcept is a concept given by codings and/or text
+type CodeableConcept struct {
+	Coding []Coding `json:"coding,omitempty"`
+	Text   string   `json:"text,omitempty"`
+}
+
+// HasCode returns true if the concept has a coding with the given system and code
+func (cc *CodeableConcept) HasCode(system, code string) bool {
+	for _, coding := range cc.Coding {
+		if coding.System == system && coding.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// Value returns the text of the concept, or else the display or code of its first coding
+func (cc *CodeableConcept) Value() string {
+	if cc.Text != "" {
+		return cc.Text
+	}
+	for _, coding := range cc.Coding {
+		if coding.Display != "" {
+			return coding.Display
+		}
+		if coding.Code != "" {
+			return coding.Code
+		}
+	}
+	return ""
+}
+
+// Identifier is a business identifier of a resource e.g. a national identification number
+type Identifier struct {
+	Use    string           `json:"use,omitempty"`
+	Type   *CodeableConcept `json:"type,omitempty"`
+	System string           `json:"system,omitempty"`
+	Value  string           `json:"value,omitempty"`
+}
+
+// Reference refers to another resource, by its literal reference e.g. Organization/FvewOonC8lS or by identifier
+type Reference struct {
+	Reference  string      `json:"reference,omitempty"`
+	Identifier *Identifier `json:"identifier,omitempty"`
+	Display    string      `json:"display,omitempty"`
+}
+
+// ID returns the id of the referenced resource of the given type, or the value of the reference's identifier
+func (r *Reference) ID(resourceType string) string {
+	if r == nil {
+		return ""
+	}
+	if id, ok := strings.CutPrefix(r.Reference, resourceType+"/"); ok {
+		return id
+	}
+	if r.Identifier != nil {
+		return r.Identifier.Value
+	}
+	return ""
+}
+
+// HumanName is the name of a patient
+type HumanName struct {
+	Use    string   `json:"use,omitempty"`
+	Text   string   `json:"text,omitempty"`
+	Family string   `json:"family,omitempty"`
+	Given  []string `json:"given,omitempty"`
+}
+
+// FullName returns the text of the name, or else its given and family names
+func (n *HumanName) FullName() string {
+	if n.Text != "" {
+		return n.Text
+	}
+	return strings.TrimSpace(strings.Join(append(append([]string{}, n.Given...), n.Family), " "))
+}
+
+// ContactPoint is a phone number or other contact of a patient
+type ContactPoint struct {
+	System string `json:"system,omitempty"`
+	Value  string `json:"value,omitempty"`
+	Use    string `json:"use,omitempty"`
+}
+
+// Extension is an additional element of a resource identified by its url
+type Extension struct {
+	URL          string           `json:"url"`
+	ValueString  *string          `json:"valueString,omitempty"`
+	ValueCode    *string          `json:"valueCode,omitempty"`
+	ValueBoolean *bool            `json:"valueBoolean,omitempty"`
+	ValueInteger *int             `json:"valueInteger,omitempty"`
+	ValueDecimal *json.Number     `json:"valueDecimal,omitempty"`
+	ValueCoding  *Coding          `json:"valueCoding,omitempty"`
+	ValueConcept *CodeableConcept `json:"valueCodeableConcept,omitempty"`
+}
+
+// Patient is a FHIR Patient resource
+type Patient struct {
+	ResourceType         string         `json:"resourceType"`
+	ID                   string         `json:"id,omitempty"`
+	Identifier           []Identifier   `json:"identifier,omitempty"`
+	Name                 []HumanName    `json:"name,omitempty"`
+	Telecom              []ContactPoint `json:"telecom,omitempty"`
+	Gender               string         `json:"gender,omitempty"`
+	BirthDate            string         `json:"birthDate,omitempty"`
+	ManagingOrganization *Reference     `json:"managingOrganization,omitempty"`
+	Extension            []Extension    `json:"extension,omitempty"`
+}
+
+// ObservationComponent is a component result of an observation e.g. the rifampicin resistance of a GeneXpert test
+type ObservationComponent struct {
+	Code                 CodeableConcept  `json:"code"`
+	ValueCodeableConcept *CodeableConcept `json:"valueCodeableConcept,omitempty"`
+	ValueString          *string          `json:"valueString,omitempty"`
+}
+
+// Value returns the coded or string value of the component
+func (oc *ObservationComponent) Value() string {
+	return observationValue(oc.ValueCodeableConcept, oc.ValueString)
+}
+
+// Observation is a FHIR Observation resource
+type Observation struct {
+	ResourceType         string                 `json:"resourceType"`
+	ID                   string                 `json:"id,omitempty"`
+	Status               string                 `json:"status,omitempty"`
+	Code                 CodeableConcept        `json:"code"`
+	Subject              *Reference             `json:"subject,omitempty"`
+	EffectiveDateTime    string                 `json:"effectiveDateTime,omitempty"`
+	Issued               string                 `json:"issued,omitempty"`
+	Performer            []Reference            `json:"performer,omitempty"`
+	ValueCodeableConcept *CodeableConcept       `json:"valueCodeableConcept,omitempty"`
+	ValueString          *string                `json:"valueString,omitempty"`
+	Component            []ObservationComponent `json:"component,omitempty"`
+}
+
+// Value returns the coded or string value of the observation
+func (o *Observation) Value() string {
+	return observationValue(o.ValueCodeableConcept, o.ValueString)
+}
+
+func observationValue(concept *CodeableConcept, value *string) string {
+	if concept != nil {
+		return concept.Value()
+	}
+	if value != nil {
+		return *value
+	}
+	return ""
+}
+
+// Bundle is a FHIR transaction or batch Bundle, or the response to one
+type Bundle struct {
+	ResourceType string        `json:"resourceType"`
+	Type         string        `json:"type"`
+	Entry        []BundleEntry `json:"entry,omitempty"`
+}
+
+// BundleEntry is a resource in a Bundle, or the response to it
+type BundleEntry struct {
+	FullURL  string               `json:"fullUrl,omitempty"`
+	Resource json.RawMessage      `json:"resource,omitempty"`
+	Response *BundleEntryResponse `json:"response,omitempty"`
+}
+
+// ResourceType returns the resourceType of the entry's resource
+func (e *BundleEntry) ResourceType() string {
+	var resource struct {
+		ResourceType string `json:"resourceType"`
+	}
+	_ = json.Unmarshal(e.Resource, &resource)
+	return resource.ResourceType
+}
+
+// BundleEntryResponse is the outcome of processing a Bundle entry
+type BundleEntryResponse struct {
+	Status   string            `json:"status"`
+	Location string            `json:"location,omitempty"`
+	Outcome  *OperationOutcome `json:"outcome,omitempty"`
+}
+
+// OperationOutcome reports the outcome of an operation as a list of issues
+type OperationOutcome struct {
+	ResourceType string  `json:"resourceType"`
+	Issue        []Issue `json:"issue"`
+}
+
+// Issue is an error or information about an operation
+type Issue struct {
+	Severity    string   `json:"severity"`
+	Code        string   `json:"code"`
+	Diagnostics string   `json:"diagnostics,omitempty"`
+	Expression  []string `json:"expression,omitempty"`
+}
+
+// NewOperationOutcome returns an OperationOutcome with the given issues
+func NewOperationOutcome(issues ...Issue) *OperationOutcome {
+	return &OperationOutcome{ResourceType: "OperationOutcome", Issue: issues}
+}
+
+// HasErrors returns true if any of the issues is an error
+func (oo *OperationOutcome) HasErrors() bool {
+	for _, issue := range oo.Issue {
+		if issue.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
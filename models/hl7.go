@@ -0,0 +1,192 @@
+package models
+
+import (
+	"fmt"
+	"rtcgw/config"
+	"rtcgw/hl7"
+	"rtcgw/utils"
+	"sort"
+	"strings"
+	"time"
+)
+
+// HL7Result is a LabXpert result from an ORU^R01 message, with the fields of the message its values were taken from
+type HL7Result struct {
+	LabXpertResult
+	locations map[string]hl7Location
+}
+
+type hl7Location struct {
+	segment *hl7.Segment
+	field   int
+}
+
+// LabXpertResultsFromORU maps the GeneXpert results of an ORU^R01 message onto LabXpert results, one for each
+// order (OBR) with an OBX coded with the configured MTB code. The patient is given by PID-3, the MTB and
+// rifampicin resistance results by the OBX values, the result date by OBX-14 or else OBR-7 and the facility by MSH-4
+func LabXpertResultsFromORU(msg *hl7.Message) ([]HL7Result, []hl7.Error) {
+	if code, event := msg.Type(); code != "ORU" {
+		return nil, []hl7.Error{{Segment: "MSH", Sequence: 1, Field: 9, Code: hl7.ErrUnsupportedMessage,
+			Message: fmt.Sprintf("Unsupported message type %s, only ORU^R01 is supported", code)}}
+	} else if event != "R01" {
+		return nil, []hl7.Error{{Segment: "MSH", Sequence: 1, Field: 9, Code: hl7.ErrUnsupportedEvent,
+			Message: fmt.Sprintf("Unsupported trigger event %s, only ORU^R01 is supported", event)}}
+	}
+	msh := msg.Segment("MSH")
+	facility := hl7Facility(msh)
+
+	var results []HL7Result
+	var current *HL7Result
+	var pid, obr *hl7.Segment
+	flush := func() {
+		if current != nil && current.MTB != "" {
+			current.setResultDate(obr)
+			results = append(results, *current)
+		}
+		current = nil
+	}
+	for _, segment := range msg.Segments {
+		switch segment.Name {
+		case "PID":
+			flush()
+			pid, obr = segment, nil
+		case "OBR":
+			flush()
+			obr = segment
+		case "OBX":
+			if current == nil {
+				current = newHL7Result(msh, pid, facility)
+			}
+			current.addObservation(segment)
+		}
+	}
+	flush()
+
+	if len(results) == 0 {
+		return nil, []hl7.Error{{Segment: "OBX", Code: hl7.ErrRequiredFieldMissing, Field: 3,
+			Message: fmt.Sprintf("No OBX with the MTB result code %s", config.RTCGwConf.API.HL7MTBCode)}}
+	}
+	return results, nil
+}
+
+func newHL7Result(msh, pid *hl7.Segment, facility string) *HL7Result {
+	result := &HL7Result{
+		LabXpertResult: LabXpertResult{FacilityID: facility, Lab: msh.Component(4, 1)},
+		locations:      map[string]hl7Location{"facility_dhis2_id": {msh, 4}},
+	}
+	if pid != nil {
+		result.PatientID = hl7PatientID(pid)
+		result.locations["patient_id"] = hl7Location{pid, 3}
+	}
+	return result
+}
+
+func (r *HL7Result) addObservation(obx *hl7.Segment) {
+	switch {
+	case hl7HasCode(obx, config.RTCGwConf.API.HL7MTBCode):
+		r.MTB = normalizeResult(hl7ObservationValue(obx), utils.MTBResults)
+		r.locations["mtb"] = hl7Location{obx, 5}
+		if obx.Field(14) != "" {
+			r.ResultDate = obx.Field(14)
+			r.locations["result_date"] = hl7Location{obx, 14}
+		}
+	case hl7HasCode(obx, config.RTCGwConf.API.HL7RRCode):
+		r.RR = normalizeResult(hl7ObservationValue(obx), utils.RRResults)
+		r.locations["rr"] = hl7Location{obx, 5}
+	}
+}
+
+// setResultDate converts the HL7 date/time of the result, from OBX-14 or else OBR-7, to a LabXpert result date.
+// Dates that cannot be parsed are kept as they are to fail validation
+func (r *HL7Result) setResultDate(obr *hl7.Segment) {
+	if r.ResultDate == "" && obr != nil {
+		r.ResultDate = obr.Field(7)
+		r.locations["result_date"] = hl7Location{obr, 7}
+	}
+	if r.ResultDate == "" {
+		return
+	}
+	t, dateOnly, err := hl7.ParseTime(r.ResultDate, time.Local)
+	switch {
+	case err != nil:
+	case dateOnly:
+		r.ResultDate = t.Format("2006-01-02")
+	default:
+		r.ResultDate = t.Format(time.RFC3339)
+	}
+}
+
+// Errors returns the validation errors of the result as errors at the fields of the message they were taken from
+func (r *HL7Result) Errors(validationErrors map[string]string) []hl7.Error {
+	fields := make([]string, 0, len(validationErrors))
+	for field := range validationErrors {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	values := map[string]string{"patient_id": r.PatientID, "mtb": r.MTB, "rr": r.RR,
+		"result_date": r.ResultDate, "facility_dhis2_id": r.FacilityID}
+	var errs []hl7.Error
+	for _, field := range fields {
+		e := hl7.Error{Code: hl7.ErrTableValueNotFound, Message: validationErrors[field]}
+		switch {
+		case values[field] == "":
+			e.Code = hl7.ErrRequiredFieldMissing
+		case field == "result_date" || field == "patient_id":
+			e.Code = hl7.ErrDataType
+		}
+		if location, ok := r.locations[field]; ok {
+			e.Segment, e.Sequence, e.Field = location.segment.Name, location.segment.Sequence, location.field
+		}
+		errs = append(errs, e)
+	}
+	return errs
+}
+
+// hl7PatientID returns the medical record number of PID-3, or else its first identifier
+func hl7PatientID(pid *hl7.Segment) string {
+	id := ""
+	for _, cx := range pid.Repetitions(3) {
+		if pid.RepetitionComponent(cx, 5) == "MR" {
+			return pid.RepetitionComponent(cx, 1)
+		}
+		if id == "" {
+			id = pid.RepetitionComponent(cx, 1)
+		}
+	}
+	return id
+}
+
+// hl7Facility returns the DHIS2 UID of the sending facility of MSH-4, either configured in hl7_facilities for
+// its namespace or universal id, or given as one of them
+func hl7Facility(msh *hl7.Segment) string {
+	candidates := []string{msh.Component(4, 2), msh.Component(4, 1)}
+	for _, candidate := range candidates {
+		if uid, ok := config.RTCGwConf.API.HL7Facilities[strings.ToLower(candidate)]; ok && candidate != "" {
+			return uid
+		}
+	}
+	for _, candidate := range candidates {
+		if candidate != "" && utils.IsDHIS2UID(candidate) {
+			return candidate
+		}
+	}
+	return msh.Component(4, 1)
+}
+
+// hl7HasCode returns true if the identifier or alternate identifier of the observation (OBX-3) is code
+func hl7HasCode(obx *hl7.Segment, code string) bool {
+	return code != "" && (strings.EqualFold(obx.Component(3, 1), code) || strings.EqualFold(obx.Component(3, 4), code))
+}
+
+// hl7ObservationValue returns the text of a coded observation value (OBX-5), or else its code or string value
+func hl7ObservationValue(obx *hl7.Segment) string {
+	switch obx.Field(2) {
+	case "CE", "CWE", "CNE":
+		if text := obx.Component(5, 2); text != "" {
+			return text
+		}
+		return obx.Component(5, 1)
+	}
+	return obx.Value(5)
+}
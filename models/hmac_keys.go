@@ -0,0 +1,121 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"rtcgw/db"
+	"rtcgw/utils"
+	"time"
+)
+
+// HMACKey is a shared secret with which a machine client signs its requests
+type HMACKey struct {
+	ID         int64      `db:"id" json:"id"`
+	UserID     int64      `db:"user_id" json:"-"`
+	KeyID      string     `db:"key_id" json:"key_id"`
+	Secret     string     `db:"secret" json:"-"`
+	IsActive   bool       `db:"is_active" json:"is_active"`
+	LastUsedAt *time.Time `db:"last_used_at" json:"last_used_at"`
+	Created    *time.Time `db:"created" json:"created"`
+	Updated    *time.Time `db:"updated" json:"updated"`
+}
+
+// NewHMACKey generates a key id and secret for the user
+func NewHMACKey(userID int64) (*HMACKey, error) {
+	secret, err := GenerateToken()
+	if err != nil {
+		return nil, err
+	}
+	return &HMACKey{
+		UserID:   userID,
+		KeyID:    utils.GenerateUID(),
+		Secret:   secret,
+		IsActive: true,
+	}, nil
+}
+
+// Save inserts the key
+func (k *HMACKey) Save() error {
+	return db.GetDB().QueryRowx(`INSERT INTO hmac_keys (user_id, key_id, secret, is_active)
+		VALUES ($1, $2, $3, $4) RETURNING id, created, updated`, k.UserID, k.KeyID, k.Secret, k.IsActive).
+		Scan(&k.ID, &k.Created, &k.Updated)
+}
+
+// Revoke deactivates the key
+func (k *HMACKey) Revoke() error {
+	_, err := db.GetDB().Exec(`UPDATE hmac_keys SET is_active = FALSE, updated = NOW() WHERE id = $1`, k.ID)
+	if err == nil {
+		k.IsActive = false
+	}
+	return err
+}
+
+// RevokeHMACKeys deactivates all the user's HMAC keys
+func (u *User) RevokeHMACKeys() {
+	_, err := db.GetDB().Exec(`UPDATE hmac_keys SET is_active = FALSE, updated = NOW()
+		WHERE user_id = $1 AND is_active`, u.ID)
+	if err != nil {
+		log.WithError(err).Error("Failed to revoke user HMAC keys")
+	}
+}
+
+// MarkUsed records when the key was last used
+func (k *HMACKey) MarkUsed() {
+	_, err := db.GetDB().Exec(`UPDATE hmac_keys SET last_used_at = NOW() WHERE id = $1`, k.ID)
+	if err != nil {
+		log.WithError(err).Error("Failed to update HMAC key usage")
+	}
+}
+
+// Sign returns the base64 encoded HMAC-SHA256 signature of a request made with the key
+func (k *HMACKey) Sign(method, path, timestamp, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(k.Secret))
+	mac.Write([]byte(HMACStringToSign(method, path, timestamp, nonce, body)))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks signature against the one computed for the request
+func (k *HMACKey) Verify(signature, method, path, timestamp, nonce string, body []byte) bool {
+	expected := k.Sign(method, path, timestamp, nonce, body)
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+// HMACStringToSign returns the string signed by machine clients:
+// the method, path, timestamp, nonce and hex encoded SHA-256 digest of the body separated by newlines
+func HMACStringToSign(method, path, timestamp, nonce string, body []byte) string {
+	digest := sha256.Sum256(body)
+	return fmt.Sprintf("%s\n%s\n%s\n%s\n%s", method, path, timestamp, nonce, hex.EncodeToString(digest[:]))
+}
+
+// GetActiveHMACKey returns the active key with keyID if it belongs to an active user
+func GetActiveHMACKey(keyID string) (*HMACKey, error) {
+	var k HMACKey
+	err := db.GetDB().Get(&k, `SELECT k.* FROM hmac_keys k
+            INNER JOIN users u ON u.id = k.user_id
+        WHERE k.key_id = $1 AND k.is_active = TRUE AND u.is_active = TRUE`, keyID)
+	if err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+// GetUserHMACKeys returns all the keys of the user
+func GetUserHMACKeys(userID int64) ([]HMACKey, error) {
+	keys := []HMACKey{}
+	err := db.GetDB().Select(&keys, `SELECT * FROM hmac_keys WHERE user_id = $1 ORDER BY created DESC`, userID)
+	return keys, err
+}
+
+// GetUserHMACKey returns the key with keyID if it belongs to the user
+func GetUserHMACKey(userID int64, keyID string) (*HMACKey, error) {
+	var k HMACKey
+	err := db.GetDB().Get(&k, `SELECT * FROM hmac_keys WHERE user_id = $1 AND key_id = $2`, userID, keyID)
+	if err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
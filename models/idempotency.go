@@ -0,0 +1,67 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"rtcgw/config"
+	"rtcgw/db"
+	"time"
+)
+
+// IdempotentRequest is the stored response to a submission, replayed when the submission is repeated
+type IdempotentRequest struct {
+	ID             int64      `db:"id"`
+	UserID         int64      `db:"user_id"`
+	Route          string     `db:"route"`
+	IdempotencyKey string     `db:"idempotency_key"`
+	RequestHash    string     `db:"request_hash"`
+	Status         int        `db:"status"`
+	ResponseBody   string     `db:"response_body"`
+	Created        *time.Time `db:"created"`
+}
+
+// IdempotencyRetention returns how long responses to submissions are kept for replay
+func IdempotencyRetention() time.Duration {
+	return time.Duration(config.RTCGwConf.Server.IdempotencyRetentionHours) * time.Hour
+}
+
+// RequestHash returns the hex encoded SHA-256 hash identifying a request by its method, path and body
+func RequestHash(method, path string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(method + "\n" + path + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Save stores the response. A response already stored under the same key is kept
+func (r *IdempotentRequest) Save() error {
+	_, err := db.GetDB().NamedExec(`INSERT INTO idempotent_requests
+			(user_id, route, idempotency_key, request_hash, status, response_body)
+		VALUES (:user_id, :route, :idempotency_key, :request_hash, :status, :response_body)
+		ON CONFLICT (user_id, route, idempotency_key) DO NOTHING`, r)
+	return err
+}
+
+// GetIdempotentRequest returns the response stored within the retention window for the user's submission
+// to route under key, nil if there is none
+func GetIdempotentRequest(userID int64, route, key string) (*IdempotentRequest, error) {
+	requests := []IdempotentRequest{}
+	err := db.GetDB().Select(&requests, `SELECT * FROM idempotent_requests
+		WHERE user_id = $1 AND route = $2 AND idempotency_key = $3
+			AND created > NOW() - make_interval(secs => $4)`,
+		userID, route, key, IdempotencyRetention().Seconds())
+	if err != nil || len(requests) == 0 {
+		return nil, err
+	}
+	return &requests[0], nil
+}
+
+// PurgeIdempotentRequests removes the responses older than the retention window
+func PurgeIdempotentRequests() (int64, error) {
+	res, err := db.GetDB().Exec(`DELETE FROM idempotent_requests WHERE created < NOW() - make_interval(secs => $1)`,
+		IdempotencyRetention().Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
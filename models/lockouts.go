@@ -0,0 +1,147 @@
+package models
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"rtcgw/config"
+	"rtcgw/db"
+	"time"
+)
+
+// LockoutError is returned when a login is refused because the user or source IP address is locked out
+type LockoutError struct {
+	Until time.Time
+}
+
+func (e *LockoutError) Error() string {
+	return fmt.Sprintf("locked out until %s", e.Until.Format(time.RFC3339))
+}
+
+// IPLockout tracks failed logins from a source IP address
+type IPLockout struct {
+	IP             string     `db:"ip" json:"ip"`
+	FailedAttempts string     `db:"failed_attempts" json:"failed_attempts"`
+	LockoutCount   int        `db:"lockout_count" json:"lockout_count"`
+	LockedUntil    *time.Time `db:"locked_until" json:"locked_until"`
+	Created        *time.Time `db:"created" json:"created"`
+	Updated        *time.Time `db:"updated" json:"updated"`
+}
+
+// lockoutDuration doubles the configured lockout duration for every lockout after the first
+func lockoutDuration(lockoutCount int) time.Duration {
+	maxDuration := time.Duration(config.RTCGwConf.Security.MaxLockoutMinutes) * time.Minute
+	duration := time.Duration(config.RTCGwConf.Security.LockoutMinutes) * time.Minute
+	for i := 1; i < lockoutCount && duration < maxDuration; i++ {
+		duration *= 2
+	}
+	if duration > maxDuration {
+		duration = maxDuration
+	}
+	return duration
+}
+
+// IPLockedUntil returns the time until which logins from ip are refused, nil if ip is not locked out
+func IPLockedUntil(ip string) *time.Time {
+	var lockedUntil *time.Time
+	err := db.GetDB().Get(&lockedUntil, `SELECT locked_until FROM ip_lockouts
+		WHERE ip = $1 AND locked_until > NOW()`, ip)
+	if err != nil {
+		return nil
+	}
+	return lockedUntil
+}
+
+// RecordFailedLogin counts a failed login against the user, if known, and the source ip.
+// Reaching the configured number of failed attempts locks the user or ip out
+func RecordFailedLogin(userID int64, ip string) {
+	dbConn := db.GetDB()
+	var failedAttempts string
+	var lockoutCount int
+	if userID > 0 {
+		err := dbConn.QueryRowx(fmt.Sprintf(`UPDATE users SET failed_attempts = %s
+			WHERE id = $1 RETURNING failed_attempts, lockout_count`, counterIncrement("failed_attempts", "'YYYYmmdd'", "1")),
+			userID).Scan(&failedAttempts, &lockoutCount)
+		if err != nil {
+			log.WithError(err).Error("Failed to record failed login for user")
+		} else if count, _ := ParseCounter(failedAttempts); count >= config.RTCGwConf.Security.MaxFailedAttempts {
+			duration := lockoutDuration(lockoutCount + 1)
+			_, err = dbConn.Exec(`UPDATE users SET lockout_count = lockout_count + 1,
+				locked_until = NOW() + make_interval(secs => $1), failed_attempts = '0/' || to_char(NOW(), 'YYYYmmdd')
+				WHERE id = $2`, duration.Seconds(), userID)
+			if err != nil {
+				log.WithError(err).Error("Failed to lock out user")
+			}
+			log.WithFields(log.Fields{"user": userID, "duration": duration}).Warn("User locked out after failed logins")
+		}
+	}
+
+	err := dbConn.QueryRowx(fmt.Sprintf(`INSERT INTO ip_lockouts (ip, failed_attempts)
+		VALUES ($1, '1/' || to_char(NOW(), 'YYYYmmdd'))
+		ON CONFLICT (ip) DO UPDATE SET failed_attempts = %s, updated = NOW()
+		RETURNING failed_attempts, lockout_count`, counterIncrement("ip_lockouts.failed_attempts", "'YYYYmmdd'", "1")),
+		ip).Scan(&failedAttempts, &lockoutCount)
+	if err != nil {
+		log.WithError(err).Error("Failed to record failed login for IP address")
+		return
+	}
+	if count, _ := ParseCounter(failedAttempts); count >= config.RTCGwConf.Security.MaxFailedAttempts {
+		duration := lockoutDuration(lockoutCount + 1)
+		_, err = dbConn.Exec(`UPDATE ip_lockouts SET lockout_count = lockout_count + 1,
+			locked_until = NOW() + make_interval(secs => $1), failed_attempts = '0/' || to_char(NOW(), 'YYYYmmdd'),
+			updated = NOW()
+			WHERE ip = $2`, duration.Seconds(), ip)
+		if err != nil {
+			log.WithError(err).Error("Failed to lock out IP address")
+		}
+		log.WithFields(log.Fields{"ip": ip, "duration": duration}).Warn("IP address locked out after failed logins")
+	}
+}
+
+// RecordSuccessfulLogin updates the user's last_login and resets their failed attempts. The failed attempts of the
+// source IP address are left to expire with the day, so that logging in with one valid account between guesses
+// at others does not avoid the IP lockout
+func RecordSuccessfulLogin(userID int64) {
+	_, err := db.GetDB().Exec(`UPDATE users SET last_login = NOW(), lockout_count = 0, locked_until = NULL,
+		failed_attempts = '0/' || to_char(NOW(), 'YYYYmmdd') WHERE id = $1`, userID)
+	if err != nil {
+		log.WithError(err).Error("Failed to record successful login")
+	}
+}
+
+// ClearLockout unlocks the user and resets their failed attempts
+func (u *User) ClearLockout() error {
+	_, err := db.GetDB().Exec(`UPDATE users SET lockout_count = 0, locked_until = NULL,
+		failed_attempts = '0/' || to_char(NOW(), 'YYYYmmdd'), updated = NOW() WHERE id = $1`, u.ID)
+	if err == nil {
+		u.LockedUntil = nil
+	}
+	return err
+}
+
+// ClearIPLockout removes the failed login record of ip, returning false if there was none
+func ClearIPLockout(ip string) (bool, error) {
+	res, err := db.GetDB().Exec(`DELETE FROM ip_lockouts WHERE ip = $1`, ip)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// GetLockedUsers returns the users that are currently locked out
+func GetLockedUsers() ([]User, error) {
+	users := []User{}
+	err := db.GetDB().Select(&users, `SELECT
+            id, uid, username, firstname, lastname , telephone, email, created, updated, is_active, is_system_user,
+            user_role, last_login, locked_until, cert_subject, must_change_password, password_changed
+        FROM users WHERE locked_until > NOW() ORDER BY locked_until DESC`)
+	return users, err
+}
+
+// GetLockedIPs returns the source IP addresses that are currently locked out
+func GetLockedIPs() ([]IPLockout, error) {
+	ips := []IPLockout{}
+	err := db.GetDB().Select(&ips, `SELECT * FROM ip_lockouts WHERE locked_until > NOW()
+		ORDER BY locked_until DESC`)
+	return ips, err
+}
@@ -0,0 +1,190 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/buger/jsonparser"
+	"github.com/goccy/go-json"
+	"rtcgw/clients"
+	"rtcgw/config"
+	"rtcgw/db"
+	"time"
+)
+
+// Statuses of a missing client
+const (
+	MissingClientPending = "pending"
+	MissingClientMatched = "matched"
+)
+
+// MissingClient is a patient whose results were received without a sync_log row, e.g. because they were
+// registered directly in DHIS2 or before the gateway went live
+type MissingClient struct {
+	ID             int64      `db:"id" json:"id"`
+	ECHISID        string     `db:"echis_id" json:"echis_patient_id"`
+	FacilityID     string     `db:"facility_id" json:"facility_id"`
+	Status         string     `db:"status" json:"status"`
+	SearchAttempts int        `db:"search_attempts" json:"search_attempts"`
+	LastError      string     `db:"last_error" json:"last_error,omitempty"`
+	LastSearched   *time.Time `db:"last_searched" json:"last_searched"`
+	Results        string     `db:"results" json:"-"` // JSON array of the results received for the client
+	Created        *time.Time `db:"created" json:"created"`
+	Updated        *time.Time `db:"updated" json:"updated"`
+}
+
+// RecordMissingClient records that result was received for a patient without a sync_log row, so that the patient
+// is searched for in DHIS2. The result is kept, to be queued again once the patient is found
+func RecordMissingClient(result LabXpertResult) error {
+	payload, err := json.Marshal([]LabXpertResult{result})
+	if err != nil {
+		return err
+	}
+	_, err = db.GetDB().Exec(`INSERT INTO missing_clients (echis_id, facility_id, results) VALUES ($1, $2, $3)
+		ON CONFLICT (echis_id) DO UPDATE SET facility_id = EXCLUDED.facility_id, status = $4, updated = NOW(),
+			results = CASE WHEN missing_clients.results @> EXCLUDED.results THEN missing_clients.results
+				ELSE missing_clients.results || EXCLUDED.results END`,
+		result.PatientID, result.FacilityID, string(payload), MissingClientPending)
+	return err
+}
+
+// PendingResults returns the results received for the missing client that have not been queued again
+func (m *MissingClient) PendingResults() ([]LabXpertResult, error) {
+	results := []LabXpertResult{}
+	if m.Results == "" {
+		return results, nil
+	}
+	err := json.Unmarshal([]byte(m.Results), &results)
+	return results, err
+}
+
+// ClearResults records that the results received for the missing client have been queued again
+func (m *MissingClient) ClearResults() error {
+	_, err := db.GetDB().Exec(`UPDATE missing_clients SET results = '[]', updated = NOW() WHERE id = $1`, m.ID)
+	if err == nil {
+		m.Results = "[]"
+	}
+	return err
+}
+
+// GetMissingClients returns the missing clients with the given status, all of them if status is empty
+func GetMissingClients(status string) ([]MissingClient, error) {
+	missing := []MissingClient{}
+	err := db.GetDB().Select(&missing, `SELECT * FROM missing_clients WHERE $1 = '' OR status = $1
+		ORDER BY last_searched NULLS FIRST, id`, status)
+	return missing, err
+}
+
+// GetMissingClient returns the missing client with the given id
+func GetMissingClient(id int64) (*MissingClient, error) {
+	missing := MissingClient{}
+	err := db.GetDB().Get(&missing, `SELECT * FROM missing_clients WHERE id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+	return &missing, nil
+}
+
+// Backfill searches DHIS2 for the tracked entity of the missing client by the configured search attribute, in all
+// the org units accessible to the DHIS2 user since the client may be registered at another facility than the lab.
+// If the tracked entity and its screening event are found, the missing sync_log row is created and the client
+// is marked matched, for their PendingResults to be queued again. Otherwise the reason is recorded in LastError
+func (m *MissingClient) Backfill() (bool, error) {
+	err := m.backfill()
+	var searchErr *missingClientError
+	switch {
+	case err == nil:
+		m.Status, m.LastError = MissingClientMatched, ""
+	case errors.As(err, &searchErr):
+		m.LastError = err.Error()
+	default:
+		return false, err
+	}
+	m.SearchAttempts++
+	err = db.GetDB().QueryRowx(`UPDATE missing_clients SET status = $1, last_error = $2,
+			search_attempts = search_attempts + 1, last_searched = NOW(), updated = NOW()
+		WHERE id = $3 RETURNING last_searched, updated`, m.Status, m.LastError, m.ID).
+		Scan(&m.LastSearched, &m.Updated)
+	return m.Status == MissingClientMatched, err
+}
+
+// missingClientError is the reason a missing client could not be matched in DHIS2
+type missingClientError struct {
+	reason string
+}
+
+func (e *missingClientError) Error() string {
+	return e.reason
+}
+
+func (m *MissingClient) backfill() error {
+	syncLog, err := GetSyncLogByECHISID(m.ECHISID)
+	if err != nil {
+		return err
+	}
+	if syncLog != nil {
+		// the client has since been registered through the gateway
+		return nil
+	}
+	instances, err := SearchTE(clients.Dhis2Client, m.ECHISID, "", config.RTCGwConf.API.DHIS2TrackerProgram)
+	if err != nil {
+		return err
+	}
+	if len(instances) == 0 {
+		return &missingClientError{fmt.Sprintf("no tracked entity with echis_patient_id %s in DHIS2", m.ECHISID)}
+	}
+	te := instances[0]
+	event, eventDate, err := screeningEvent(te.TrackedEntity)
+	if err != nil {
+		return err
+	}
+	if event == "" {
+		return &missingClientError{fmt.Sprintf("tracked entity %s has no screening event in DHIS2", te.TrackedEntity)}
+	}
+	syncLog = &SyncLog{
+		ECHISID:       m.ECHISID,
+		EventID:       event,
+		EventDate:     eventDate,
+		TrackedEntity: te.TrackedEntity,
+		OrgUnit:       te.OrgUnit,
+	}
+	return syncLog.Save()
+}
+
+// screeningEvent returns the latest event of the tracked entity in the tracker program stage and its date
+func screeningEvent(trackedEntity string) (string, sql.NullTime, error) {
+	params := map[string]string{
+		"trackedEntity": trackedEntity,
+		"program":       config.RTCGwConf.API.DHIS2TrackerProgram,
+		"programStage":  config.RTCGwConf.API.DHIS2TrackerProgramStage,
+		"fields":        "event,occurredAt",
+		"order":         "occurredAt:desc",
+		"pageSize":      "1",
+	}
+	resp, err := clients.Dhis2Client.GetResource("/tracker/events", params)
+	if err != nil {
+		return "", sql.NullTime{}, err
+	}
+	if !resp.IsSuccess() {
+		return "", sql.NullTime{}, fmt.Errorf("failed to get screening event from DHIS2: %s", resp.Status())
+	}
+	v, _, _, err := jsonparser.Get(resp.Body(), "instances")
+	if err != nil {
+		return "", sql.NullTime{}, err
+	}
+	var events []struct {
+		Event      string `json:"event"`
+		OccurredAt string `json:"occurredAt"`
+	}
+	if err := json.Unmarshal(v, &events); err != nil {
+		return "", sql.NullTime{}, err
+	}
+	if len(events) == 0 {
+		return "", sql.NullTime{}, nil
+	}
+	eventDate := sql.NullTime{}
+	if t, err := time.Parse("2006-01-02T15:04:05.000", events[0].OccurredAt); err == nil {
+		eventDate = sql.NullTime{Time: t, Valid: true}
+	}
+	return events[0].Event, eventDate, nil
+}
@@ -0,0 +1,116 @@
+package models
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"rtcgw/config"
+	"rtcgw/db"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ValidatePassword checks password against the configured password policy
+func ValidatePassword(password string) error {
+	policy := config.RTCGwConf.Security
+	var problems []string
+	if len([]rune(password)) < policy.PasswordMinLength {
+		problems = append(problems, fmt.Sprintf("be at least %d characters long", policy.PasswordMinLength))
+	}
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r):
+			hasSymbol = true
+		}
+	}
+	if policy.PasswordRequireUpper && !hasUpper {
+		problems = append(problems, "contain an uppercase letter")
+	}
+	if policy.PasswordRequireLower && !hasLower {
+		problems = append(problems, "contain a lowercase letter")
+	}
+	if policy.PasswordRequireDigit && !hasDigit {
+		problems = append(problems, "contain a digit")
+	}
+	if policy.PasswordRequireSymbol && !hasSymbol {
+		problems = append(problems, "contain a symbol")
+	}
+	if len(problems) > 0 {
+		return errors.New("password must " + strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// CheckPassword returns true if password matches the user's password or their unexpired one-time password
+func (u *User) CheckPassword(password string) (bool, error) {
+	var matches bool
+	err := db.GetDB().Get(&matches, `SELECT password = crypt($2, password)
+			OR (onetime_password IS NOT NULL AND onetime_password_expiry > NOW()
+				AND onetime_password = crypt($2, onetime_password))
+		FROM users WHERE id = $1`, u.ID, password)
+	return matches, err
+}
+
+// SetPassword changes the user's password, clearing any one-time password, and deactivates all their API tokens
+// and HMAC keys
+func (u *User) SetPassword(password string) error {
+	_, err := db.GetDB().Exec(`UPDATE users SET password = crypt($1, gen_salt('bf')),
+			onetime_password = NULL, onetime_password_expiry = NULL, must_change_password = FALSE,
+			password_changed = NOW(), updated = NOW()
+		WHERE id = $2`, password, u.ID)
+	if err != nil {
+		return err
+	}
+	u.MustChangePassword = false
+	u.DeactivateAPITokens("")
+	u.RevokeHMACKeys()
+	return nil
+}
+
+// IssueOnetimePassword generates a one-time password for the user, valid for the configured number of hours.
+// Their current password is replaced with a random one, so that only the one-time password can be used to log in.
+// The user must change their password on their next login and their API tokens and HMAC keys are deactivated
+func (u *User) IssueOnetimePassword() (string, *time.Time, error) {
+	password, err := generateOnetimePassword(12)
+	if err != nil {
+		return "", nil, err
+	}
+	var expiry time.Time
+	err = db.GetDB().QueryRowx(`UPDATE users SET password = crypt(encode(gen_random_bytes(32), 'hex'), gen_salt('bf')),
+			onetime_password = crypt($1, gen_salt('bf')),
+			onetime_password_expiry = NOW() + make_interval(hours => $2), must_change_password = TRUE,
+			updated = NOW()
+		WHERE id = $3 RETURNING onetime_password_expiry`,
+		password, config.RTCGwConf.Security.OnetimePasswordHours, u.ID).Scan(&expiry)
+	if err != nil {
+		return "", nil, err
+	}
+	u.MustChangePassword = true
+	u.DeactivateAPITokens("")
+	u.RevokeHMACKeys()
+	return password, &expiry, nil
+}
+
+// onetimePasswordChars excludes characters that are easily confused when read out e.g. 0 and O
+const onetimePasswordChars = "ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz23456789"
+
+func generateOnetimePassword(length int) (string, error) {
+	password := make([]byte, length)
+	for i := range password {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(onetimePasswordChars))))
+		if err != nil {
+			return "", err
+		}
+		password[i] = onetimePasswordChars[n.Int64()]
+	}
+	return string(password), nil
+}
@@ -0,0 +1,122 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"rtcgw/db"
+	"time"
+)
+
+// Transaction windows over which users.transaction_cap applies
+const (
+	TransactionWindowDaily  = "daily"
+	TransactionWindowHourly = "hourly"
+)
+
+// transactionPeriodFormat is the SQL expression formatting the current period of a user's transaction window
+const transactionPeriodFormat = `CASE WHEN transaction_window = 'hourly' THEN 'YYYYmmddHH24' ELSE 'YYYYmmdd' END`
+
+// transactionUsageColumns are the columns selected into TransactionUsage
+const transactionUsageColumns = `id, uid, username, transaction_cap, transaction_window, transaction_limit,
+	to_char(NOW(), ` + transactionPeriodFormat + `) AS current_period,
+	EXTRACT(EPOCH FROM date_trunc(CASE WHEN transaction_window = 'hourly' THEN 'hour' ELSE 'day' END, NOW())
+		+ CASE WHEN transaction_window = 'hourly' THEN INTERVAL '1 hour' ELSE INTERVAL '1 day' END - NOW()) AS reset_in`
+
+// TransactionUsage is a user's submission count in the current transaction window
+type TransactionUsage struct {
+	UserID            int64   `db:"id" json:"-"`
+	UID               string  `db:"uid" json:"uid"`
+	Username          string  `db:"username" json:"username"`
+	TransactionCap    *int    `db:"transaction_cap" json:"transaction_cap"`
+	TransactionWindow string  `db:"transaction_window" json:"transaction_window"`
+	TransactionLimit  *string `db:"transaction_limit" json:"-"`
+	CurrentPeriod     string  `db:"current_period" json:"period"`
+	ResetIn           float64 `db:"reset_in" json:"-"`
+	Used              int     `db:"-" json:"used"`
+	Remaining         *int    `db:"-" json:"remaining"`
+	Rejected          bool    `db:"-" json:"-"` // set when submissions were not counted as they would exceed the cap
+}
+
+// computeUsage derives Used and Remaining from the transaction_limit counter
+func (t *TransactionUsage) computeUsage() {
+	t.Used = 0
+	if t.TransactionLimit != nil {
+		if count, period := ParseCounter(*t.TransactionLimit); period == t.CurrentPeriod {
+			t.Used = count
+		}
+	}
+	t.Remaining = nil
+	if t.HasCap() {
+		remaining := *t.TransactionCap - t.Used
+		if remaining < 0 {
+			remaining = 0
+		}
+		t.Remaining = &remaining
+	}
+}
+
+// HasCap returns true if the user's submissions are capped
+func (t *TransactionUsage) HasCap() bool {
+	return t.TransactionCap != nil && *t.TransactionCap > 0
+}
+
+// RetryAfter returns the time left until the current transaction window ends
+func (t *TransactionUsage) RetryAfter() time.Duration {
+	return time.Duration(t.ResetIn * float64(time.Second))
+}
+
+// ConsumeTransactionQuota counts n submissions against the user's transaction cap and returns the resulting usage.
+// Submissions that would exceed the cap are not counted at all, and the current usage is returned with Rejected set,
+// so that a rejected batch does not use up the rest of the window
+func ConsumeTransactionQuota(userID int64, n int) (*TransactionUsage, error) {
+	usage := TransactionUsage{}
+	err := db.GetDB().QueryRowx(fmt.Sprintf(`UPDATE users SET transaction_limit = %s
+		WHERE id = $1 AND (COALESCE(transaction_cap, 0) <= 0 OR %s <= transaction_cap)
+		RETURNING %s`, counterIncrement("transaction_limit", transactionPeriodFormat, "$2"),
+		counterNext("transaction_limit", transactionPeriodFormat, "$2"), transactionUsageColumns),
+		userID, n).StructScan(&usage)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = db.GetDB().QueryRowx(`SELECT `+transactionUsageColumns+` FROM users WHERE id = $1`, userID).
+			StructScan(&usage)
+		usage.Rejected = err == nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	usage.computeUsage()
+	return &usage, nil
+}
+
+// GetTransactionUsage returns the usage of the user identified by uid
+func GetTransactionUsage(uid string) (*TransactionUsage, error) {
+	usage := TransactionUsage{}
+	err := db.GetDB().QueryRowx(`SELECT `+transactionUsageColumns+` FROM users WHERE uid = $1`, uid).
+		StructScan(&usage)
+	if err != nil {
+		return nil, err
+	}
+	usage.computeUsage()
+	return &usage, nil
+}
+
+// GetTransactionUsages returns the usage of all active users
+func GetTransactionUsages() ([]TransactionUsage, error) {
+	usages := []TransactionUsage{}
+	err := db.GetDB().Select(&usages, `SELECT `+transactionUsageColumns+` FROM users
+		WHERE is_active = TRUE ORDER BY username`)
+	if err != nil {
+		return nil, err
+	}
+	for i := range usages {
+		usages[i].computeUsage()
+	}
+	return usages, nil
+}
+
+// SetTransactionQuota sets the user's transaction cap and window. A cap of 0 removes the cap
+func (u *User) SetTransactionQuota(transactionCap int, window string) error {
+	_, err := db.GetDB().Exec(`UPDATE users SET transaction_cap = NULLIF($1, 0), transaction_window = $2,
+		updated = NOW() WHERE id = $3`, transactionCap, window, u.ID)
+	return err
+}
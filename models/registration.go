@@ -10,50 +10,38 @@ import (
 	"rtcgw/config"
 	"rtcgw/models/tracker"
 	"rtcgw/utils"
+	"strings"
 	"time"
 )
 
-type ECHISRequest struct {
-	ECHISID             string `use_as:"attr" json:"echis_patient_id" binding:"required"`
-	NIN                 string `use_as:"attr" json:"national_identification_number" binding:"omitempty,ugandaNIN"`
-	Name                string `use_as:"attr" json:"patient_name" binding:"required"`
-	Sex                 string `use_as:"attr" json:"patient_gender" binding:"omitempty,maleFemale"`
-	FacilityID          string `use_as:"" json:"facility_id"`
-	FacilityDHIS2ID     string `use_as:"" json:"facility_dhis2_id" binding:"required,dhis2UID"`
-	PatientPhone        string `use_as:"attr" json:"patient_phone"`
-	PatientCategory     string `use_as:"attr" json:"patient_category"`
-	PatientAgeInYears   string `use_as:"attr" json:"patient_age_in_years"`
-	PatientAgeInMonths  string `use_as:"attr" json:"patient_age_in_months,omitempty"`
-	PatientAgeInDays    string `use_as:"attr" json:"patient_age_in_days,omitempty"`
-	ClientCategory      string `use_as:"attr" json:"client_category,omitempty"`
-	Cough               string `use_as:"de" json:"cough,omitempty" binding:"omitempty,yesNo"`
-	Fever               string `use_as:"de" json:"fever,omitempty" binding:"omitempty,yesNo"`
-	WeightLoss          string `use_as:"de" json:"weight_loss,omitempty" binding:"omitempty,yesNo"`
-	ExcessiveNightSweat string `use_as:"de" json:"excessive_night_sweat,omitempty" binding:"omitempty,yesNo"`
-	IsOnTBTreatment     string `use_as:"de" json:"is_on_tb_treatment,omitempty" binding:"omitempty,yesNo"`
-	PoorWeightGain      string `use_as:"de" json:"poor_weight_gain,omitempty"`
-}
-
 // FormatValidationError translates validation errors
 func FormatValidationError(err error) map[string]string {
 	errors := make(map[string]string)
 
 	if validationErrors, ok := err.(validator.ValidationErrors); ok {
 		for _, e := range validationErrors {
+			if strings.HasPrefix(e.StructNamespace(), "ECHISRequest.") {
+				field, _ := schemaField(ECHISSchema(), e.Field())
+				field.Name = e.Field()
+				errors[e.Field()] = schemaValidationMessage(field, e.Tag())
+				continue
+			}
 			// Customize messages for required fields
 			switch e.Field() {
-			case "echis_parent_id":
-				errors["echis_parent_id"] = "echis_patient_id is required and cannot be empty."
 			case "facility_dhis2_id":
 				errors["facility_dhis2_id"] = "facility_dhis2_id must be a valid DHIS2 UID."
-			case "patient_name":
-				errors[e.Field()] = "patient_name is required and must be provided."
-			case "national_identification_number":
-				errors["national_identification_number"] = "invalid national_identification_number provided."
-			case "patient_gender":
-				errors["patient_gender"] = "patient_gender should be Male or Female"
-			case "fever", "cough", "weight_loss", "excessive_night_sweat":
-				errors[e.Field()] = fmt.Sprintf("Should be exactly 'Yes' or 'No'. Notice the case")
+			case "patient_id":
+				errors["patient_id"] = "patient_id is required and cannot be empty."
+			case "mtb":
+				errors["mtb"] = fmt.Sprintf("mtb should be one of %s", strings.Join(utils.MTBResults, ", "))
+			case "rr":
+				if e.Tag() == "required_with_detected_mtb" {
+					errors["rr"] = "rr is required when MTB is detected."
+				} else {
+					errors["rr"] = fmt.Sprintf("rr should be one of %s", strings.Join(utils.RRResults, ", "))
+				}
+			case "result_date":
+				errors["result_date"] = "result_date should be a date like 2025-01-27 13:08:27 and not in the future."
 			default:
 
 				errors[e.Field()] = fmt.Sprintf("Validation failed on '%s' condition", e.Tag())
@@ -64,50 +52,11 @@ func FormatValidationError(err error) map[string]string {
 	return errors
 }
 
-func (r ECHISRequest) SaveClient(client *clients.Client) {
-	attr := utils.GetFieldsByTag(r, "attr")
-	des := utils.GetFieldsByTag(r, "de")
-
-	attributesConf, exists := config.RTCGwConf.API.DHIS2Mapping["attributes"]
-	if !exists {
-		log.Infof("DHIS2Mapping not found for attributes in config")
-		return
-	}
-	var attributes []tracker.NestedAttribute
-	for k, v := range attributesConf {
-		if v == "" {
-			continue
-		}
-		val, e := attr[k]
-		if e {
-			attributes = append(attributes, tracker.NestedAttribute{
-				Attribute: v,
-				Value:     val,
-			})
-
-		}
-	}
-	log.Infof("attributes: %v", attributes)
-
-	dataElementsConf, exists := config.RTCGwConf.API.DHIS2Mapping["data_elements"]
-	var dataValues []tracker.DataValue
-	if !exists {
-		log.Infof("DHIS2Mapping not found for data_elements in config")
-		return
-	}
-	for k, v := range dataElementsConf {
-		if v == "" {
-			continue
-		}
-		val, e := des[k]
-		if e {
-			dataValues = append(dataValues, tracker.DataValue{
-				DataElement: v,
-				Value:       val,
-			})
-		}
-	}
-	log.Infof("dataElements: %v The des: %v", dataValues, des)
+// SaveClient creates the client as a tracked entity enrolled in the TB program in DHIS2.
+// A *ConflictError is returned if DHIS2 rejects the client
+func (r ECHISRequest) SaveClient(client *clients.Client) error {
+	attributes, dataValues := r.dhis2Values()
+	log.Infof("attributes: %v dataElements: %v", attributes, dataValues)
 	events := []tracker.NestedEvent{{
 		DataValues:   dataValues,
 		OrgUnit:      r.FacilityDHIS2ID,
@@ -138,13 +87,13 @@ func (r ECHISRequest) SaveClient(client *clients.Client) {
 	jsonData, err := json.MarshalIndent(nestedPayload, "", "  ")
 	if err != nil {
 		log.Infof("Error marshaling JSON: %v", err)
-		return
+		return err
 	}
 	log.Infof("JSON NestedPayload: %s", jsonData)
 	resp, err := client.PostResource("trackedEntityInstances", nil, nestedPayload)
 	if err != nil {
 		log.Infof("Error sending request: %v", err)
-		return
+		return err
 	}
 	// if resp status code is 200
 	if resp.IsSuccess() {
@@ -154,7 +103,7 @@ func (r ECHISRequest) SaveClient(client *clients.Client) {
 		err = json.Unmarshal(resp.Body(), &data)
 		if err != nil {
 			log.Infof("Error unmarshalling response: %v", err)
-			return
+			return err
 		}
 		trackedEntity, eventID, found, conflicts := data.GetTrackedEntityAndEventReferences()
 		if found {
@@ -175,54 +124,33 @@ func (r ECHISRequest) SaveClient(client *clients.Client) {
 			if conflictMsg != "" {
 				log.Infof("Conflicts during DHIS2 sync: %v", conflicts.Error())
 				synclog.SetECHISClientCreationErrors(conflicts.Error())
-				return
+				return &ConflictError{Conflicts: tracker.ConflictMessages(data.Response.AllConflicts())}
 			} else {
 				synclog.SetECHISClientCreationErrors("")
 			}
 			log.Infof("Event ID: %s", eventID)
 		} else {
 			log.Infof("Error retrieving Event Reference from response: %v", data.Response.ImportSummaries)
-			return
+			return &ConflictError{Conflicts: []string{"tracked entity and event references missing from DHIS2 response"}}
 		}
 		// print indented data
 		jsonData, err = json.MarshalIndent(data, "", "  ")
 		if err != nil {
 			log.Infof("Error marshaling JSON: %v", err)
-			return
+			return nil
 		}
 		log.Infof("JSON Response: %s", jsonData)
 
-		return
+		return nil
 	} else {
 		log.Infof("Error saving patient in DHIS2: %s", resp.Body())
-		return
+		return responseError(resp.StatusCode(), resp.Body())
 	}
 
 }
 
 func (r ECHISRequest) UpdateClient(client *clients.Client, syncLog *SyncLog) {
-	attr := utils.GetFieldsByTag(r, "attr")
-	des := utils.GetFieldsByTag(r, "de")
-
-	attributesConf, exists := config.RTCGwConf.API.DHIS2Mapping["attributes"]
-	if !exists {
-		log.Infof("DHIS2Mapping not found for attributes in config")
-		return
-	}
-	var attributes []tracker.NestedAttribute
-	for k, v := range attributesConf {
-		if v == "" {
-			continue
-		}
-		val, e := attr[k]
-		if e {
-			attributes = append(attributes, tracker.NestedAttribute{
-				Attribute: v,
-				Value:     val,
-			})
-
-		}
-	}
+	attributes, dataValues := r.forSyncLog(syncLog).dhis2Values()
 	// log.Infof("attributes: %v: >> %v", attributes, attr)
 	teUpdatePayload := tracker.TrackedEntityUpdatePayload{
 		TrackedEntityInstance: syncLog.TrackedEntity,
@@ -237,25 +165,7 @@ func (r ECHISRequest) UpdateClient(client *clients.Client, syncLog *SyncLog) {
 		log.Infof("Error updating trackedEntity attributes in DHIS2: %v: %v", err, string(resp.Body()))
 	}
 
-	dataElementsConf, exists := config.RTCGwConf.API.DHIS2Mapping["data_elements"]
-	var dataValues []tracker.DataValue
-	if !exists {
-		log.Infof("DHIS2Mapping not found for data_elements in config")
-		return
-	}
-	for k, v := range dataElementsConf {
-		if v == "" {
-			continue
-		}
-		val, e := des[k]
-		if e {
-			dataValues = append(dataValues, tracker.DataValue{
-				DataElement: v,
-				Value:       val,
-			})
-		}
-	}
-	log.Infof("dataElements: %v The des: %v", dataValues, des)
+	log.Infof("dataElements: %v", dataValues)
 	for _, v := range dataValues {
 		ep := tracker.EventUpdatePayload{
 			Event:         syncLog.EventID,
@@ -275,3 +185,116 @@ func (r ECHISRequest) UpdateClient(client *clients.Client, syncLog *SyncLog) {
 	}
 
 }
+
+// PatchClient updates the tracked entity attributes and screening event data values of the request's fields, and
+// only those, on the client recorded in syncLog. A *ConflictError is returned if DHIS2 rejects the update
+func (r ECHISRequest) PatchClient(client *clients.Client, syncLog *SyncLog) error {
+	attributes, dataValues := r.forSyncLog(syncLog).dhis2Values()
+	if len(attributes) > 0 {
+		// DHIS2 replaces all the attributes of a tracked entity on update, so the current attributes are sent
+		// together with the updated ones
+		var te struct {
+			OrgUnit    string                    `json:"orgUnit"`
+			Attributes []tracker.NestedAttribute `json:"attributes"`
+		}
+		teURL := fmt.Sprintf("trackedEntityInstances/%s", syncLog.TrackedEntity)
+		resp, err := client.GetResource(teURL, map[string]string{"fields": "orgUnit,attributes[attribute,value]"})
+		if err != nil {
+			return err
+		}
+		if !resp.IsSuccess() {
+			return responseError(resp.StatusCode(), resp.Body())
+		}
+		if err := json.Unmarshal(resp.Body(), &te); err != nil {
+			return err
+		}
+		teUpdatePayload := tracker.TrackedEntityUpdatePayload{
+			TrackedEntityInstance: syncLog.TrackedEntity,
+			TrackedEntityType:     config.RTCGwConf.API.DHIS2TrackedEntityType,
+			Attributes:            mergeAttributes(te.Attributes, attributes),
+			OrgUnit:               te.OrgUnit,
+		}
+		putURL := fmt.Sprintf("%s?program=%s", teURL, config.RTCGwConf.API.DHIS2TrackerProgram)
+		resp, err = client.PutResource(putURL, teUpdatePayload)
+		if err != nil {
+			return err
+		}
+		if !resp.IsSuccess() {
+			log.Infof("Error updating trackedEntity attributes in DHIS2: %s", resp.Body())
+			return responseError(resp.StatusCode(), resp.Body())
+		}
+	}
+
+	if len(dataValues) > 0 && syncLog.EventID == "" {
+		return &ConflictError{Conflicts: []string{"client has no screening event in DHIS2"}}
+	}
+	for _, v := range dataValues {
+		ep := tracker.EventUpdatePayload{
+			Event:         syncLog.EventID,
+			Program:       config.RTCGwConf.API.DHIS2TrackerProgram,
+			OrgUnit:       syncLog.OrgUnit,
+			Status:        "ACTIVE",
+			ProgramStage:  config.RTCGwConf.API.DHIS2TrackerProgramStage,
+			DataValues:    []tracker.DataValue{v},
+			TrackedEntity: syncLog.TrackedEntity,
+		}
+		resp, err := client.PutResource(fmt.Sprintf("events/%s/%s/", syncLog.EventID, v.DataElement), ep)
+		if err != nil {
+			return err
+		}
+		if !resp.IsSuccess() {
+			log.Infof("Error updating screening event data value in DHIS2: %s", resp.Body())
+			return responseError(resp.StatusCode(), resp.Body())
+		}
+	}
+	return nil
+}
+
+// forSyncLog returns the request for the patient of syncLog. The requests of a merged duplicate update the surviving
+// patient, who keeps their own echis_patient_id
+func (r ECHISRequest) forSyncLog(syncLog *SyncLog) ECHISRequest {
+	if r.ECHISID == syncLog.ECHISID {
+		return r
+	}
+	values := make(map[string]string, len(r.Values))
+	for name, value := range r.Values {
+		values[name] = value
+	}
+	values[FieldECHISID] = syncLog.ECHISID
+	return NewECHISRequest(values)
+}
+
+// mergeAttributes returns the current attribute values with those of updates replaced or added
+func mergeAttributes(current, updates []tracker.NestedAttribute) []tracker.NestedAttribute {
+	merged := make([]tracker.NestedAttribute, 0, len(current)+len(updates))
+	for _, attribute := range current {
+		found := false
+		for _, update := range updates {
+			if update.Attribute == attribute.Attribute {
+				found = true
+			}
+		}
+		if !found {
+			merged = append(merged, tracker.NestedAttribute{Attribute: attribute.Attribute, Value: attribute.Value})
+		}
+	}
+	return append(merged, updates...)
+}
+
+// responseError returns the error of a failed DHIS2 request. Rejections are returned as a *ConflictError
+// with the import conflicts, while server errors are returned as plain errors so that they are retried
+func responseError(statusCode int, body []byte) error {
+	if statusCode >= 500 {
+		return fmt.Errorf("DHIS2 responded with status %d", statusCode)
+	}
+	var data tracker.RootResponse
+	if err := json.Unmarshal(body, &data); err == nil {
+		if conflicts := data.Response.AllConflicts(); len(conflicts) > 0 {
+			return &ConflictError{Conflicts: tracker.ConflictMessages(conflicts)}
+		}
+		if data.Message != "" {
+			return &ConflictError{Conflicts: []string{data.Message}}
+		}
+	}
+	return &ConflictError{Conflicts: []string{fmt.Sprintf("DHIS2 responded with status %d", statusCode)}}
+}
@@ -0,0 +1,119 @@
+package models
+
+import (
+	"github.com/goccy/go-json"
+	"github.com/lib/pq"
+	"rtcgw/config"
+	"rtcgw/db"
+	"rtcgw/utils"
+	"strings"
+	"time"
+)
+
+// ResultUploadFields are the fields of LabXpert results that may be given by the columns of an uploaded spreadsheet
+var ResultUploadFields = []string{"patient_id", "lab", "mtb", "rr", "result_date", "facility_dhis2_id"}
+
+// ResultUpload is a spreadsheet of results uploaded by a user, with the outcome of each of its rows
+type ResultUpload struct {
+	ID        string         `db:"id" json:"id"`
+	UserID    *int64         `db:"user_id" json:"-"`
+	Filename  string         `db:"filename" json:"filename"`
+	TotalRows int            `db:"total_rows" json:"rows"`
+	Queued    int            `db:"queued" json:"queued"`
+	Rejected  int            `db:"rejected" json:"rejected"`
+	Columns   pq.StringArray `db:"columns" json:"-"` // the header of the column of each of the ResultUploadFields
+	Report    string         `db:"report" json:"-"`
+	Created   *time.Time     `db:"created" json:"created"`
+}
+
+// ResultUploadRow is the outcome of a row of an uploaded spreadsheet, identified by its row number in the sheet
+type ResultUploadRow struct {
+	Row          int               `json:"row"`
+	Status       string            `json:"status"`
+	SubmissionID string            `json:"submission_id,omitempty"`
+	Values       map[string]string `json:"values"`
+	Errors       map[string]string `json:"errors,omitempty"`
+}
+
+// ResultUploadColumns returns the configured column header of each of the ResultUploadFields, the field name
+// itself for fields that are not configured
+func ResultUploadColumns() map[string]string {
+	columns := make(map[string]string)
+	for _, field := range ResultUploadFields {
+		columns[field] = field
+		if header, ok := config.RTCGwConf.API.ResultsUploadColumns[field]; ok && header != "" {
+			columns[field] = header
+		}
+	}
+	return columns
+}
+
+// LabXpertResultFromRow maps the values of an uploaded row onto a LabXpert result. Results are matched without
+// regard to case, and result dates may be Excel serial dates
+func LabXpertResultFromRow(values map[string]string) LabXpertResult {
+	result := LabXpertResult{
+		PatientID:  values["patient_id"],
+		Lab:        values["lab"],
+		MTB:        normalizeResult(values["mtb"], utils.MTBResults),
+		RR:         normalizeResult(values["rr"], utils.RRResults),
+		ResultDate: values["result_date"],
+		FacilityID: values["facility_dhis2_id"],
+	}
+	if t, ok := utils.ExcelDate(result.ResultDate); ok {
+		result.ResultDate = t.Format("2006-01-02 15:04:05")
+	}
+	return result
+}
+
+// SetRows records the outcome of the upload's rows
+func (u *ResultUpload) SetRows(rows []ResultUploadRow) error {
+	report, err := json.Marshal(rows)
+	if err != nil {
+		return err
+	}
+	u.Report = string(report)
+	u.TotalRows, u.Queued, u.Rejected = len(rows), 0, 0
+	for _, row := range rows {
+		if row.SubmissionID != "" {
+			u.Queued++
+		} else {
+			u.Rejected++
+		}
+	}
+	return nil
+}
+
+// Rows returns the outcome of the upload's rows
+func (u *ResultUpload) Rows() ([]ResultUploadRow, error) {
+	rows := []ResultUploadRow{}
+	if strings.TrimSpace(u.Report) == "" {
+		return rows, nil
+	}
+	err := json.Unmarshal([]byte(u.Report), &rows)
+	return rows, err
+}
+
+// Save saves the upload and its report
+func (u *ResultUpload) Save() error {
+	rows, err := db.GetDB().NamedQuery(`INSERT INTO result_uploads
+			(id, user_id, filename, total_rows, queued, rejected, columns, report)
+		VALUES (:id, :user_id, :filename, :total_rows, :queued, :rejected, :columns, :report) RETURNING created`, u)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	if rows.Next() {
+		return rows.Scan(&u.Created)
+	}
+	return nil
+}
+
+// GetResultUpload returns the upload with the given id
+func GetResultUpload(id string) (*ResultUpload, error) {
+	upload := ResultUpload{}
+	err := db.GetDB().Get(&upload, `SELECT * FROM result_uploads WHERE id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+	return &upload, nil
+}
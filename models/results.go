@@ -3,75 +3,93 @@ package models
 import (
 	"fmt"
 	"github.com/buger/jsonparser"
+	"github.com/go-playground/validator/v10"
 	"github.com/goccy/go-json"
 	log "github.com/sirupsen/logrus"
 	"rtcgw/clients"
 	"rtcgw/config"
 	"rtcgw/models/tracker"
+	"strings"
 )
 
 type LabXpertResult struct {
 	PatientID  string `json:"patient_id" binding:"required"`
 	Lab        string `json:"lab,omitempty"`
-	MTB        string `json:"mtb"`
-	RR         string `json:"rr"`
-	ResultDate string `json:"result_date"`
-	FacilityID string `json:"facility_dhis2_id"`
+	MTB        string `json:"mtb" binding:"required,mtbResult"`
+	RR         string `json:"rr" binding:"omitempty,rrResult"`
+	ResultDate string `json:"result_date" binding:"required,resultDate"`
+	FacilityID string `json:"facility_dhis2_id" binding:"required,dhis2UID"`
 }
 
-func SearchTE(client *clients.Client, echisID, orgUnit, program string) (bool, []tracker.TrackedEntity) {
+// LabXpertResultValidation requires the rifampicin resistance result whenever MTB is detected
+func LabXpertResultValidation(sl validator.StructLevel) {
+	result := sl.Current().Interface().(LabXpertResult)
+	if strings.HasPrefix(result.MTB, "DETECTED") && result.RR == "" {
+		sl.ReportError(result.RR, "rr", "RR", "required_with_detected_mtb", "")
+	}
+}
+
+// SearchTE returns the tracked entities of the program with echisID as their search attribute in orgUnit, or in any
+// org unit accessible to the DHIS2 user if orgUnit is empty
+func SearchTE(client *clients.Client, echisID, orgUnit, program string) ([]tracker.TrackedEntity, error) {
 	params := make(map[string]string)
 	// params["trackedEntity"] = echisID
-	params["orgUnit"] = orgUnit
 	params["program"] = program
-	params["ouMode"] = "SELECTED"
-	params["orgUnitMode"] = "SELECTED"
+	if orgUnit != "" {
+		params["orgUnit"] = orgUnit
+		params["ouMode"] = "SELECTED"
+		params["orgUnitMode"] = "SELECTED"
+	} else {
+		params["ouMode"] = "ACCESSIBLE"
+		params["orgUnitMode"] = "ACCESSIBLE"
+	}
+	// DHIS2 timestamps have no time zone and would fail to unmarshal into the time.Time fields of TrackedEntity
+	params["fields"] = "trackedEntity,trackedEntityType,orgUnit"
 	params["filter"] = fmt.Sprintf("%s:EQ:%s", config.RTCGwConf.API.DHIS2SearchAttribute, echisID)
 	//params["query"] = fmt.Sprintf("%s", echisID)
 	resp, err := client.GetResource("/tracker/trackedEntities", params)
 	if err != nil {
-		log.Info("Error calling resource!!!")
-		fmt.Printf("Error when calling GetResource: %v\n", err)
-		return false, nil
+		return nil, err
+	}
+	if !resp.IsSuccess() {
+		return nil, fmt.Errorf("failed to search DHIS2 for tracked entity: %s", resp.Status())
 	}
 
 	v, _, _, err := jsonparser.Get(resp.Body(), "instances")
 	if err != nil {
-		log.Infof("Error getting instances: %v", err)
-		return false, nil
+		return nil, err
 	}
 	var instances []tracker.TrackedEntity
 	err = json.Unmarshal(v, &instances)
-	if err != nil {
-		log.Infof("Error unmarshalling instances: %v", err)
-		return false, nil
-	}
-	return true, instances
+	return instances, err
 }
 
 // CheckDhis2Presence returns true if a TE is present for the given results
 func (r *LabXpertResult) CheckDhis2Presence(c *clients.Client) bool {
 	log.Info("Checking TE in DHIS2")
-	//exists := utils.SearchTE(c,
-	//	r.PatientID, r.FacilityID, config.RTCGwConf.API.DHIS2TrackerProgram)
-	exists, _ := SearchTE(c,
+	instances, err := SearchTE(c,
 		r.PatientID, r.FacilityID, config.RTCGwConf.API.DHIS2TrackerProgram)
-	if !exists {
+	if err != nil {
+		log.WithError(err).Info("Failed to search TE in DHIS2")
+		return false
+	}
+	if len(instances) == 0 {
 		log.Infof("TE not found in DHIS2 for patient: %s, facility: %s, program: %s",
 			r.PatientID, r.FacilityID, config.RTCGwConf.API.DHIS2TrackerProgram)
 	}
 
-	return exists // Placeholder return value
-
+	return len(instances) > 0
 }
 
-func (r *LabXpertResult) InDhis2() (*SyncLog, bool) {
+// InDhis2 returns the sync log of the result's patient and true if the patient has been saved to DHIS2. The error
+// is returned if the sync log could not be read, in which case it is not known whether they have
+func (r *LabXpertResult) InDhis2() (*SyncLog, bool, error) {
 	syncLog, err := GetSyncLogByECHISID(r.PatientID)
 	if err != nil {
 		log.Infof("Error getting sync log for patient: %s: Error: %v", r.PatientID, err.Error())
-		return nil, false
+		return nil, false, err
 	}
-	return syncLog, true
+	return syncLog, syncLog != nil, nil
 }
 
 func (r *LabXpertResult) SaveResults(c *clients.Client) {
@@ -89,7 +107,10 @@ func (r *LabXpertResult) SaveResults(c *clients.Client) {
 	//	// TODO: Implement update tracked entity function
 	//
 	//}
-	dhis2Log, present := r.InDhis2()
+	dhis2Log, present, err := r.InDhis2()
+	if err != nil {
+		return
+	}
 	if !present {
 		// Alert that no match found in DHIS2 and return
 		log.Infof("No match found in DHIS2 for eCHISID %s", r.PatientID)
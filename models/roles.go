@@ -0,0 +1,236 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"rtcgw/db"
+	"strings"
+	"time"
+)
+
+// System modules as stored in user_role_permissions.sys_module
+const (
+	ModuleClients = "Clients"
+	ModuleResults = "Results"
+	ModuleUsers   = "Users"
+	ModuleTokens  = "Tokens"
+	ModuleStats   = "Stats"
+	ModuleAudit   = "Audit"
+)
+
+// Permissions as stored in user_role_permissions.sys_perms e.g. "rmad"
+const (
+	PermRead   = "r"
+	PermModify = "m"
+	PermAdd    = "a"
+	PermDelete = "d"
+)
+
+// Token scope access levels. Read access covers PermRead while write access covers the other permissions
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+)
+
+// SysModules lists all the modules a role can be granted permissions on
+var SysModules = []string{ModuleClients, ModuleResults, ModuleUsers, ModuleTokens, ModuleStats, ModuleAudit}
+
+// allPerms is the canonical order in which permissions are stored
+const allPerms = "rmad"
+
+// UserRole is our user role object
+type UserRole struct {
+	ID          int64                `db:"id" json:"id"`
+	Name        string               `db:"name" json:"name" binding:"required"`
+	Description string               `db:"description" json:"description"`
+	Created     *time.Time           `db:"created" json:"created"`
+	Updated     *time.Time           `db:"updated" json:"updated"`
+	Permissions []UserRolePermission `db:"-" json:"permissions"`
+}
+
+// UserRolePermission holds the permissions a role has on a sys_module
+type UserRolePermission struct {
+	ID        int64      `db:"id" json:"id"`
+	UserRole  int64      `db:"user_role" json:"user_role"`
+	SysModule string     `db:"sys_module" json:"sys_module" binding:"required"`
+	SysPerms  string     `db:"sys_perms" json:"sys_perms" binding:"required"`
+	Created   *time.Time `db:"created" json:"created"`
+	Updated   *time.Time `db:"updated" json:"updated"`
+}
+
+// IsValidModule returns true if module is one of the known SysModules
+func IsValidModule(module string) bool {
+	for _, m := range SysModules {
+		if m == module {
+			return true
+		}
+	}
+	return false
+}
+
+// ScopeFor returns the token scope e.g. "clients:write" required for perm on module
+func ScopeFor(module, perm string) string {
+	access := ScopeWrite
+	if perm == PermRead {
+		access = ScopeRead
+	}
+	return strings.ToLower(module) + ":" + access
+}
+
+// AllScopes returns every token scope
+func AllScopes() []string {
+	var scopes []string
+	for _, m := range SysModules {
+		scopes = append(scopes, ScopeFor(m, PermRead), ScopeFor(m, PermModify))
+	}
+	return scopes
+}
+
+// IsValidScope returns true if scope is one of AllScopes
+func IsValidScope(scope string) bool {
+	for _, s := range AllScopes() {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// NormalizePerms validates perms and returns them deduplicated in "rmad" order
+func NormalizePerms(perms string) (string, error) {
+	for _, p := range perms {
+		if !strings.ContainsRune(allPerms, p) {
+			return "", fmt.Errorf("invalid permission '%c', allowed permissions are '%s'", p, allPerms)
+		}
+	}
+	var normalized strings.Builder
+	for _, p := range allPerms {
+		if strings.ContainsRune(perms, p) {
+			normalized.WriteRune(p)
+		}
+	}
+	return normalized.String(), nil
+}
+
+// Save creates the role
+func (r *UserRole) Save() error {
+	dbConn := db.GetDB()
+	return dbConn.QueryRowx(`INSERT INTO user_roles (name, description)
+		VALUES ($1, $2) RETURNING id, created, updated`, r.Name, r.Description).
+		Scan(&r.ID, &r.Created, &r.Updated)
+}
+
+// LoadPermissions populates the role's Permissions
+func (r *UserRole) LoadPermissions() error {
+	dbConn := db.GetDB()
+	r.Permissions = []UserRolePermission{}
+	return dbConn.Select(&r.Permissions, `SELECT id, user_role, sys_module, sys_perms, created, updated
+		FROM user_role_permissions WHERE user_role = $1 ORDER BY sys_module`, r.ID)
+}
+
+// GrantPermission adds perms on module to the permissions the role already has
+func (r *UserRole) GrantPermission(module, perms string) (string, error) {
+	current, err := r.modulePerms(module)
+	if err != nil {
+		return "", err
+	}
+	newPerms, err := NormalizePerms(current + perms)
+	if err != nil {
+		return "", err
+	}
+	dbConn := db.GetDB()
+	_, err = dbConn.Exec(`INSERT INTO user_role_permissions (user_role, sys_module, sys_perms)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (sys_module, user_role) DO UPDATE SET sys_perms = EXCLUDED.sys_perms, updated = NOW()`,
+		r.ID, module, newPerms)
+	if err != nil {
+		return "", err
+	}
+	return newPerms, nil
+}
+
+// RevokePermission removes perms on module from the role. An empty perms revokes all permissions on the module
+func (r *UserRole) RevokePermission(module, perms string) (string, error) {
+	current, err := r.modulePerms(module)
+	if err != nil {
+		return "", err
+	}
+	if _, err := NormalizePerms(perms); err != nil {
+		return "", err
+	}
+	remaining := current
+	if perms == "" {
+		remaining = ""
+	}
+	for _, p := range perms {
+		remaining = strings.ReplaceAll(remaining, string(p), "")
+	}
+	dbConn := db.GetDB()
+	if remaining == "" {
+		_, err = dbConn.Exec(`DELETE FROM user_role_permissions WHERE user_role = $1 AND sys_module = $2`,
+			r.ID, module)
+	} else {
+		_, err = dbConn.Exec(`UPDATE user_role_permissions SET sys_perms = $1, updated = NOW()
+			WHERE user_role = $2 AND sys_module = $3`, remaining, r.ID, module)
+	}
+	if err != nil {
+		return "", err
+	}
+	return remaining, nil
+}
+
+func (r *UserRole) modulePerms(module string) (string, error) {
+	var perms string
+	err := db.GetDB().Get(&perms, `SELECT sys_perms FROM user_role_permissions
+		WHERE user_role = $1 AND sys_module = $2`, r.ID, module)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return perms, err
+}
+
+// GetUserRoles returns all the roles together with their permissions
+func GetUserRoles() ([]UserRole, error) {
+	roles := []UserRole{}
+	err := db.GetDB().Select(&roles, `SELECT id, name, description, created, updated
+		FROM user_roles ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	for i := range roles {
+		if err := roles[i].LoadPermissions(); err != nil {
+			return nil, err
+		}
+	}
+	return roles, nil
+}
+
+// GetUserRoleByID returns the role with the given id together with its permissions
+func GetUserRoleByID(id int64) (*UserRole, error) {
+	role := UserRole{}
+	err := db.GetDB().Get(&role, `SELECT id, name, description, created, updated
+		FROM user_roles WHERE id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := role.LoadPermissions(); err != nil {
+		return nil, err
+	}
+	return &role, nil
+}
+
+// UserHasPermission checks whether the role of the user identified by userID has perm on module
+func UserHasPermission(userID int64, module, perm string) bool {
+	var perms string
+	err := db.GetDB().Get(&perms, `SELECT p.sys_perms FROM users u
+		INNER JOIN user_role_permissions p ON p.user_role = u.user_role
+		WHERE u.id = $1 AND p.sys_module = $2`, userID, module)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.WithError(err).Error("Failed to get user permissions")
+		}
+		return false
+	}
+	return strings.Contains(perms, perm)
+}
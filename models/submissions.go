@@ -0,0 +1,113 @@
+package models
+
+import (
+	"database/sql"
+	"github.com/lib/pq"
+	"rtcgw/db"
+	"strings"
+	"time"
+)
+
+// Submission statuses
+const (
+	SubmissionQueued     = "queued"
+	SubmissionProcessing = "processing"
+	SubmissionRetrying   = "retrying"
+	SubmissionSynced     = "synced"
+	SubmissionFailed     = "failed"
+)
+
+// Submission tracks an accepted client or result submission through its task until it is synced to DHIS2
+type Submission struct {
+	ID        string         `db:"id" json:"id"`
+	UserID    *int64         `db:"user_id" json:"-"`
+	TaskType  string         `db:"task_type" json:"type"`
+	TaskID    string         `db:"task_id" json:"task_id"`
+	Queue     string         `db:"queue" json:"-"`
+	ECHISID   string         `db:"echis_id" json:"echis_patient_id"`
+	Status    string         `db:"status" json:"status"`
+	LastError string         `db:"last_error" json:"last_error,omitempty"`
+	Conflicts pq.StringArray `db:"conflicts" json:"conflicts,omitempty"`
+	Retries   int            `db:"retries" json:"retries"`
+	Created   *time.Time     `db:"created" json:"created"`
+	Updated   *time.Time     `db:"updated" json:"updated"`
+}
+
+// ConflictError is returned when DHIS2 rejects a submission, carrying the parsed import conflicts
+type ConflictError struct {
+	Conflicts []string
+}
+
+func (e *ConflictError) Error() string {
+	return "conflicts: " + strings.Join(e.Conflicts, "; ")
+}
+
+// CreateSubmission saves a queued submission. If a submission already uses the task id, as is the case for
+// repeated submissions sharing an idempotency key, that submission is returned instead and created is false
+func CreateSubmission(s *Submission) (created bool, err error) {
+	dbConn := db.GetDB()
+	rows, err := dbConn.NamedQuery(`INSERT INTO submissions (id, user_id, task_type, task_id, queue, echis_id)
+		VALUES (:id, :user_id, :task_type, :task_id, :queue, :echis_id)
+		ON CONFLICT (task_id) DO NOTHING RETURNING status, created, updated`, s)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	if rows.Next() {
+		return true, rows.Scan(&s.Status, &s.Created, &s.Updated)
+	}
+	existing, err := GetSubmissionByTaskID(s.TaskID)
+	if err != nil {
+		return false, err
+	}
+	*s = *existing
+	return false, nil
+}
+
+// Requeue resets a finished submission whose task has been queued again
+func (s *Submission) Requeue() error {
+	_, err := db.GetDB().Exec(`UPDATE submissions SET status = $1, last_error = '', conflicts = NULL, retries = 0,
+			updated = NOW()
+		WHERE id = $2 AND status IN ($3, $4)`, SubmissionQueued, s.ID, SubmissionSynced, SubmissionFailed)
+	return err
+}
+
+// SetStatus records the submission's status together with the last error and number of retries of its task.
+// The DHIS2 conflicts are kept if lastError is a *ConflictError
+func (s *Submission) SetStatus(status string, lastError error, retries int) error {
+	s.Status, s.LastError, s.Conflicts, s.Retries = status, "", nil, retries
+	if lastError != nil {
+		s.LastError = lastError.Error()
+		if conflictErr, ok := lastError.(*ConflictError); ok {
+			s.LastError = "DHIS2 rejected the submission"
+			s.Conflicts = conflictErr.Conflicts
+		}
+	}
+	_, err := db.GetDB().Exec(`UPDATE submissions SET status = $1, last_error = $2, conflicts = $3, retries = $4,
+			updated = NOW()
+		WHERE id = $5`, s.Status, s.LastError, s.Conflicts, s.Retries, s.ID)
+	return err
+}
+
+// GetSubmission returns the submission with the given tracking id
+func GetSubmission(id string) (*Submission, error) {
+	submission := Submission{}
+	err := db.GetDB().Get(&submission, `SELECT * FROM submissions WHERE id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+	return &submission, nil
+}
+
+// GetSubmissionByTaskID returns the submission processed by the task, nil if the task is not for a submission
+func GetSubmissionByTaskID(taskID string) (*Submission, error) {
+	submission := Submission{}
+	err := db.GetDB().Get(&submission, `SELECT * FROM submissions WHERE task_id = $1`, taskID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &submission, nil
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/buger/jsonparser"
 	"github.com/goccy/go-json"
+	"github.com/jmoiron/sqlx"
 	log "github.com/sirupsen/logrus"
 	"rtcgw/clients"
 	"rtcgw/config"
@@ -20,16 +21,17 @@ type SyncLog struct {
 	TrackedEntity             string       `db:"tracked_entity" json:"trackedEntityInstance"`
 	EventDate                 sql.NullTime `db:"event_date" json:"event_date"`
 	OrgUnit                   string       `db:"org_unit" json:"org_unit"`
-	ECHISClientCreationErrors string       `db:"echis_clinet_creation_errors" json:"echisClientCreationErrors"`
+	ECHISClientCreationErrors string       `db:"echis_client_creation_errors" json:"echisClientCreationErrors"`
 	ResultsUpdated            bool         `db:"results_updated" json:"results_updated"`
 	ResultsUpdateErrors       string       `db:"results_update_errors" json:"resultsUpdateErrors"`
 	LabEvent                  string       `db:"lab_event" json:"lab_event"`
 	LabEnrollment             string       `db:"lab_enrollment" json:"lab_enrollment"`
+	MergedInto                string       `db:"merged_into" json:"merged_into,omitempty"` // the surviving patient of a merged duplicate
 	Created                   time.Time    `db:"created" json:"created"`
 	Updated                   time.Time    `db:"updated" json:"updated"`
 }
 
-func (s *SyncLog) Save() {
+func (s *SyncLog) Save() error {
 	dbConn := db.GetDB()
 	_, err := dbConn.NamedExec(`INSERT INTO sync_log 
 	(echis_id, event_id, event_date, tracked_entity, org_unit) 
@@ -37,6 +39,7 @@ func (s *SyncLog) Save() {
 	if err != nil {
 		log.WithError(err).Error("Failed to save sync log")
 	}
+	return err
 }
 
 func (s *SyncLog) SetResultUpdated() {
@@ -130,17 +133,40 @@ func (s *SyncLog) LabEventExists() bool {
 	return DHIS2EventExists(s.LabEvent)
 }
 
+// GetSyncLogByECHISID returns the sync log of the patient echisID. The sync log of the surviving patient is
+// returned for a merged duplicate, so that their results and updates land on one record
 func GetSyncLogByECHISID(echisID string) (*SyncLog, error) {
+	syncLog, err := GetSyncLogRow(echisID)
+	if err != nil || syncLog == nil || syncLog.MergedInto == "" {
+		return syncLog, err
+	}
+	return GetSyncLogRow(syncLog.MergedInto)
+}
+
+// GetSyncLogRow returns the sync log row of the patient echisID without following merges, e.g. to tell whether
+// the patient has been merged into another
+func GetSyncLogRow(echisID string) (*SyncLog, error) {
+	return getSyncLogRow(db.GetDB(), echisID, "")
+}
+
+// lockSyncLogRow returns the sync log row of the patient echisID, locking it until the transaction tx ends
+func lockSyncLogRow(tx *sqlx.Tx, echisID string) (*SyncLog, error) {
+	return getSyncLogRow(tx, echisID, " FOR UPDATE")
+}
+
+func getSyncLogRow(q sqlx.Queryer, echisID, lock string) (*SyncLog, error) {
 	logObj := SyncLog{}
-	var eventDateStr, labEvent, labEnrollment sql.NullString
+	var eventDateStr, labEvent, labEnrollment, creationErrors, updateErrors, mergedInto sql.NullString
 
-	err := db.GetDB().QueryRow(
+	err := q.QueryRowx(
 		`SELECT id, echis_id, event_id, tracked_entity, event_date, results_updated, 
-		lab_event, lab_enrollment, org_unit
-		FROM sync_log WHERE echis_id = $1`, echisID).
+		lab_event, lab_enrollment, org_unit, echis_client_creation_errors, results_update_errors, merged_into,
+		created, updated
+		FROM sync_log WHERE echis_id = $1`+lock, echisID).
 		Scan(&logObj.ID, &logObj.ECHISID, &logObj.EventID,
 			&logObj.TrackedEntity, &eventDateStr, &logObj.ResultsUpdated,
-			&labEvent, &labEnrollment, &logObj.OrgUnit)
+			&labEvent, &labEnrollment, &logObj.OrgUnit, &creationErrors, &updateErrors, &mergedInto,
+			&logObj.Created, &logObj.Updated)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
@@ -150,6 +176,9 @@ func GetSyncLogByECHISID(echisID string) (*SyncLog, error) {
 	logObj.EventDate = StringToNullTime(eventDateStr)
 	logObj.LabEvent = labEvent.String
 	logObj.LabEnrollment = labEnrollment.String
+	logObj.ECHISClientCreationErrors = creationErrors.String
+	logObj.ResultsUpdateErrors = updateErrors.String
+	logObj.MergedInto = mergedInto.String
 	return &logObj, nil
 }
 
@@ -252,7 +281,7 @@ func (s *SyncLog) CheckLabProgramEnrollment() bool {
 	var enrollments []map[string]string
 	err = json.Unmarshal(v, &enrollments)
 	if err != nil {
-		log.Infof("Error unmarshalling enrollments: Resp: %v -- %v, Error:", string(v), enrollments, err.Error())
+		log.Infof("Error unmarshalling enrollments: Resp: %v -- %v, Error: %v", string(v), enrollments, err.Error())
 		return false
 	}
 	if len(enrollments) > 0 {
@@ -99,6 +99,33 @@ func ConflictsToError(conflicts []any) error {
 	return fmt.Errorf("conflicts: %s", strings.Join(conflictMessages, "; "))
 }
 
+// ConflictMessages formats import conflicts, which DHIS2 sends as {"object": ..., "value": ...}, as "object: value"
+func ConflictMessages(conflicts []any) []string {
+	var messages []string
+	for _, conflict := range conflicts {
+		if c, ok := conflict.(map[string]any); ok && c["value"] != nil {
+			messages = append(messages, fmt.Sprintf("%v: %v", c["object"], c["value"]))
+			continue
+		}
+		messages = append(messages, fmt.Sprintf("%v", conflict))
+	}
+	return messages
+}
+
+// AllConflicts returns the conflicts of the response and of its nested import summaries
+func (r *Response) AllConflicts() []any {
+	if r == nil {
+		return nil
+	}
+	conflicts := r.Conflicts
+	for _, summary := range r.ImportSummaries {
+		conflicts = append(conflicts, summary.Conflicts...)
+		conflicts = append(conflicts, summary.Enrollments.AllConflicts()...)
+		conflicts = append(conflicts, summary.Events.AllConflicts()...)
+	}
+	return conflicts
+}
+
 // GetTrackedEntityAndEventReferences retrieves the first event reference under enrollments → importSummaries → events.
 func (r *RootResponse) GetTrackedEntityAndEventReferences() (string, string, bool, error) {
 	trackedEntityInstance := ""
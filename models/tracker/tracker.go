@@ -172,6 +172,7 @@ type TrackedEntityUpdatePayload struct {
 	TrackedEntityType     string            `json:"trackedEntityType"`
 	Attributes            []NestedAttribute `json:"attributes"`
 	Relationships         []Relationship    `json:"relationships,omitempty"`
+	Inactive              bool              `json:"inactive,omitempty"`
 }
 
 type EnrollmentPayload struct {
@@ -212,10 +213,8 @@ func (e *EnrollmentPayload) Create() (string, error) {
 			return "", err
 		}
 		return enID, nil
-	} else {
-		return "", fmt.Errorf("failed to create enrollment: %v", string(resp.Body()))
 	}
-	return "", fmt.Errorf("failed to create enrollment")
+	return "", fmt.Errorf("failed to create enrollment: %v", string(resp.Body()))
 }
 
 func (e *EventCreationPayload) Create() (string, error) {
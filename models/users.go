@@ -2,8 +2,11 @@ package models
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
+	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
 	log "github.com/sirupsen/logrus"
 	"rtcgw/db"
 	"time"
@@ -21,8 +24,15 @@ type User struct {
 	Phone        string     `db:"telephone" json:"telephone"`
 	IsActive     bool       `db:"is_active" json:"is_active"`
 	IsSystemUser bool       `db:"is_system_user" json:"is_system_user"`
-	Created      *time.Time `db:"created" json:"created"`
-	Updated      *time.Time `db:"updated" json:"updated"`
+	UserRole     int64      `db:"user_role" json:"user_role"`
+	LastLogin    *time.Time `db:"last_login" json:"last_login"`
+	LockedUntil  *time.Time `db:"locked_until" json:"locked_until"`
+	CertSubject  *string    `db:"cert_subject" json:"cert_subject"`
+	// MustChangePassword restricts the user to changing their password, set when a one-time password is issued
+	MustChangePassword bool       `db:"must_change_password" json:"must_change_password"`
+	PasswordChanged    *time.Time `db:"password_changed" json:"password_changed"`
+	Created            *time.Time `db:"created" json:"created"`
+	Updated            *time.Time `db:"updated" json:"updated"`
 }
 
 func (u *User) DeactivateAPITokens(token string) {
@@ -34,40 +44,139 @@ func (u *User) DeactivateAPITokens(token string) {
 	}
 }
 
+// DefaultTokenName is the name of the token managed through getToken and refreshToken
+const DefaultTokenName = "default"
+
 type UserToken struct {
-	ID        int64     `db:"id" json:"id"`
-	UserID    int64     `db:"user_id" json:"user_id"`
-	Token     string    `db:"token" json:"token"`
-	IsActive  bool      `db:"is_active" json:"is_active"`
-	ExpiresAt time.Time `db:"expires_at" json:"expires_at"`
-	Created   time.Time `db:"created_at" json:"created_at"`
-	Updated   time.Time `db:"updated_at" json:"updated_at"`
+	ID         int64          `db:"id" json:"id"`
+	UserID     int64          `db:"user_id" json:"user_id"`
+	Name       string         `db:"name" json:"name"`
+	Token      string         `db:"token" json:"-"` // SHA-256 hash of the token
+	Scopes     pq.StringArray `db:"scopes" json:"scopes"`
+	IsActive   bool           `db:"is_active" json:"is_active"`
+	ExpiresAt  *time.Time     `db:"expires_at" json:"expires_at"`
+	LastUsedAt *time.Time     `db:"last_used_at" json:"last_used_at"`
+	LastUsedIP *string        `db:"last_used_ip" json:"last_used_ip"`
+	Created    time.Time      `db:"created_at" json:"created_at"`
+	Updated    time.Time      `db:"updated_at" json:"updated_at"`
+}
+
+// NewUserToken generates a named token for the user with the given scopes, valid for validity.
+// The plain token is returned and only its hash is kept in the UserToken
+func NewUserToken(userID int64, name string, scopes []string, validity time.Duration) (string, *UserToken, error) {
+	token, err := GenerateToken()
+	if err != nil {
+		return "", nil, err
+	}
+	now := time.Now()
+	expiresAt := now.Add(validity)
+	return token, &UserToken{
+		UserID:    userID,
+		Name:      name,
+		Token:     HashToken(token),
+		Scopes:    scopes,
+		IsActive:  true,
+		ExpiresAt: &expiresAt,
+		Created:   now,
+		Updated:   now,
+	}, nil
+}
+
+// Revoke deactivates the token
+func (ut *UserToken) Revoke() error {
+	dbConn := db.GetDB()
+	_, err := dbConn.Exec(`UPDATE user_apitoken SET is_active = FALSE, updated_at = NOW() WHERE id = $1`, ut.ID)
+	if err == nil {
+		ut.IsActive = false
+	}
+	return err
 }
 
-func (ut *UserToken) Save() {
+// Save inserts the token
+func (ut *UserToken) Save() error {
 	dbConn := db.GetDB()
-	_, err := dbConn.NamedExec(`INSERT INTO user_apitoken (user_id, token)
-			VALUES(:user_id, :token)`, ut)
+	rows, err := dbConn.NamedQuery(`INSERT INTO user_apitoken (user_id, name, token, scopes, is_active, expires_at,
+				created_at, updated_at)
+			VALUES(:user_id, :name, :token, :scopes, :is_active, :expires_at, :created_at, :updated_at) RETURNING id`, ut)
 	if err != nil {
-		log.WithError(err).Error("Failed to save user API token")
+		return err
 	}
+	defer rows.Close()
+	if rows.Next() {
+		return rows.Scan(&ut.ID)
+	}
+	return rows.Err()
 }
 
-func (u *User) GetActiveToken() (string, error) {
+// MarkUsed records when and from which IP address the token was last used
+func (ut *UserToken) MarkUsed(clientIP string) {
 	dbConn := db.GetDB()
+	now := time.Now()
+	ut.LastUsedAt = &now
+	ut.LastUsedIP = &clientIP
+	_, err := dbConn.Exec(`UPDATE user_apitoken SET last_used_at = $1, last_used_ip = $2 WHERE id = $3`,
+		now, clientIP, ut.ID)
+	if err != nil {
+		log.WithError(err).Error("Failed to update user API token usage")
+	}
+}
+
+// GetActiveUserToken returns the active, non-expired token matching the plain token
+// if it belongs to an active user
+func GetActiveUserToken(token string) (*UserToken, error) {
 	var ut UserToken
-	err := dbConn.Get(&ut, "SELECT * FROM user_apitoken WHERE user_id = $1 AND is_active = TRUE LIMIT 1", u.ID)
+	err := db.GetDB().Get(&ut, `SELECT t.* FROM user_apitoken t
+            INNER JOIN users u ON u.id = t.user_id
+        WHERE
+            t.token = $1 AND t.is_active = TRUE AND u.is_active = TRUE
+            AND (t.expires_at IS NULL OR t.expires_at > NOW()) LIMIT 1`, HashToken(token))
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	return ut.Token, nil
+	return &ut, nil
+}
+
+// GetUserTokens returns all the tokens of the user, most recent first
+func GetUserTokens(userID int64) ([]UserToken, error) {
+	tokens := []UserToken{}
+	err := db.GetDB().Select(&tokens, `SELECT * FROM user_apitoken WHERE user_id = $1
+		ORDER BY created_at DESC`, userID)
+	return tokens, err
+}
+
+// GetUserTokenByID returns the token with id if it belongs to the user
+func GetUserTokenByID(userID, id int64) (*UserToken, error) {
+	var ut UserToken
+	err := db.GetDB().Get(&ut, `SELECT * FROM user_apitoken WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		return nil, err
+	}
+	return &ut, nil
+}
+
+// ActiveTokenNameExists returns true if the user already has an active token called name
+func ActiveTokenNameExists(userID int64, name string) (bool, error) {
+	var count int
+	err := db.GetDB().Get(&count, `SELECT count(*) FROM user_apitoken
+		WHERE user_id = $1 AND name = $2 AND is_active = TRUE`, userID, name)
+	return count > 0, err
+}
+
+// PurgeUserTokens deletes expired and inactive tokens, returning the number of deleted tokens
+func PurgeUserTokens() (int64, error) {
+	res, err := db.GetDB().Exec(`DELETE FROM user_apitoken WHERE is_active = FALSE OR expires_at < NOW()`)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
 }
 
 func GetUserByUID(uid string) (*User, error) {
 	userObj := User{}
 	err := db.GetDB().QueryRowx(
 		`SELECT
-            id, uid, username, firstname, lastname , telephone, email, created, updated, is_active, is_system_user
+            id, uid, username, firstname, lastname , telephone, email, created, updated, is_active, is_system_user,
+            user_role, last_login, locked_until, cert_subject, must_change_password, password_changed
         FROM users
         WHERE
             uid = $1`,
@@ -82,7 +191,8 @@ func GetUserById(id int64) (*User, error) {
 	userObj := User{}
 	err := db.GetDB().QueryRowx(
 		`SELECT
-            id, uid, username, firstname, lastname , telephone, email, created, updated, is_active, is_system_user
+            id, uid, username, firstname, lastname , telephone, email, created, updated, is_active, is_system_user,
+            user_role, last_login, locked_until, cert_subject, must_change_password, password_changed
         FROM users
         WHERE
             id = $1`,
@@ -93,6 +203,125 @@ func GetUserById(id int64) (*User, error) {
 	return &userObj, nil
 }
 
+// CreateUserRequest is the payload used by admins to create users
+type CreateUserRequest struct {
+	Username     string `json:"username" binding:"required"`
+	Password     string `json:"password" binding:"required"`
+	FirstName    string `json:"firstname" binding:"required"`
+	LastName     string `json:"lastname" binding:"required"`
+	Email        string `json:"email" binding:"omitempty,email"`
+	Phone        string `json:"telephone"`
+	UserRole     int64  `json:"user_role" binding:"required"`
+	IsSystemUser bool   `json:"is_system_user"`
+}
+
+// UserFilter holds the optional filters used when listing users
+type UserFilter struct {
+	Query        string
+	UserRole     int64
+	IsActive     *bool
+	IsSystemUser *bool
+}
+
+// Create saves the user, storing the password as a bcrypt hash using pgcrypto
+func (u *User) Create(password string) error {
+	dbConn := db.GetDB()
+	return dbConn.QueryRowx(`INSERT INTO users (uid, user_role, username, password, firstname, lastname,
+			email, telephone, is_active, is_system_user)
+		VALUES ($1, $2, $3, crypt($4, gen_salt('bf')), $5, $6, $7, $8, $9, $10)
+		RETURNING id, created, updated`,
+		u.UID, u.UserRole, u.Username, password, u.FirstName, u.LastName,
+		u.Email, u.Phone, u.IsActive, u.IsSystemUser).Scan(&u.ID, &u.Created, &u.Updated)
+}
+
+// SetActive activates or deactivates the user. Deactivated users also lose their API tokens
+func (u *User) SetActive(active bool) error {
+	dbConn := db.GetDB()
+	_, err := dbConn.Exec(`UPDATE users SET is_active = $1, updated = NOW() WHERE id = $2`, active, u.ID)
+	if err != nil {
+		return err
+	}
+	u.IsActive = active
+	if !active {
+		u.DeactivateAPITokens("")
+	}
+	return nil
+}
+
+// SetRole assigns the user the role identified by roleID
+func (u *User) SetRole(roleID int64) error {
+	dbConn := db.GetDB()
+	_, err := dbConn.Exec(`UPDATE users SET user_role = $1, updated = NOW() WHERE id = $2`, roleID, u.ID)
+	if err != nil {
+		return err
+	}
+	u.UserRole = roleID
+	return nil
+}
+
+// SetCertSubject sets the client certificate subject common name or SAN identifying the user.
+// An empty subject disables certificate authentication for the user
+func (u *User) SetCertSubject(subject string) error {
+	_, err := db.GetDB().Exec(`UPDATE users SET cert_subject = NULLIF($1, ''), updated = NOW() WHERE id = $2`,
+		subject, u.ID)
+	return err
+}
+
+// GetUserIDByCertSubject returns the id of the active user identified by one of a client certificate's identities
+func GetUserIDByCertSubject(identities []string) (int64, error) {
+	var userID int64
+	err := db.GetDB().Get(&userID, `SELECT id FROM users WHERE cert_subject = ANY($1) AND is_active = TRUE
+		LIMIT 1`, pq.Array(identities))
+	return userID, err
+}
+
+// UsernameTaken returns true if a user other than the one with excludeUID already uses username
+func UsernameTaken(username, excludeUID string) (bool, error) {
+	var count int
+	err := db.GetDB().Get(&count,
+		`SELECT count(*) FROM users WHERE username = $1 AND uid <> $2`, username, excludeUID)
+	return count > 0, err
+}
+
+// GetUsers returns a page of users matching filter, together with the total number of matching users
+func GetUsers(filter UserFilter, page, pageSize int) ([]User, int64, error) {
+	where := "WHERE TRUE"
+	var args []interface{}
+	if filter.Query != "" {
+		args = append(args, "%"+filter.Query+"%")
+		where += fmt.Sprintf(` AND (username ILIKE $%[1]d OR firstname ILIKE $%[1]d
+			OR lastname ILIKE $%[1]d OR email ILIKE $%[1]d OR telephone ILIKE $%[1]d)`, len(args))
+	}
+	if filter.UserRole > 0 {
+		args = append(args, filter.UserRole)
+		where += fmt.Sprintf(" AND user_role = $%d", len(args))
+	}
+	if filter.IsActive != nil {
+		args = append(args, *filter.IsActive)
+		where += fmt.Sprintf(" AND is_active = $%d", len(args))
+	}
+	if filter.IsSystemUser != nil {
+		args = append(args, *filter.IsSystemUser)
+		where += fmt.Sprintf(" AND is_system_user = $%d", len(args))
+	}
+
+	dbConn := db.GetDB()
+	var total int64
+	if err := dbConn.Get(&total, "SELECT count(*) FROM users "+where, args...); err != nil {
+		return nil, 0, err
+	}
+	users := []User{}
+	args = append(args, pageSize, (page-1)*pageSize)
+	err := dbConn.Select(&users, fmt.Sprintf(`SELECT
+            id, uid, username, firstname, lastname , telephone, email, created, updated, is_active, is_system_user,
+            user_role, last_login, locked_until, cert_subject, must_change_password, password_changed
+        FROM users %s ORDER BY id LIMIT $%d OFFSET $%d`, where, len(args)-1, len(args)), args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	return users, total, nil
+}
+
 func RespondWithError(code int, message string, c *gin.Context) {
 	resp := map[string]string{"error": message}
 
@@ -116,3 +345,9 @@ func GenerateToken() (string, error) {
 	// Convert the bytes to a hexadecimal string
 	return hex.EncodeToString(token), nil
 }
+
+// HashToken returns the hex encoded SHA-256 hash under which a token is stored
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
+	log "github.com/sirupsen/logrus"
+	"rtcgw/models"
+	"rtcgw/tasks"
+)
+
+// queueLabResult queues a result received from a laboratory system or instrument rather than through the API.
+// Results sent again with the same task id while the task is retained are not queued twice
+func queueLabResult(taskID string, result models.LabXpertResult) (*models.Submission, error) {
+	task, err := tasks.NewResultsTask(result)
+	if err != nil {
+		return nil, err
+	}
+	submission := &models.Submission{
+		ID:       uuid.NewString(),
+		TaskType: task.Type(),
+		TaskID:   taskID,
+		Queue:    "default",
+		ECHISID:  result.PatientID,
+	}
+	created, err := models.CreateSubmission(submission)
+	if err != nil {
+		return nil, err
+	}
+	_, err = client.Enqueue(task, asynq.Queue(submission.Queue), asynq.TaskID(submission.TaskID),
+		asynq.Retention(models.IdempotencyRetention()))
+	if errors.Is(err, asynq.ErrTaskIDConflict) {
+		log.Infof("task %s for repeated results is already queued", submission.TaskID)
+		return submission, nil
+	}
+	if err != nil {
+		if created {
+			_ = submission.SetStatus(models.SubmissionFailed, err, 0)
+		}
+		return nil, err
+	}
+	if !created {
+		// the task of the earlier results has finished and is no longer retained
+		if err := submission.Requeue(); err != nil {
+			log.WithError(err).Error("Failed to requeue submission")
+		}
+	}
+	return submission, nil
+}
@@ -3,6 +3,7 @@ package tasks
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"github.com/hibiken/asynq"
 	log "github.com/sirupsen/logrus"
 	"rtcgw/clients"
@@ -11,6 +12,7 @@ import (
 
 const (
 	TypeCreateClient = "client:create"
+	TypeUpdateClient = "client:update"
 )
 
 func NewClientTask(client models.ECHISRequest) (*asynq.Task, error) {
@@ -37,7 +39,15 @@ func HandleClientTask(ctx context.Context, task *asynq.Task) error {
 	}
 	if syncLog == nil {
 		// No match found in localDB hence in DHIS2
-		client.SaveClient(clients.Dhis2Client)
+		if err := client.SaveClient(clients.Dhis2Client); err != nil {
+			var conflictErr *models.ConflictError
+			if errors.As(err, &conflictErr) {
+				// retrying will not help until the client is corrected
+				submissionFailed(ctx, conflictErr)
+				return nil
+			}
+			return err
+		}
 
 		log.Infof("Client saved to DHIS2: %s", client.ECHISID)
 	} else {
@@ -47,3 +57,45 @@ func HandleClientTask(ctx context.Context, task *asynq.Task) error {
 
 	return nil
 }
+
+// NewClientUpdateTask returns a task applying the partial update of a client to DHIS2, see ECHISRequest.PartialUpdate
+func NewClientUpdateTask(update models.ECHISRequest) (*asynq.Task, error) {
+	payload, err := json.Marshal(update)
+	if err != nil {
+		return nil, err
+	}
+
+	return asynq.NewTask(TypeUpdateClient, payload, asynq.MaxRetry(3)), nil
+}
+
+// HandleClientUpdateTask updates only the fields of the task's update on the client's tracked entity and screening
+// event in DHIS2
+func HandleClientUpdateTask(ctx context.Context, task *asynq.Task) error {
+	var update models.ECHISRequest
+	if err := json.Unmarshal(task.Payload(), &update); err != nil {
+		log.Infof("failed to unmarshal payload: %v", err)
+		return err
+	}
+
+	syncLog, err := models.GetSyncLogByECHISID(update.ECHISID)
+	if err != nil {
+		log.Infof("Error getting sync log for patient: %s: %v", update.ECHISID, err)
+		return err
+	}
+	if syncLog == nil {
+		submissionFailed(ctx, errors.New("client not found in DHIS2"))
+		return nil
+	}
+	if err := update.PatchClient(clients.Dhis2Client, syncLog); err != nil {
+		var conflictErr *models.ConflictError
+		if errors.As(err, &conflictErr) {
+			// retrying will not help until the update is corrected
+			submissionFailed(ctx, conflictErr)
+			return nil
+		}
+		return err
+	}
+
+	log.Infof("Client updated in DHIS2: %s", update.ECHISID)
+	return nil
+}
@@ -0,0 +1,27 @@
+package tasks
+
+import (
+	"context"
+	"github.com/hibiken/asynq"
+	log "github.com/sirupsen/logrus"
+	"rtcgw/models"
+)
+
+const (
+	TypePurgeIdempotentRequests = "idempotency:purge"
+)
+
+func NewPurgeIdempotentRequestsTask() *asynq.Task {
+	return asynq.NewTask(TypePurgeIdempotentRequests, nil, asynq.MaxRetry(1))
+}
+
+// HandlePurgeIdempotentRequestsTask removes stored submission responses older than the retention window
+func HandlePurgeIdempotentRequestsTask(ctx context.Context, task *asynq.Task) error {
+	purged, err := models.PurgeIdempotentRequests()
+	if err != nil {
+		log.WithError(err).Error("Failed to purge stored submission responses")
+		return err
+	}
+	log.Infof("Purged %d stored submission responses", purged)
+	return nil
+}
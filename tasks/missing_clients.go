@@ -0,0 +1,70 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/hibiken/asynq"
+	log "github.com/sirupsen/logrus"
+	"rtcgw/config"
+	"rtcgw/models"
+)
+
+const (
+	TypeBackfillMissingClients = "missing_clients:backfill"
+)
+
+func NewBackfillMissingClientsTask() *asynq.Task {
+	return asynq.NewTask(TypeBackfillMissingClients, nil, asynq.MaxRetry(1))
+}
+
+// HandleBackfillMissingClientsTask searches DHIS2 for the pending missing clients, creates the sync_log rows
+// of those found and queues their results again
+func HandleBackfillMissingClientsTask(ctx context.Context, task *asynq.Task) error {
+	missing, err := models.GetMissingClients(models.MissingClientPending)
+	if err != nil {
+		log.WithError(err).Error("Failed to get missing clients")
+		return err
+	}
+	client := asynq.NewClient(asynq.RedisClientOpt{Addr: config.RTCGwConf.Server.RedisAddress})
+	defer func() { _ = client.Close() }()
+	matched := 0
+	for i := range missing {
+		found, err := missing[i].Backfill()
+		if err == nil && found {
+			matched++
+			err = QueueMissingClientResults(client, &missing[i])
+		}
+		if err != nil {
+			log.WithError(err).WithField("echis_patient_id", missing[i].ECHISID).Error("Failed to backfill missing client")
+		}
+	}
+	log.Infof("Backfilled %d of %d missing clients", matched, len(missing))
+	return nil
+}
+
+// QueueMissingClientResults queues the results received for a matched missing client for saving to DHIS2, and
+// then clears them. The task ids are derived from the results, so that results are not queued twice if clearing
+// them fails
+func QueueMissingClientResults(client *asynq.Client, missing *models.MissingClient) error {
+	results, err := missing.PendingResults()
+	if err != nil {
+		return err
+	}
+	if len(results) == 0 {
+		return nil
+	}
+	for _, result := range results {
+		task, err := NewResultsTask(result)
+		if err != nil {
+			return err
+		}
+		taskID := fmt.Sprintf("%s:missing:%s", TypeSendResults, models.HashToken(string(task.Payload())))
+		_, err = client.Enqueue(task, asynq.TaskID(taskID), asynq.Retention(models.IdempotencyRetention()))
+		if err != nil && !errors.Is(err, asynq.ErrTaskIDConflict) {
+			return err
+		}
+	}
+	log.WithField("echis_patient_id", missing.ECHISID).Infof("Queued %d results of matched missing client", len(results))
+	return missing.ClearResults()
+}
@@ -10,7 +10,7 @@ import (
 	"rtcgw/config"
 	"rtcgw/models"
 	"rtcgw/models/tracker"
-	"time"
+	"rtcgw/utils"
 )
 
 const (
@@ -33,10 +33,15 @@ func HandleResultsTask(cxt context.Context, task *asynq.Task) error {
 	// Send the results to DHIS2
 	log.Printf("Sending result to DHIS2 for PatientID: %v", result.PatientID)
 	resultUpdatde := false
-	if patientLog, ok := result.InDhis2(); ok {
+	patientLog, ok, err := result.InDhis2()
+	if err != nil {
+		// the patient may well be in DHIS2, retry rather than recording them as missing
+		return err
+	}
+	if ok {
 		tbResult, diagnosed := result.GetResult()
 		log.Infof("Patient found: %v with result: %s and event: %s", patientLog.ECHISID, tbResult, patientLog.EventID)
-		resultsDate, err := time.Parse("2006-01-02 15:04:05", result.ResultDate)
+		resultsDate, err := utils.ParseResultDate(result.ResultDate)
 		if err != nil {
 			fmt.Println("Error parsing date:", err)
 			return err
@@ -56,6 +61,7 @@ func HandleResultsTask(cxt context.Context, task *asynq.Task) error {
 			},
 		}
 		// Iterate through dv and create EventUpdatePayload and send to DHIS2
+		var conflicts []string
 		for _, v := range dv {
 			ep := tracker.EventUpdatePayload{
 				Event:         patientLog.EventID,
@@ -84,14 +90,13 @@ func HandleResultsTask(cxt context.Context, task *asynq.Task) error {
 					log.Infof("Error unmarshalling response: %v", err)
 					continue
 				}
-				conflictMsg := tracker.ConflictsToError(data.Response.Conflicts).Error()
-				if conflictMsg != "" {
-					patientLog.ResultsUpdateErrors = conflictMsg
-					patientLog.SetResultsUpdateErrors(conflictMsg)
-				} else {
-					patientLog.ResultsUpdateErrors = conflictMsg
-					patientLog.SetResultsUpdateErrors("")
+				conflictMsg := ""
+				if conflictErr := tracker.ConflictsToError(data.Response.Conflicts); conflictErr != nil {
+					conflictMsg = conflictErr.Error()
+					conflicts = append(conflicts, tracker.ConflictMessages(data.Response.Conflicts)...)
 				}
+				patientLog.ResultsUpdateErrors = conflictMsg
+				patientLog.SetResultsUpdateErrors(conflictMsg)
 				resultUpdatde = false
 				continue
 			}
@@ -99,6 +104,11 @@ func HandleResultsTask(cxt context.Context, task *asynq.Task) error {
 		}
 		if resultUpdatde {
 			patientLog.SetResultUpdated()
+		} else {
+			if len(conflicts) == 0 {
+				conflicts = []string{"Failed to update results in DHIS2"}
+			}
+			submissionFailed(cxt, &models.ConflictError{Conflicts: conflicts})
 		}
 		// Create Enrollment into Lab Program
 		if diagnosed == "Yes" {
@@ -185,6 +195,14 @@ func HandleResultsTask(cxt context.Context, task *asynq.Task) error {
 
 		}
 
+	} else {
+		// the patient may have been registered directly in DHIS2, the missing clients job will look for them and
+		// queue the result again once they are found
+		if err := models.RecordMissingClient(result); err != nil {
+			log.WithError(err).Error("Failed to record missing client")
+		}
+		submissionFailed(cxt, &models.ConflictError{Conflicts: []string{
+			fmt.Sprintf("No client with echis_patient_id %s has been saved to DHIS2", result.PatientID)}})
 	}
 
 	log.Printf("Done sending result to DHIS2 for patient: %v", result.PatientID)
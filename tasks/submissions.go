@@ -0,0 +1,64 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"github.com/hibiken/asynq"
+	log "github.com/sirupsen/logrus"
+	"rtcgw/models"
+)
+
+type submissionContextKey struct{}
+
+// TrackSubmissions is a task middleware keeping the submission processed by a task up to date with its progress
+func TrackSubmissions(h asynq.Handler) asynq.Handler {
+	return asynq.HandlerFunc(func(ctx context.Context, task *asynq.Task) error {
+		taskID, _ := asynq.GetTaskID(ctx)
+		submission, err := models.GetSubmissionByTaskID(taskID)
+		if err != nil {
+			log.WithError(err).WithField("task", taskID).Error("Failed to get submission of task")
+		}
+		if submission == nil {
+			return h.ProcessTask(ctx, task)
+		}
+		retries, _ := asynq.GetRetryCount(ctx)
+		maxRetry, _ := asynq.GetMaxRetry(ctx)
+		return processSubmission(ctx, submission, h, task, retries, retries >= maxRetry)
+	})
+}
+
+// RunSubmission processes the submission's task inline, as synchronous submissions are, recording its progress.
+// A submission whose task fails with an error that may be retried is marked retrying
+func RunSubmission(ctx context.Context, submission *models.Submission, task *asynq.Task, h asynq.Handler) error {
+	return processSubmission(ctx, submission, h, task, 0, false)
+}
+
+// processSubmission runs the submission's task. Submissions whose task fails on its last attempt are marked failed,
+// otherwise they are marked synced unless the handler marks them failed
+func processSubmission(ctx context.Context, submission *models.Submission, h asynq.Handler, task *asynq.Task,
+	retries int, lastAttempt bool) error {
+	setSubmissionStatus(submission, models.SubmissionProcessing, nil, retries)
+	err := h.ProcessTask(context.WithValue(ctx, submissionContextKey{}, submission), task)
+	switch {
+	case err != nil && (lastAttempt || errors.Is(err, asynq.SkipRetry)):
+		setSubmissionStatus(submission, models.SubmissionFailed, err, retries)
+	case err != nil:
+		setSubmissionStatus(submission, models.SubmissionRetrying, err, retries)
+	case submission.Status == models.SubmissionProcessing:
+		setSubmissionStatus(submission, models.SubmissionSynced, nil, retries)
+	}
+	return err
+}
+
+// submissionFailed marks the submission processed by the task in ctx failed, e.g. when DHIS2 rejects it
+func submissionFailed(ctx context.Context, reason error) {
+	if submission, ok := ctx.Value(submissionContextKey{}).(*models.Submission); ok {
+		setSubmissionStatus(submission, models.SubmissionFailed, reason, submission.Retries)
+	}
+}
+
+func setSubmissionStatus(submission *models.Submission, status string, lastError error, retries int) {
+	if err := submission.SetStatus(status, lastError, retries); err != nil {
+		log.WithError(err).WithField("submission", submission.ID).Error("Failed to update submission status")
+	}
+}
@@ -0,0 +1,27 @@
+package tasks
+
+import (
+	"context"
+	"github.com/hibiken/asynq"
+	log "github.com/sirupsen/logrus"
+	"rtcgw/models"
+)
+
+const (
+	TypePurgeTokens = "tokens:purge"
+)
+
+func NewPurgeTokensTask() *asynq.Task {
+	return asynq.NewTask(TypePurgeTokens, nil, asynq.MaxRetry(1))
+}
+
+// HandlePurgeTokensTask removes expired and inactive API tokens
+func HandlePurgeTokensTask(ctx context.Context, task *asynq.Task) error {
+	purged, err := models.PurgeUserTokens()
+	if err != nil {
+		log.WithError(err).Error("Failed to purge user API tokens")
+		return err
+	}
+	log.Infof("Purged %d expired or inactive API tokens", purged)
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"rtcgw/config"
+)
+
+// tlsEnabled returns true if a server certificate and key are configured
+func tlsEnabled() bool {
+	return config.RTCGwConf.Server.TLSCertFile != "" && config.RTCGwConf.Server.TLSKeyFile != ""
+}
+
+// newTLSConfig returns the server TLS configuration. Client certificates signed by the configured
+// client CA are verified if presented, and required if tls_require_client_cert is set
+func newTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	caFile := config.RTCGwConf.Server.TLSClientCAFile
+	if caFile == "" {
+		if config.RTCGwConf.Server.TLSRequireClientCert {
+			return nil, errors.New("tls_require_client_cert is set but no tls_client_ca_file is configured")
+		}
+		return tlsConfig, nil
+	}
+
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read client CA file: %w", err)
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in client CA file %s", caFile)
+	}
+	tlsConfig.ClientCAs = clientCAs
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	if config.RTCGwConf.Server.TLSRequireClientCert {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// certificateIdentities returns the subject common name and SANs of a verified client certificate
+func certificateIdentities(state *tls.ConnectionState) []string {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	cert := state.PeerCertificates[0]
+	var identities []string
+	if cert.Subject.CommonName != "" {
+		identities = append(identities, cert.Subject.CommonName)
+	}
+	identities = append(identities, cert.DNSNames...)
+	identities = append(identities, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		identities = append(identities, uri.String())
+	}
+	return identities
+}
@@ -72,3 +72,7 @@ func IndexOf(slice []string, item string) int {
 	}
 	return -1
 }
+
+func Contains(slice []string, item string) bool {
+	return IndexOf(slice, item) != -1
+}
@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"github.com/goccy/go-json"
+)
+
+// RedactedValue replaces the values of redacted fields
+const RedactedValue = "[REDACTED]"
+
+// RedactJSON replaces the values of the given fields, at any depth, in a JSON document.
+// Bodies that are not valid JSON are returned as nil since they cannot be safely redacted
+func RedactJSON(body []byte, fields []string) []byte {
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil
+	}
+	redacted, err := json.Marshal(redactValue(doc, fields))
+	if err != nil {
+		return nil
+	}
+	return redacted
+}
+
+func redactValue(v interface{}, fields []string) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, item := range val {
+			if Contains(fields, k) {
+				val[k] = RedactedValue
+				continue
+			}
+			val[k] = redactValue(item, fields)
+		}
+		return val
+	case []interface{}:
+		for i, item := range val {
+			val[i] = redactValue(item, fields)
+		}
+		return val
+	default:
+		return v
+	}
+}
+
+// JSONFieldValues returns the string values of the given fields found at any depth in a JSON document
+func JSONFieldValues(body []byte, fields []string) []string {
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil
+	}
+	var values []string
+	collectFieldValues(doc, fields, &values)
+	return values
+}
+
+func collectFieldValues(v interface{}, fields []string, values *[]string) {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, item := range val {
+			if s, ok := item.(string); ok && s != "" && Contains(fields, k) {
+				*values = append(*values, s)
+				continue
+			}
+			collectFieldValues(item, fields, values)
+		}
+	case []interface{}:
+		for _, item := range val {
+			collectFieldValues(item, fields, values)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"github.com/xuri/excelize/v2"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ReadSpreadsheet returns the rows of a CSV file, or of the first sheet of an XLSX workbook, by the file's
+// extension. XLSX cells are read as stored, so dates are Excel serial numbers, see ExcelDate
+func ReadSpreadsheet(filename string, r io.Reader) ([][]string, error) {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".csv":
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		// spreadsheet programs may save CSV files with a byte order mark
+		data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+		reader := csv.NewReader(bytes.NewReader(data))
+		reader.FieldsPerRecord = -1
+		reader.LazyQuotes = true
+		reader.TrimLeadingSpace = true
+		return reader.ReadAll()
+	case ".xlsx":
+		workbook, err := excelize.OpenReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer func() { _ = workbook.Close() }()
+		return workbook.GetRows(workbook.GetSheetName(0), excelize.Options{RawCellValue: true})
+	}
+	return nil, fmt.Errorf("unsupported file type %q, only .csv and .xlsx files are supported", filepath.Ext(filename))
+}
+
+// ExcelDate converts an Excel serial date, as XLSX cells store dates, to a date and time in local time
+func ExcelDate(value string) (time.Time, bool) {
+	serial, err := strconv.ParseFloat(value, 64)
+	if err != nil || serial <= 0 {
+		return time.Time{}, false
+	}
+	t, err := excelize.ExcelDateToTime(serial, false)
+	if err != nil {
+		return time.Time{}, false
+	}
+	// Excel dates have no time zone, so they are read as local time like other LabXpert result dates
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.Local), true
+}
@@ -1,8 +1,10 @@
 package utils
 
 import (
+	"fmt"
 	"github.com/go-playground/validator/v10"
 	"regexp"
+	"time"
 )
 
 var ugandaNINRegex = regexp.MustCompile(`^C[MF]\d{2}[A-Za-z0-9]{10}$`)
@@ -10,12 +12,28 @@ var dhis2UID = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]{10}$`)
 var yesNo = regexp.MustCompile(`^(Yes|No)$`)
 var maleFemale = regexp.MustCompile(`^(Male|Female)$`)
 
+// MTBResults are the MTB results reported by LabXpert
+var MTBResults = []string{"DETECTED VERY LOW", "DETECTED LOW", "DETECTED MEDIUM", "DETECTED HIGH",
+	"NOT DETECTED", "ERROR", "INVALID", "NO RESULT"}
+
+// RRResults are the rifampicin resistance results reported by LabXpert
+var RRResults = []string{"DETECTED", "NOT DETECTED", "INDETERMINATE", "Invalid", "Error"}
+
+// ResultDateLayouts are the accepted layouts of LabXpert result dates, which are in local time unless they
+// carry a time zone
+var ResultDateLayouts = []string{"2006-01-02 15:04:05", "2006-01-02T15:04:05", time.RFC3339, "2006-01-02"}
+
 // UgandaNINValidation is the custom validator function.
 func UgandaNINValidation(fl validator.FieldLevel) bool {
 	nin, ok := fl.Field().Interface().(string)
 	if !ok {
 		return false
 	}
+	return IsUgandaNIN(nin)
+}
+
+// IsUgandaNIN checks that nin is empty, since NIN is optional, or a Ugandan national identification number
+func IsUgandaNIN(nin string) bool {
 	// Allow empty string since NIN is optional.
 	if nin == "" {
 		return true
@@ -29,6 +47,11 @@ func Dhis2UIDValidation(fl validator.FieldLevel) bool {
 	if !ok {
 		return false
 	}
+	return IsDHIS2UID(uid)
+}
+
+// IsDHIS2UID checks that uid is a DHIS2 UID
+func IsDHIS2UID(uid string) bool {
 	return dhis2UID.MatchString(uid)
 }
 
@@ -38,7 +61,12 @@ func YesNoValidation(fl validator.FieldLevel) bool {
 	if !ok {
 		return false
 	}
-	return yesNo.MatchString(yesNoValue)
+	return IsYesNo(yesNoValue)
+}
+
+// IsYesNo checks that value is exactly Yes or No
+func IsYesNo(value string) bool {
+	return yesNo.MatchString(value)
 }
 
 // MaleFemaleValidation ... is the custom validator function.
@@ -47,5 +75,42 @@ func MaleFemaleValidation(fl validator.FieldLevel) bool {
 	if !ok {
 		return false
 	}
-	return maleFemale.MatchString(maleFemaleValue)
+	return IsMaleFemale(maleFemaleValue)
+}
+
+// IsMaleFemale checks that value is exactly Male or Female
+func IsMaleFemale(value string) bool {
+	return maleFemale.MatchString(value)
+}
+
+// MTBValidation checks that the value is one of MTBResults
+func MTBValidation(fl validator.FieldLevel) bool {
+	mtb, ok := fl.Field().Interface().(string)
+	return ok && Contains(MTBResults, mtb)
+}
+
+// RRValidation checks that the value is one of RRResults
+func RRValidation(fl validator.FieldLevel) bool {
+	rr, ok := fl.Field().Interface().(string)
+	return ok && Contains(RRResults, rr)
+}
+
+// ResultDateValidation checks that the value is a date in one of ResultDateLayouts that is not in the future
+func ResultDateValidation(fl validator.FieldLevel) bool {
+	resultDate, ok := fl.Field().Interface().(string)
+	if !ok {
+		return false
+	}
+	t, err := ParseResultDate(resultDate)
+	return err == nil && !t.After(time.Now())
+}
+
+// ParseResultDate parses a LabXpert result date in any of the ResultDateLayouts
+func ParseResultDate(value string) (time.Time, error) {
+	for _, layout := range ResultDateLayouts {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("result date %q does not match any of the layouts %v", value, ResultDateLayouts)
 }
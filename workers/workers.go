@@ -11,8 +11,9 @@ import (
 const redisAddr = "127.0.0.1:6379"
 
 func main() {
+	redisOpt := asynq.RedisClientOpt{Addr: config.RTCGwConf.Server.RedisAddress}
 	srv := asynq.NewServer(
-		asynq.RedisClientOpt{Addr: config.RTCGwConf.Server.RedisAddress},
+		redisOpt,
 		asynq.Config{
 			// Specify how many concurrent workers to use
 			Concurrency: config.RTCGwConf.Server.MaxConcurrent,
@@ -28,10 +29,34 @@ func main() {
 
 	// mux maps a type to a handler
 	mux := asynq.NewServeMux()
+	mux.Use(tasks.TrackSubmissions)
 	mux.HandleFunc(tasks.TypeSendResults, tasks.HandleResultsTask)
 	mux.HandleFunc(tasks.TypeCreateClient, tasks.HandleClientTask)
+	mux.HandleFunc(tasks.TypeUpdateClient, tasks.HandleClientUpdateTask)
+	mux.HandleFunc(tasks.TypePurgeTokens, tasks.HandlePurgeTokensTask)
+	mux.HandleFunc(tasks.TypePurgeIdempotentRequests, tasks.HandlePurgeIdempotentRequestsTask)
+	mux.HandleFunc(tasks.TypeBackfillMissingClients, tasks.HandleBackfillMissingClientsTask)
 	// ...register other handlers...
 
+	// scheduler enqueues the periodic maintenance tasks
+	scheduler := asynq.NewScheduler(redisOpt, nil)
+	if _, err := scheduler.Register(
+		config.RTCGwConf.Server.TokenPurgeSchedule, tasks.NewPurgeTokensTask()); err != nil {
+		log.Fatalf("could not register token purge task: %v", err)
+	}
+	if _, err := scheduler.Register(
+		config.RTCGwConf.Server.IdempotencyPurgeSchedule, tasks.NewPurgeIdempotentRequestsTask()); err != nil {
+		log.Fatalf("could not register idempotent request purge task: %v", err)
+	}
+	if _, err := scheduler.Register(
+		config.RTCGwConf.Server.MissingClientsSchedule, tasks.NewBackfillMissingClientsTask()); err != nil {
+		log.Fatalf("could not register missing clients backfill task: %v", err)
+	}
+	if err := scheduler.Start(); err != nil {
+		log.Fatalf("could not start scheduler: %v", err)
+	}
+	defer scheduler.Shutdown()
+
 	if err := srv.Run(mux); err != nil {
 		log.Fatalf("could not run server: %v", err)
 	}